@@ -7,217 +7,11895 @@ Date: 2023-05-29
 Version: v0.0.2-Beta
 Description: Golang implementation of "debugAPK.sh" script.
 
-Usage: go run debugAPK.go [APK_FILE]
+Usage: go run debugAPK.go [OPTIONS] <APK_FILE|APK_URL> [APKTOOL_JAR]
+
+The debug APK is written next to the input as <name>.debug.apk, or to -o.
+An http(s) input is downloaded into the temporary directory first, and its
+debug APK is written to the current directory.
+An -o path without an extension gets .apk appended; any other extension is
+kept with a warning (an error under -strict), since installers may not
+recognize the file.
 
 */
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	verifyInstall  bool
+	uninstallAfter bool
+	apktoolVersion string
+	keepDecompiled bool
+	keepMode       string
+	projectName    string
+	javaHeap       string
+	maxJava        int
+	javaOpts       stringList
+	aapt2Args      stringList
+	signingProps   string
+	nextSigners    stringList
+	keystore       string
+	extraKeystores []keystorePair
+	keystoreType   string
+	pkcs11Config   string
+	keyAlias       string
+	storePassword  string
+	keyPassword    string
+	compression    string
+	jsonOutput     bool
+	verbose        bool
+	installApp     bool
+	installUser    string
+	smokeTest      bool
+	fridaAttach    bool
+	fridaScript    string
+	smokeWait      int
+	deviceTimeout  int
+	outputFormat   string
+	progressJSON   bool
+	backupOriginal bool
+	outputFile     string
+	strict         bool
+	noSign         bool
+	signManifest   string
+	legacyStorage  bool
+	removeComps    stringList
+	obbFiles       stringList
+	removeCompCode bool
+	bypassRoot     bool
+	methodCounts   bool
+	scanSecrets    bool
+	emitManifest   bool
+	secretsSARIF   string
+	noAnalytics    bool
+	verifyWith     string
+	analyticsKeep  stringList
+	wrapSh         string
+	instrumentSpec string
+	injectProvider string
+	mergeSmaliDir  string
+	postCommand    string
+	postAllowFail  bool
+	appAttrs       stringList
+	theme          string
+	preserveOrder  bool
+	stripMetaInf   bool
+	bundleModule   string
+	allFilesAccess bool
+	updateNotice   bool
+	showVersion    bool
+	onlyIfChanged  bool
+	maxSize        string
+	force          bool
+	serve          bool
+	undebugMode    bool // the undebug command
+	servePort      int
+	serveDownloads int
+	serveTimeout   int
+	inputSHA256    string
+	downloadTime   int
+	debugProfile   bool
+	cleartext      bool
+	extractLibs    bool
+	auditLog       string
+	strictModeOn   bool
+	releaseKey     string
+	allowExpired   bool
+	mirrors        stringList
+	unverifiedOK   bool
+	artifactCACert string
+	apktoolSHA256  string
 )
 
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// keystorePair is a -keystore given after the first, with the -ks-alias
+// that follows it: another key to sign with, like a -next-signer.
+type keystorePair struct {
+	file, alias string
+}
+
+// keystoreFlag is -keystore: the first sets keystore, each further one adds
+// a keystorePair.
+type keystoreFlag struct{}
+
+func (keystoreFlag) String() string {
+	files := []string{keystore}
+	for _, k := range extraKeystores {
+		files = append(files, k.file)
+	}
+	return strings.Join(files, ",")
+}
+
+func (keystoreFlag) Set(value string) error {
+	if keystore == "" {
+		keystore = value
+	} else {
+		extraKeystores = append(extraKeystores, keystorePair{file: value})
+	}
+	return nil
+}
+
+// aliasFlag is -ks-alias, the key of the last -keystore before it.
+type aliasFlag struct{}
+
+func (aliasFlag) String() string {
+	aliases := []string{keyAlias}
+	for _, k := range extraKeystores {
+		aliases = append(aliases, k.alias)
+	}
+	return strings.Join(aliases, ",")
+}
+
+func (aliasFlag) Set(value string) error {
+	alias := &keyAlias
+	if n := len(extraKeystores); n > 0 {
+		alias = &extraKeystores[n-1].alias
+	}
+	if *alias != "" {
+		return errors.New("given twice for the same -keystore")
+	}
+	*alias = value
+	return nil
+}
+
+// defineFlags registers the options of the regular pipeline, which sign
+// shares, on the command line flag set.
+func defineFlags() {
+	flag.BoolVar(&verifyInstall, "verify-install", false, "Install the signed APK on a connected device and check it's debuggable there")
+	flag.BoolVar(&uninstallAfter, "uninstall-after", false, "Uninstall the app again after -verify-install succeeds")
+	flag.StringVar(&apktoolVersion, "apktool-version", "", "Use this apktool release (downloaded into the cache on demand)")
+	flag.StringVar(&apktoolSHA256, "apktool-sha256", "", "Expected SHA-256 of the -apktool-version jar")
+	flag.Var(&mirrors, "artifact-mirror", "Base URL of a mirror to download tools from before GitHub (repeatable)")
+	flag.BoolVar(&unverifiedOK, "allow-unverified-mirror", false, "Download tools from an -artifact-mirror even without a SHA-256 to check them against")
+	flag.StringVar(&artifactCACert, "artifact-ca-cert", "", "PEM file of extra CA certificates to trust for downloads")
+	flag.BoolVar(&keepDecompiled, "keep-decompiled", false, "Keep the decompiled sources next to the debug APK")
+	flag.StringVar(&keepMode, "keep-mode", "move", "How the kept decompiled tree is made: move, link or copy")
+	flag.StringVar(&projectName, "project-name", "", "Name of the decompiled project directory (default: the app's package id)")
+	flag.StringVar(&javaHeap, "java-heap", "", "Maximum JVM heap for apktool, e.g. 4g")
+	flag.Var(&javaOpts, "java-opt", "Extra JVM option for apktool (repeatable)")
+	flag.Var(&aapt2Args, "aapt2-arg", "Extra aapt2 option for the rebuild, e.g. --no-version-vectors (repeatable)")
+	flag.IntVar(&maxJava, "max-parallel-java", 0, "Run at most this many apktool JVMs at once across all runs on this machine (default: by free memory)")
+	flag.StringVar(&signingProps, "signing-props", "", "Sign with the keystore described by a keystore.properties file")
+	flag.Var(&nextSigners, "next-signer", "keystore.properties file of another key to sign with as well (repeatable, apksigner only)")
+	flag.Var(keystoreFlag{}, "keystore", "Sign with a key from this JKS or PKCS12 keystore (repeatable, the others sign as well)")
+	flag.StringVar(&keystoreType, "ks-type", "", "Keystore type: jks, pkcs12 or pkcs11 for a hardware token (default: detected)")
+	flag.StringVar(&pkcs11Config, "pkcs11-config", "", "SunPKCS11 provider config of the -ks-type pkcs11 token")
+	flag.Var(aliasFlag{}, "ks-alias", "Alias of the key of the -keystore before it, needed when that holds several")
+	flag.StringVar(&storePassword, "storepass", "", "Password of the -keystore (prompted for when missing)")
+	flag.StringVar(&auditLog, "audit-log", "", "Append a JSON line to this file for every signing (best set in the config file)")
+	flag.BoolVar(&allowExpired, "allow-expired-cert", false, "Sign with an expired -keystore or -signing-props certificate")
+	flag.StringVar(&keyPassword, "keypass", "", "Password of the -ks-alias key (default: the -storepass)")
+	flag.StringVar(&compression, "compression", "", "Re-compress the rebuilt APK: store, fast or best")
+	flag.StringVar(&verifyWith, "verify-with", "auto", "Verify the signature with apksigner, jarsigner or auto")
+	flag.BoolVar(&jsonOutput, "json", false, "Print a JSON report on stdout (progress goes to stderr)")
+	flag.StringVar(&installUser, "install-user", "", "Install for this user ID (or current, or all) instead of all users")
+	flag.BoolVar(&installApp, "install", false, "Install the debug APK on the connected device")
+	flag.BoolVar(&smokeTest, "smoke-test", false, "After -install, launch the app and check it doesn't crash")
+	flag.BoolVar(&fridaAttach, "frida-attach", false, "After -install, launch the app and forward the port of its Frida gadget")
+	flag.StringVar(&fridaScript, "frida-script", "", "With -frida-attach, run frida attached to the gadget with this script")
+	flag.IntVar(&smokeWait, "smoke-wait", 5, "Seconds the app has to stay alive during -smoke-test")
+	flag.IntVar(&deviceTimeout, "device-timeout", 30, "Seconds to wait for the device to come online and finish booting")
+	flag.StringVar(&inputSHA256, "sha256", "", "Expected SHA-256 of the input APK")
+	flag.IntVar(&downloadTime, "download-timeout", 300, "Seconds each download attempt may take")
+	flag.StringVar(&outputFormat, "output-format", "apk", "Output a signed APK (apk) or the patched decompiled tree (dir)")
+	flag.BoolVar(&progressJSON, "progress-json", false, "Stream stage start/end events as JSON lines on stderr")
+	flag.BoolVar(&verbose, "verbose", false, "Print the retries of adb commands that failed for a moment")
+	flag.BoolVar(&backupOriginal, "backup-original", false, "Back up an existing output file before it's overwritten")
+	flag.StringVar(&outputFile, "o", "", "Output file (default <name>.debug.apk next to the input)")
+	flag.BoolVar(&strict, "strict", false, "Turn warnings about the output into errors")
+	flag.BoolVar(&noSign, "no-sign", false, "Leave the output unsigned, e.g. to sign it elsewhere")
+	flag.StringVar(&signManifest, "signing-manifest", "", "With sign, the signing manifest the APK must match (default: APK.sign.json, if any)")
+	flag.BoolVar(&legacyStorage, "legacy-external-storage", false, "Set android:requestLegacyExternalStorage=\"true\" on the application")
+	flag.BoolVar(&debugProfile, "debug-profile", false, "Shorthand for -cleartext-traffic -extract-native-libs")
+	flag.BoolVar(&cleartext, "cleartext-traffic", false, "Set android:usesCleartextTraffic=\"true\" on the application")
+	flag.BoolVar(&extractLibs, "extract-native-libs", false, "Set android:extractNativeLibs=\"true\" on the application")
+	flag.BoolVar(&strictModeOn, "strict-mode", false, "Turn on StrictMode's default checks when the app starts")
+	flag.BoolVar(&allFilesAccess, "all-files-access", false, "Request MANAGE_EXTERNAL_STORAGE (all files access)")
+	flag.Var(&obbFiles, "obb", "OBB expansion file of the app to put next to the debug APK, and push with -install (repeatable)")
+	flag.Var(&removeComps, "remove-component", "Remove an activity, service, receiver or provider from the manifest (repeatable)")
+	flag.BoolVar(&removeCompCode, "remove-component-code", false, "Also delete the smali classes of -remove-component components")
+	flag.BoolVar(&bypassRoot, "bypass-root-detection", false, "Make known root checks (RootBeer, RootTools, su path checks) in the smali return false")
+	flag.BoolVar(&methodCounts, "report-method-counts", false, "Estimate the method references in each dex before rebuilding")
+	flag.BoolVar(&emitManifest, "emit-manifest-artifact", false, "Write the original and patched manifest and the edits made to <name>.manifest.json")
+	flag.BoolVar(&scanSecrets, "scan-secrets", false, "Look for API keys, private keys and other secrets in the decoded app")
+	flag.StringVar(&secretsSARIF, "secrets-sarif", "", "With -scan-secrets, also write the findings to this SARIF file")
+	flag.BoolVar(&noAnalytics, "disable-analytics", false, "Remove or turn off the components of known analytics and crash reporting SDKs")
+	flag.Var(&analyticsKeep, "analytics-keep", "SDK, component or meta-data name for -disable-analytics to leave alone (repeatable)")
+	flag.BoolVar(&preserveOrder, "preserve-order", false, "Reorder the rebuilt APK's entries to follow the input APK")
+	flag.BoolVar(&stripMetaInf, "strip-meta-inf", false, "With sign, remove all of META-INF, not only the old signature")
+	flag.StringVar(&bundleModule, "module", "base", "Module of an app bundle (.aab) whose manifest to make debuggable")
+	flag.Var(&appAttrs, "set-app-attr", "Set android:NAME=VALUE on the application, e.g. hardwareAccelerated=false (repeatable)")
+	flag.StringVar(&theme, "theme", "", "Set android:theme on the application to this style, e.g. @style/Theme.Debug")
+	flag.StringVar(&injectProvider, "inject-provider", "", "Declare a content provider CLASS, created before Application.onCreate")
+	flag.StringVar(&mergeSmaliDir, "merge-smali-dir", "", "Add the smali classes of DIR to the app, as a dex of their own")
+	flag.StringVar(&postCommand, "post-command", "", "Run this shell command on the output once it's built, e.g. 'upload {{.Output}}'")
+	flag.BoolVar(&postAllowFail, "post-command-allow-fail", false, "Only warn when the -post-command fails")
+	flag.StringVar(&instrumentSpec, "add-instrumentation", "", "Declare an instrumentation: runner=CLASS[,target=PACKAGE][,test-library]")
+	flag.StringVar(&wrapSh, "wrap-sh", "", "Install this wrap.sh in every lib/<abi> directory of the app")
+	flag.BoolVar(&serve, "serve", false, "Serve the debug APK over HTTP on the local network, with a QR code of its URL")
+	flag.IntVar(&servePort, "serve-port", 0, "Port for -serve and serve (default: any free one)")
+	flag.IntVar(&serveDownloads, "serve-downloads", 1, "Stop serving after this many downloads")
+	flag.IntVar(&serveTimeout, "serve-timeout", 600, "Stop serving after this many seconds")
+	flag.StringVar(&maxSize, "max-size", "", "Warn (fail under -strict) when the output is bigger than this, e.g. 100m or 50MB")
+	flag.BoolVar(&onlyIfChanged, "only-if-changed", false, "Skip the run when the output was built from the same input with the same options")
+	flag.BoolVar(&force, "force", false, "With -only-if-changed, run even when nothing changed")
+	flag.BoolVar(&showVersion, "version", false, "Print the version of debugAPK and of the tools it uses")
+	flag.BoolVar(&updateNotice, "update-notice", false, "Say when a newer version is released (checked once a day)")
+	flag.StringVar(&releaseKey, "release-key", "", "Ed25519 public key (PEM) that self-update requires release checksums to be signed with")
+}
+
 func main() {
-	if len(os.Args) == 1 {
-		fmt.Println("Usage: go run main.go <APK_FILE> [APKTOOL_JAR]")
+	// apktool runs this binary as aapt2 when -aapt2-arg is given.
+	if spec := os.Getenv(aapt2WrapperEnv); spec != "" {
+		os.Exit(runAapt2(spec, os.Args[1:]))
+	}
+
+	defineFlags()
+	flag.Usage = usage
+
+	if len(os.Args) > 1 && os.Args[1] == "apktool" {
+		apktoolCommand(os.Args[2:])
 		return
 	}
 
-	apk := os.Args[1]
-	apktool := "apktool"
-	apktoolArgs := []string{}
-	debugFlag := false // buggy
-	// if len(os.Args) >= 3 && os.Args[2] == "debug" {
-	// 	debugFlag = true
-	// }
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signCommand(os.Args[2:])
+		return
+	}
 
-	installedVersion, err := getInstalledVersion(apktool)
-	if err != nil {
-		log.Fatal("Failed to check installed apktool version: ", err)
+	if len(os.Args) > 1 && os.Args[1] == "examples" {
+		printExamples()
+		return
 	}
 
-	installedVersionStr := strings.Fields(string(installedVersion))[0]
+	if len(os.Args) > 1 && os.Args[1] == "exit-codes" {
+		exitCodesCommand(os.Args[2:])
+		return
+	}
 
-	// For "ERROR: brut.androlib.AndrolibException: brut.common.BrutException: could not exec (exit code = 1)",
-	// Try different versions of apktool jar from github.
-	if len(os.Args) > 2 && fileExists(os.Args[2]) {
-		fmt.Println("Using custom apktool jar:", os.Args[2])
-		apktool = "java"
-		apktoolArgs = append(apktoolArgs, "-jar", os.Args[2])
-	} else if installedVersionStr != "" {
-		fmt.Println("Using installed version of apktool:", installedVersionStr)
-	} else {
-		fmt.Println("APKTOOL is not installed. Please install APKTOOL and try again.")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyCommand(os.Args[2:])
+		return
 	}
 
-	if _, err := exec.LookPath("keytool"); err != nil {
-		log.Fatal("I require keytool but it's not installed. Aborting.")
+	if len(os.Args) > 1 && os.Args[1] == "keystore" {
+		keystoreCommand(os.Args[2:])
+		return
 	}
 
-	if _, err := exec.LookPath("jarsigner"); err != nil {
-		log.Fatal("I require jarsigner but it's not installed. Aborting.")
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		manifestCommand(os.Args[2:])
+		return
 	}
 
-	tmpDir, err := ioutil.TempDir("", "apkdebug")
-	if err != nil {
-		log.Fatal("Failed to create temporary directory:", err)
+	if len(os.Args) > 1 && os.Args[1] == "permissions" {
+		permissionsCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "links" {
+		linksCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "libs" {
+		libsCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "pins" {
+		pinsCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctorCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "clean" {
+		cleanCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		selfUpdateCommand(os.Args[2:])
+		return
+	}
+
+	// undebug is the regular pipeline, with the flag set the other way.
+	if len(os.Args) > 1 && os.Args[1] == "undebug" {
+		undebugMode = true
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+
+	flag.Parse()
+
+	if err := loadConfig(); err != nil {
+		exitWith(exitUsage, "Failed to load config: ", err)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	debugAPK := strings.TrimSuffix(apk, filepath.Ext(apk)) + ".debug.apk"
+	if showVersion {
+		printVersion()
+		return
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		return
+	}
 
-	if _, err := os.Stat(apk); err == nil {
-		fmt.Println("=> Unpacking APK...")
-		unpackArgs := append(apktoolArgs, "-q", "d", apk, "-o", filepath.Join(tmpDir, "app"))
-		cmd := exec.Command(apktool, unpackArgs...)
-		err = processCMD(cmd, debugFlag)
+	// Under -json, stdout carries only the report; everything else that
+	// would be printed, including child process output, goes to stderr.
+	// When the -progress-json events are on stderr as well, they replace it.
+	stdout := os.Stdout
+	if jsonOutput && progressJSON {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 		if err != nil {
-			log.Fatal("Failed to unpack APK: ", err)
+			log.Fatal(err)
 		}
+		os.Stdout = devNull
+	} else if jsonOutput {
+		os.Stdout = os.Stderr
+	}
 
-		fmt.Println("=> Adding debug flag...")
-		manifestPath := filepath.Join(tmpDir, "app", "AndroidManifest.xml")
-		if err := addDebuggableFlag(manifestPath); err != nil {
-			log.Fatal("Failed to add debug flag: ", err)
-		}
+	if err := checkOptions(); err != nil {
+		exitWith(exitUsage, err)
+	}
 
-		fmt.Println("=> Repacking APK...")
-		repackArgs := append(apktoolArgs, "-q", "b", filepath.Join(tmpDir, "app"), "--use-aapt2", "-o", debugAPK)
-		cmd = exec.Command(apktool, repackArgs...)
-		err = processCMD(cmd, debugFlag)
+	apk := flag.Arg(0)
+	if strings.EqualFold(filepath.Ext(apk), ".aab") && !isURL(apk) {
+		os.Stdout = stdout
+		debugBundle()
+		return
+	}
+	b := &build{
+		apk:    apk,
+		output: strings.TrimSuffix(apk, filepath.Ext(apk)) + outputSuffix(),
+		result: &report{Input: redactURL(apk)},
+	}
+	if isURL(apk) {
+		name, err := urlFileName(apk)
+		if err != nil {
+			exitWith(exitUsage, err)
+		}
+		b.url, b.apk = apk, ""
+		b.output = strings.TrimSuffix(name, filepath.Ext(name)) + outputSuffix()
+	}
+	if outputFile != "" {
+		output, warning, err := outputPath(outputFile, ".apk")
 		if err != nil {
-			log.Fatal("Failed to repackage APK:", err)
+			exitWith(exitUsage, err)
 		}
+		if warning != "" {
+			fmt.Println("WARNING:", warning)
+			b.result.Warnings = append(b.result.Warnings, warning)
+		}
+		b.output = output
+	}
+	if progressJSON {
+		b.progress = &progress{w: os.Stderr}
+	}
+	b.debugFlag = false // buggy
+	// if len(os.Args) >= 3 && os.Args[2] == "debug" {
+	// 	debugFlag = true
+	// }
+
+	// Before prepare, which may ask for passwords and download apktool.
+	if _, err := os.Stat(apk); err != nil && b.url == "" {
+		fmt.Println("File not found: ", apk)
+		os.Exit(exitInput)
+	}
+
+	if err := b.prepare(flag.Arg(1)); err != nil {
+		exitWith(exitCodeOf(err), err)
+	}
 
-		fmt.Println("=> Signing APK...")
-		keyStorePath := filepath.Join(tmpDir, "keystore")
-		if err := generateKeyStore(keyStorePath, debugFlag); err != nil {
-			log.Fatal("Failed to generate keystore: ", err)
+	var fingerprint string
+	if onlyIfChanged {
+		if b.url != "" {
+			exitWith(exitUsage, "-only-if-changed needs a local input, a URL's content is only known once it's downloaded")
+		}
+		var err error
+		if fingerprint, err = b.fingerprint(flag.Args()[1:]); err != nil {
+			log.Fatal("Failed to fingerprint the build: ", err)
 		}
+		if !force && upToDate(b.output, fingerprint) {
+			fmt.Println(b.output, "is up to date: it was built from the same input with the same options, pass -force to rebuild it")
+			b.result.Output = b.output
+			b.result.UpToDate = true
+			if jsonOutput {
+				enc := json.NewEncoder(stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(b.result); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		}
+	}
 
-		cmd = exec.Command("jarsigner", "-keystore", keyStorePath, "-storepass", "password", "-keypass", "password", debugAPK, "alias1")
-		err = processCMD(cmd, debugFlag)
-		if err != nil {
-			log.Fatal("Failed to sign APK: ", err)
+	if err := b.run(); err != nil {
+		exitWith(exitCodeOf(err), err)
+	}
+	if fingerprint != "" {
+		if err := recordFingerprint(b.output, fingerprint); err != nil {
+			b.warnf("Failed to record the build for -only-if-changed: %v", err)
 		}
+	}
 
-		fmt.Println("=> Checking your debug APK...")
-		if err := verifyAPK(debugAPK); err != nil {
-			log.Fatal("Failed to verify debug APK: ", err)
+	if b.format() == "dir" {
+		fmt.Println("Your patched sources: ", b.keptDir)
+		b.result.Output = b.keptDir
+	} else {
+		if undebugMode {
+			fmt.Println("Your non-debuggable APK: ", b.output)
+		} else {
+			fmt.Println("Your debug APK: ", b.output)
+		}
+		b.result.Output = b.output
+		b.result.ArtifactType = "apk"
+		if b.result.Unsigned {
+			fmt.Println("It's unsigned, by request (-no-sign): sign it before installing it, with:")
+			fmt.Println("  go run debugAPK.go sign", hostArg(b.output))
+			fmt.Println("which checks it against its signing manifest:", b.result.SigningManifest)
+		} else if command, err := installCommand(b.output); err != nil {
+			b.warnf("Cannot tell how to install the debug APK: %v", err)
+		} else {
+			fmt.Println("Install it with:", command)
+			b.result.InstallCommand = command
+		}
+		if b.result.Instrument != "" {
+			fmt.Println("Run its tests with:", b.result.Instrument)
+		}
+		if b.keptDir != "" {
+			fmt.Println("Decompiled sources: ", b.keptDir)
+			b.result.DecompiledDir = b.keptDir
+		}
+	}
+	b.printApktool()
+	if updateNotice {
+		printUpdateNotice()
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(b.result); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if serve && b.format() == "apk" {
+		if err := serveFile(b.output); err != nil {
+			log.Fatal("Failed to serve the debug APK: ", err)
 		}
+	}
+	os.Exit(b.exitCode)
+}
 
-		fmt.Println("\n======")
-		fmt.Println("Success!")
-		fmt.Println("======")
-		fmt.Println("(deleting temporary directory...)")
+// checkOptions validates flag values and combinations before any work starts.
+func checkOptions() error {
+	if smokeTest && !installApp {
+		return errors.New("-smoke-test requires -install")
+	}
+	if downloadTime <= 0 {
+		return fmt.Errorf("Invalid -download-timeout %d, expected a number of seconds above 0", downloadTime)
+	}
+	kinds := map[string]string{}
+	for _, file := range obbFiles {
+		if !fileExists(file) {
+			return fmt.Errorf("OBB file %s not found", file)
+		}
+		kind := obbKind(file)
+		if other, ok := kinds[kind]; ok {
+			return fmt.Errorf("-obb %s and %s are both the %s OBB, an app has one main and one patch OBB at most", other, file, kind)
+		}
+		kinds[kind] = file
+	}
+	if fridaAttach && !installApp {
+		return errors.New("-frida-attach requires -install")
+	}
+	if installUser != "" && !installUserPattern.MatchString(installUser) {
+		return fmt.Errorf("Invalid -install-user %q, expected a user ID, current or all", installUser)
+	}
+	for _, attr := range appAttrs {
+		if _, _, err := parseAppAttr(attr); err != nil {
+			return fmt.Errorf("Invalid -set-app-attr %q: %v", attr, err)
+		}
+	}
+	if theme != "" && !styleReference.MatchString(theme) {
+		return fmt.Errorf("Invalid -theme %q, expected a style like @style/NAME or @android:style/NAME", theme)
+	}
+	if instrumentSpec != "" {
+		if _, err := parseInstrumentation(instrumentSpec); err != nil {
+			return fmt.Errorf("Invalid -add-instrumentation: %v", err)
+		}
+	}
+	if injectProvider != "" && !classNamePattern.MatchString(strings.TrimPrefix(injectProvider, ".")) {
+		return fmt.Errorf("Invalid -inject-provider %q, expected a class name like com.example.HookProvider", injectProvider)
+	}
+	if _, err := postCommandTemplate(postCommand); err != nil {
+		return fmt.Errorf("Invalid -post-command: %v", err)
+	}
+	if postAllowFail && postCommand == "" {
+		return errors.New("-post-command-allow-fail requires -post-command")
+	}
+	if info, err := os.Stat(mergeSmaliDir); mergeSmaliDir != "" && (err != nil || !info.IsDir()) {
+		return fmt.Errorf("-merge-smali-dir %s is not a directory", mergeSmaliDir)
+	}
+	if _, ok := parseSize(maxSize); maxSize != "" && !ok {
+		return fmt.Errorf("Invalid -max-size %q, expected a size like 104857600, 100m or 100MB", maxSize)
+	}
+	if force && !onlyIfChanged {
+		return errors.New("-force has no effect without -only-if-changed")
+	}
+	switch keepMode {
+	case "move", "link", "copy":
+	default:
+		return fmt.Errorf("Invalid -keep-mode %q, expected move, link or copy", keepMode)
+	}
+	if isFlagSet("keep-mode") && !keepDecompiled && outputFormat != "dir" {
+		return errors.New("-keep-mode requires -keep-decompiled or -output-format dir")
+	}
+	if onlyIfChanged && outputFormat == "dir" {
+		return errors.New("-only-if-changed compares APK outputs, it can't be used with -output-format dir")
+	}
+	if _, err := parseAapt2Args(aapt2Args); err != nil {
+		return fmt.Errorf("Invalid -aapt2-arg: %v", err)
+	}
+	if noSign {
+		for _, name := range []string{"install", "verify-install", "serve", "obb", "keystore", "signing-props", "next-signer"} {
+			if isFlagSet(name) {
+				return fmt.Errorf("-%s can't be used with -no-sign", name)
+			}
+		}
+	}
+	if signManifest != "" {
+		return errors.New("-signing-manifest is an option of the sign command")
+	}
+	if secretsSARIF != "" && !scanSecrets {
+		return errors.New("-secrets-sarif requires -scan-secrets")
+	}
+	if fridaScript != "" && !fridaAttach {
+		return errors.New("-frida-script requires -frida-attach")
+	}
+	if undebugMode {
+		for _, name := range []string{"verify-install", "debug-profile"} {
+			if isFlagSet(name) {
+				return fmt.Errorf("-%s makes no sense with undebug", name)
+			}
+		}
+	}
 
-		if err := os.RemoveAll(tmpDir); err != nil {
-			fmt.Println("=====")
-			fmt.Println("Something failed :'(")
-			fmt.Printf("Leaving temporary dir %s if you want to inspect what went wrong.\n", tmpDir)
-			log.Fatal(err)
+	switch outputFormat {
+	case "apk":
+	case "dir":
+		// Nothing is rebuilt, so nothing can be compressed, signed or installed.
+		for _, name := range []string{"o", "signing-props", "keystore", "compression", "install", "verify-install", "smoke-test", "preserve-order", "obb"} {
+			if isFlagSet(name) {
+				return fmt.Errorf("-%s has no effect with -output-format dir", name)
+			}
 		}
+	default:
+		return fmt.Errorf("Invalid -output-format %q, expected apk or dir", outputFormat)
+	}
 
-		fmt.Println("Your debug APK: ", debugAPK)
-	} else {
-		fmt.Println("File not found: ", apk)
+	if projectName != "" {
+		name := sanitizeProjectName(projectName)
+		if name == "" {
+			return fmt.Errorf("Invalid project name %q", projectName)
+		}
+		projectName = name
 	}
-}
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+	if _, ok := compressionLevels[compression]; compression != "" && !ok {
+		return fmt.Errorf("Invalid -compression %q, expected store, fast or best", compression)
+	}
+
+	if javaHeap != "" && !heapPattern.MatchString(javaHeap) {
+		return fmt.Errorf("Invalid -java-heap %q, expected a size like 512m or 4g", javaHeap)
+	}
+	return nil
 }
 
-func processCMD(cmd *exec.Cmd, debugFlag bool) error {
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// build carries one APK through the pipeline stages.
+type build struct {
+	apk       string
+	url       string // the input, when it's downloaded into tmpDir as apk
+	output    string // the debug APK
+	tmpDir    string
+	appDir    string // the decoded project
+	keptDir   string
+	pkg       string
+	serial    string // device used by -install/-verify-install
+	apktool   *apktoolRunner
+	signing   *signingConfig
+	entry     *appEntry // where startupCode goes, once the patch stage resolved it
+	gadget    *fridaGadget
+	tests     *instrumentation // declared by -add-instrumentation
+	cosigners []*signingConfig // -next-signer keys
+	resign    bool             // the input is debuggable already, so it's only re-signed
+	debugFlag bool
+	progress  *progress
+	result    *report
+	exitCode  int
+	failed    string           // the device check that set exitCode
+	manifest  []byte           // the decoded manifest, for -emit-manifest-artifact
+	changes   []manifestChange // the patch's edits of it
+}
 
-	err := cmd.Run()
+// fileFlags are the options that name files or directories whose content
+// goes into the output, so the fingerprint covers the content rather than
+// the path.
+var fileFlags = map[string]bool{
+	"wrap-sh": true, "merge-smali-dir": true, "frida-script": true, "keystore": true,
+	"signing-props": true, "next-signer": true, "obb": true, "pkcs11-config": true,
+}
 
-	if debugFlag {
-		fmt.Println("Command output:\n", stdout.String())
-		fmt.Println("Command error:\n", stderr.String())
+// fingerprint identifies what goes into the output: the input's content,
+// the options set on the command line, in $RSIW_ARGS or the config file,
+// the content of the files and directories named by fileFlags and
+// -aapt2-arg, the apktool that runs and the signing key. args are the
+// arguments after the input, i.e. a custom apktool jar.
+func (b *build) fingerprint(args []string) (string, error) {
+	sum, err := fileSHA256(b.apk)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "debugAPK %s\ninput %s\nundebug %t\napktool %s\n", version, sum, undebugMode, b.result.ApktoolVersion)
+	if b.signing != nil && b.signing.cert != nil {
+		fmt.Fprintf(h, "key %x\n", sha256.Sum256(b.signing.cert.Raw))
+	}
+	for _, s := range b.cosigners {
+		if s.cert != nil {
+			fmt.Fprintf(h, "next key %x\n", sha256.Sum256(s.cert.Raw))
+		}
+	}
+	// The key stands in for its passwords.
+	skip := map[string]bool{"only-if-changed": true, "force": true, "storepass": true, "keypass": true}
+	var walkErr error
+	flag.Visit(func(f *flag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+		fmt.Fprintf(h, "-%s=%s\n", f.Name, f.Value)
+		values := []string{f.Value.String()}
+		switch v := f.Value.(type) {
+		case *stringList:
+			values = *v
+		case keystoreFlag:
+			values = []string{keystore}
+			for _, k := range extraKeystores {
+				values = append(values, k.file)
+			}
+		}
+		for _, value := range values {
+			var paths []string
+			switch {
+			case fileFlags[f.Name]:
+				paths = []string{value}
+			case f.Name == "aapt2-arg":
+				// Any value of an aapt2 option that is a file, e.g. a
+				// --stable-ids file.
+				paths = strings.Fields(strings.Replace(value, "=", " ", 1))[1:]
+			}
+			for _, p := range paths {
+				sum, err := contentSHA256(p)
+				if err != nil && fileFlags[f.Name] {
+					walkErr = fmt.Errorf("-%s %s: %v", f.Name, p, err)
+				}
+				if err == nil {
+					fmt.Fprintf(h, "  %s %s\n", p, sum)
+				}
+			}
+		}
+	})
+	if walkErr != nil {
+		return "", walkErr
+	}
+	for _, arg := range args {
+		if sum, err := fileSHA256(arg); err == nil {
+			arg = sum
+		}
+		fmt.Fprintf(h, "arg %s\n", arg)
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
+// contentSHA256 is the SHA-256 of a file, or of the names and contents of
+// the files under a directory.
+func contentSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
 	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fileSHA256(path)
+	}
+	h := sha256.New()
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		fmt.Fprintf(h, "%s %s\n", filepath.ToSlash(rel), sum)
 		return err
+	})
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// buildStatePath is where -only-if-changed records the fingerprint of the
+// last build of output.
+func buildStatePath(output string) string {
+	if abs, err := filepath.Abs(output); err == nil {
+		output = abs
 	}
-	return nil
+	sum := sha256.Sum256([]byte(output))
+	return filepath.Join(filepath.Dir(apktoolCacheDir()), "builds", hex.EncodeToString(sum[:16]))
 }
 
-func getInstalledVersion(apktool string) (string, error) {
-	cmd := exec.Command(apktool, "--version")
-	output, err := cmd.Output()
+// upToDate reports whether output was last built with fingerprint, and
+// hasn't changed since.
+func upToDate(output, fingerprint string) bool {
+	data, err := ioutil.ReadFile(buildStatePath(output))
 	if err != nil {
-		return "", err
+		return false
 	}
-
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	scanner.Scan()
-	version := strings.Fields(scanner.Text())[0]
-	return version, scanner.Err()
+	sum, err := fileSHA256(output)
+	return err == nil && strings.TrimSpace(string(data)) == fingerprint+" "+sum
 }
 
-func addDebuggableFlag(manifestPath string) error {
-	data, err := ioutil.ReadFile(manifestPath)
+// recordFingerprint records the build of output, along with the checksum
+// of output itself.
+func recordFingerprint(output, fingerprint string) error {
+	sum, err := fileSHA256(output)
 	if err != nil {
 		return err
 	}
-
-	content := string(data)
-	content = strings.ReplaceAll(content, "android:debuggable=\"[^\"]*\" *", "")
-	content = strings.ReplaceAll(content, "<application ", "<application android:debuggable=\"true\" ")
-	if err := ioutil.WriteFile(manifestPath, []byte(content), 0644); err != nil {
+	path := buildStatePath(output)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
+	return ioutil.WriteFile(path, []byte(fingerprint+" "+sum+"\n"), 0644)
+}
 
-	return nil
+func (b *build) format() string {
+	return outputFormat
 }
 
-func generateKeyStore(keyStorePath string, debugFlag bool) error {
-	cmd := exec.Command("keytool", "-genkey", "-noprompt",
-		"-alias", "alias1",
-		"-dname", "CN=Unknown, OU=Unknown, O=Unknown, L=Unknown, S=Unknown, C=Unknown",
-		"-keystore", keyStorePath,
-		"-keyalg", "RSA",
-		"-storepass", "password",
-		"-keypass", "password",
-	)
-	err := processCMD(cmd, debugFlag)
+// prepare selects apktool and the signing key, and checks that the tools the
+// requested stages need are installed.
+func (b *build) prepare(customJar string) error {
+	apktool, usedVersion, err := selectApktool(customJar)
 	if err != nil {
+		return &exitError{exitMissingTool, err}
+	}
+	b.apktool = apktool
+	b.result.ApktoolVersion = usedVersion
+	b.result.ApktoolBundled = apktool.bundled
+
+	if b.signing, err = userSigningConfig(); err != nil {
 		return err
 	}
+	if b.signing != nil {
+		if b.signing.storeType == "pkcs11" {
+			fmt.Println("Signing with the PKCS#11 token of", b.signing.providerArg)
+		} else {
+			fmt.Println("Signing with keystore:", b.signing.storeFile)
+		}
+		key, warnings, err := checkSigningChain(b.signing)
+		if err != nil {
+			return &exitError{exitSign, err}
+		}
+		for _, w := range warnings {
+			b.warnf("%s", w)
+		}
+		b.result.SigningKey = key
+	} else if _, err := exec.LookPath("keytool"); err != nil && b.format() == "apk" && !noSign {
+		return &exitError{exitMissingTool, errors.New("I require keytool but it's not installed. Aborting.")}
+	}
+	if b.format() == "apk" && !noSign {
+		signers, warnings, err := loadNextSigners()
+		if err != nil {
+			return err
+		}
+		for _, w := range warnings {
+			b.warnf("%s", w)
+		}
+		b.cosigners = signers
+	}
+
+	if noSign && b.format() == "apk" {
+		b.result.Unsigned = true
+	} else if signerFor("apk") == "" && b.format() == "apk" {
+		return &exitError{exitMissingTool, errors.New("I require apksigner or jarsigner but neither is installed. Aborting.")}
+	}
+	if b.format() == "apk" && !noSign {
+		if b.result.Verifier, err = verifierFor("apk"); err != nil {
+			return err
+		}
+	}
 
+	if wrapSh != "" {
+		warning, err := checkWrapSh(wrapSh)
+		if err != nil {
+			return &exitError{exitUsage, fmt.Errorf("Invalid -wrap-sh %s: %v", wrapSh, err)}
+		}
+		if warning != "" {
+			b.warnf("-wrap-sh %s: %s", wrapSh, warning)
+		}
+	}
 	return nil
 }
 
-func verifyAPK(apk string) error {
-	cmd := exec.Command("jarsigner", "-verify", apk)
+// selectApktool picks the apktool to run: customJar, the -apktool-version
+// jar, the installed apktool, or the bundled jar, in that order.
+func selectApktool(customJar string) (*apktoolRunner, string, error) {
+	apktool := &apktoolRunner{name: "apktool", jvmArgs: jvmOptions()}
 
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
+	// For "ERROR: brut.androlib.AndrolibException: brut.common.BrutException: could not exec (exit code = 1)",
+	// Try different versions of apktool jar from github.
+	if customJar != "" && fileExists(customJar) {
+		fmt.Println("Using custom apktool jar:", customJar)
+		apktool.jar = customJar
+		apktoolVersion = ""
+	} else if apktoolVersion != "" {
+		jar, err := cachedApktool(apktoolVersion)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to get apktool %s: %v", apktoolVersion, err)
+		}
+		fmt.Println("Using cached apktool jar:", jar)
+		apktool.jar = jar
+	} else if _, err := exec.LookPath("apktool"); err != nil && bundledApktool != nil {
+		jar, err := bundledApktool.extract()
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to extract the bundled apktool: %v", err)
+		}
+		fmt.Println("Using bundled apktool jar:", jar)
+		apktool.jar = jar
+		apktool.bundled = true
+	} else if err != nil {
+		fmt.Println("APKTOOL is not installed. Please install APKTOOL and try again.")
+		os.Exit(exitMissingTool)
+	}
 
-	err := cmd.Run()
+	usedVersion, err := apktool.version()
 	if err != nil {
-		return err
+		return nil, "", fmt.Errorf("Failed to check apktool version: %v", err)
+	}
+	if apktoolVersion != "" && usedVersion != apktoolVersion {
+		return nil, "", fmt.Errorf("Cached jar for apktool %s reports version %s, remove it from %s and retry", apktoolVersion, usedVersion, apktoolCacheDir())
 	}
+	if apktool.jar == "" {
+		fmt.Println("Using installed version of apktool:", usedVersion)
+	}
+	return apktool, usedVersion, nil
+}
 
-	output := strings.Split(stdout.String(), "\n")
-	for i, line := range output {
-		if i >= 2 {
-			break
-		}
-		fmt.Println(line)
+// printApktool tells which apktool built the output, with a note when it
+// was the bundled jar, whose release may not be the one the user has.
+func (b *build) printApktool() {
+	if b.resign {
+		fmt.Println("Re-signed only, without a rebuild: the input was debuggable already")
+		return
+	}
+	fmt.Println("Built with apktool:", b.result.ApktoolVersion)
+	if b.result.ApktoolBundled {
+		fmt.Printf("Note: apktool isn't installed, so the apktool %s bundled in this binary ran instead. If the\n", b.result.ApktoolVersion)
+		fmt.Println("result differs from what your own apktool gives, install apktool (https://apktool.org/docs/install)")
+		fmt.Println("or pick the release you want with -apktool-version.")
 	}
+}
 
-	return nil
+// outputSuffix replaces the input's extension in the default output name.
+func outputSuffix() string {
+	if undebugMode {
+		return ".nodebug.apk"
+	}
+	return ".debug.apk"
+}
+
+func patchMessage() string {
+	if undebugMode {
+		return "Removing debug flag..."
+	}
+	return "Adding debug flag..."
+}
+
+// The exit codes of a build. exitStatuses describes them, for usage and the
+// exit-codes command.
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+	exitMissingTool
+	exitInput
+	exitDecode
+	exitBuild
+	exitSign
+	exitVerify
+	exitDevice
+	exitPostCommand
+)
+
+// exitStatus is an exit code of a build and what it means.
+type exitStatus struct {
+	Code    int    `json:"code"`
+	Name    string `json:"name"`
+	Meaning string `json:"meaning"`
+}
+
+var exitStatuses = []exitStatus{
+	{exitOK, "ok", "the output was built, or was up to date with -only-if-changed"},
+	{exitFailure, "failure", "any other error"},
+	{exitUsage, "usage", "invalid options, config file or $RSIW_ARGS"},
+	{exitMissingTool, "missing-tool", "apktool is not installed and none is bundled, or keytool or a signer isn't"},
+	{exitInput, "input", "the input or keystore is missing, unreadable, fails -sha256, or can't be downloaded"},
+	{exitDecode, "decode", "apktool failed to decode the APK"},
+	{exitBuild, "build", "patching or rebuilding the APK failed"},
+	{exitSign, "sign", "signing failed, or the key can't be unlocked"},
+	{exitVerify, "verify", "the output failed its checks: signature, debuggable flag, -max-size with -strict"},
+	{exitDevice, "device", "installing, or a check on the device (-verify-install, -smoke-test), failed"},
+	{exitPostCommand, "post-command", "the -post-command failed, without -post-command-allow-fail"},
+}
+
+// stageExitCode is the exit code of a build whose stage failed.
+func stageExitCode(stage string) int {
+	switch stage {
+	case "unpack":
+		return exitDecode
+	case "patch", "repack", "compress", "align", "resign":
+		return exitBuild
+	case "sign":
+		return exitSign
+	case "verify":
+		return exitVerify
+	case "obb", "install", "check-debuggable", "smoke-test", "frida-attach":
+		return exitDevice
+	case "post-command":
+		return exitPostCommand
+	}
+	return exitFailure
+}
+
+// exitError is an error with the exit code it ends the build with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCodeOf is the exit code err ends the build with.
+func exitCodeOf(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
+
+// exitWith logs v like log.Fatal does, and exits with code.
+func exitWith(code int, v ...interface{}) {
+	log.Print(v...)
+	os.Exit(code)
+}
+
+// example is a common invocation the examples command prints. args is what
+// follows "go run debugAPK.go", as it would be typed in a shell.
+type example struct {
+	title string
+	args  string
+}
+
+var examples = []example{
+	{"Make an APK debuggable, writing app.debug.apk next to it", "app.apk"},
+	{"Also allow plain HTTP (e.g. through an intercepting proxy) and extract the native libraries", "-debug-profile app.apk"},
+	{"Install the debug APK and check the device treats it as debuggable", "-verify-install -uninstall-after app.apk"},
+	{"Install it and check it starts without crashing", "-install -smoke-test app.apk"},
+	{"Attach Frida to the gadget the app ships, with a script", "-install -frida-attach -frida-script hook.js app.apk"},
+	{"Sign with your own key instead of a throwaway one", "-keystore release.jks -ks-alias upload app.apk"},
+	{"Only re-sign an APK, without rebuilding it", "sign app.apk"},
+	{"Re-sign a split APK set with one key, and install it", "sign -install base.apk split_config.arm64_v8a.apk"},
+	{"Keep the decoded sources next to the debug APK, to edit and rebuild them", "-keep-decompiled app.apk"},
+	{"Build only when the input or the options changed, e.g. in a build script", "-only-if-changed -json app.apk"},
+	{"Patch an APK straight from a URL, checking its checksum", "-sha256 HEX https://example.com/app.apk"},
+	{"Check the alignment and signatures of all APKs in a directory", "verify -recursive ./apks"},
+	{"See which Android and debugging tools are installed", "doctor"},
+}
+
+func printExamples() {
+	for i, e := range examples {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println("# " + e.title)
+		fmt.Println("go run debugAPK.go " + e.args)
+	}
+}
+
+func exitCodesCommand(args []string) {
+	flags := flag.NewFlagSet("exit-codes", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the exit codes as JSON")
+	flags.Parse(args)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(exitStatuses); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printExitCodes()
+}
+
+func printExitCodes() {
+	for _, s := range exitStatuses {
+		fmt.Printf("  %-3d %-25s %s\n", s.Code, s.Name, s.Meaning)
+	}
+}
+
+// stage is one step of the pipeline. Stages with an empty message run
+// without announcing themselves.
+type stage struct {
+	name    string
+	message string
+	run     func() error
+}
+
+func (b *build) stages() []stage {
+	stages := []stage{
+		{"unpack", "Unpacking APK...", b.unpack},
+		{"patch", patchMessage(), b.patch},
+	}
+	if scanSecrets {
+		stages = append(stages[:1], append([]stage{{"scan-secrets", "Scanning for secrets...", b.scanSecrets}}, stages[1:]...)...)
+	}
+	if b.resign {
+		stages = []stage{{"resign", "The APK is debuggable already, re-signing it without a rebuild...", b.stripSignature}}
+	}
+	if methodCounts {
+		stages = append(stages, stage{"method-counts", "Counting method references...", b.countMethods})
+	}
+	if b.format() == "apk" {
+		if !b.resign {
+			stages = append(stages, stage{"repack", "Repacking APK...", b.repack})
+		}
+		if compression != "" {
+			stages = append(stages, stage{"compress", fmt.Sprintf("Re-compressing APK (%s)...", compression), b.compress})
+		}
+		if noSign {
+			stages = append(stages, stage{"align", "Aligning APK...", b.align})
+		} else {
+			stages = append(stages, stage{"sign", "Signing APK...", b.sign})
+		}
+		stages = append(stages, stage{"verify", "Checking your debug APK...", b.verify})
+		if emitManifest {
+			stages = append(stages, stage{"manifest-artifact", "", b.emitManifestArtifact})
+		}
+		if len(obbFiles) > 0 {
+			stages = append(stages, stage{"obb", "Copying the OBB files...", b.copyOBBs})
+		}
+		if verifyInstall || installApp {
+			stages = append(stages, stage{"install", "Installing APK on device...", b.install})
+		}
+		if verifyInstall {
+			stages = append(stages, stage{"check-debuggable", "Checking the app is debuggable on the device...", b.checkDebuggable})
+		}
+		if smokeTest {
+			stages = append(stages, stage{"smoke-test", "", b.smoke})
+		}
+		if fridaAttach {
+			stages = append(stages, stage{"frida-attach", "Attaching to the Frida gadget...", b.attachFrida})
+		}
+	}
+	if emitManifest && b.format() != "apk" {
+		stages = append(stages, stage{"manifest-artifact", "", b.emitManifestArtifact})
+	}
+	if keepDecompiled || b.format() == "dir" {
+		stages = append(stages, stage{"keep", "", b.keep})
+	}
+	if postCommand != "" {
+		stages = append(stages, stage{"post-command", "Running the post-command...", b.runPostCommand})
+	}
+	return stages
+}
+
+// download fetches the input URL into the temporary directory, which takes
+// it away with everything else.
+func (b *build) download() error {
+	name, err := urlFileName(b.url)
+	if err != nil {
+		return err
+	}
+	d, err := newDownloader()
+	if err != nil {
+		return err
+	}
+	d.mirrors = nil
+
+	apk := filepath.Join(b.tmpDir, name)
+	a := artifact{path: name, upstream: b.url, sha256: inputSHA256, contentTypes: apkContentTypes}
+	if err := d.fetch(a, apk); err != nil {
+		return fmt.Errorf("Failed to download %s: %v", redactURL(b.url), err)
+	}
+	b.apk = apk
+	return nil
+}
+
+// apkContentTypes are the types servers label APKs with. Anything else,
+// e.g. the HTML of a login page, is refused.
+var apkContentTypes = []string{
+	"application/vnd.android.package-archive",
+	"application/octet-stream",
+	"binary/octet-stream",
+	"application/zip",
+	"application/java-archive",
+	"application/x-zip-compressed",
+}
+
+func isURL(input string) bool {
+	return strings.HasPrefix(input, "https://") || strings.HasPrefix(input, "http://")
+}
+
+// redactURL hides what a URL may carry for authentication, its user info
+// and its query (a token, or the signature of a presigned URL), so that the
+// URL can be printed and reported. Anything else is returned as is.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !isURL(s) {
+		return s
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// redactURLError is err with rawURL redacted, wherever it shows: net/http
+// quotes it in its errors, the downloader's own errors have it as is.
+func redactURLError(err error, rawURL string) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactURL(rawURL)
+	}
+	return errors.New(strings.ReplaceAll(err.Error(), rawURL, redactURL(rawURL)))
+}
+
+// urlFileName is the name of the APK a URL points at, with .apk added when
+// its last path segment doesn't end in it.
+func urlFileName(input string) (string, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL %s: %v", input, err)
+	}
+	name := sanitizeProjectName(path.Base(u.Path))
+	if name == "" || name == "_" {
+		name = "input"
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".apk") {
+		name += ".apk"
+	}
+	return name, nil
+}
+
+func (b *build) run() error {
+	tmpDir, err := ioutil.TempDir("", "apkdebug")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	b.tmpDir = tmpDir
+
+	b.appDir = filepath.Join(tmpDir, "app")
+	if projectName != "" {
+		b.appDir = filepath.Join(tmpDir, projectName)
+	}
+
+	if b.url != "" {
+		if err := b.progress.track("download", b.download); err != nil {
+			return &exitError{exitInput, err}
+		}
+	} else if inputSHA256 != "" {
+		if sum, err := fileSHA256(b.apk); err != nil {
+			return &exitError{exitInput, fmt.Errorf("Failed to read APK: %v", err)}
+		} else if !strings.EqualFold(sum, inputSHA256) {
+			return &exitError{exitInput, fmt.Errorf("%s has checksum %s, expected %s", b.apk, sum, inputSHA256)}
+		}
+	}
+
+	if packer, err := detectPacker(b.apk); err != nil {
+		return &exitError{exitInput, fmt.Errorf("Failed to read APK: %v", err)}
+	} else if packer != "" {
+		warning := fmt.Sprintf("%s appears to be packed with %s: the real code is loaded at runtime, so the patched APK may not work as expected", b.apk, packer)
+		fmt.Println("\n!!! WARNING:", warning)
+		fmt.Println()
+		b.result.Packed = true
+		b.result.Packer = packer
+		b.result.Warnings = append(b.result.Warnings, warning)
+	}
+	warnSharedUser(b.apk, b.result)
+	if err := b.checkShrinking(); err != nil {
+		return &exitError{exitInput, err}
+	}
+
+	if b.onlyNeedsSigning() {
+		b.resign = true
+		b.result.FastResign = true
+	}
+
+	for _, st := range b.stages() {
+		if st.message != "" {
+			fmt.Println("=> " + st.message)
+		}
+		if err := b.progress.track(st.name, st.run); err != nil {
+			return &exitError{stageExitCode(st.name), err}
+		}
+	}
+
+	fmt.Println("\n======")
+	if b.exitCode == 0 {
+		fmt.Println("Success!")
+	} else {
+		fmt.Printf("Built, but the %s failed.\n", b.failed)
+	}
+	fmt.Println("======")
+	fmt.Println("(deleting temporary directory...)")
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		fmt.Println("=====")
+		fmt.Println("Something failed :'(")
+		fmt.Printf("Leaving temporary dir %s if you want to inspect what went wrong.\n", tmpDir)
+		return err
+	}
+	return nil
+}
+
+func (b *build) unpack() error {
+	if err := b.apktool.run(b.debugFlag, "-q", "d", b.apk, "-o", b.appDir); err != nil {
+		printOOMHint(err, b.apk)
+		if isManifestDecodeError(err) {
+			return fmt.Errorf("Failed to unpack APK: apktool can't decode AndroidManifest.xml, which obfuscators sometimes corrupt on purpose; retry with another -apktool-version (%v)", err)
+		}
+		return fmt.Errorf("Failed to unpack APK: %v", err)
+	}
+
+	pkg, err := manifestPackage(b.manifestPath())
+	if err != nil {
+		return fmt.Errorf("Failed to read package name: %v", err)
+	}
+	b.pkg = pkg
+	b.result.Package = pkg
+
+	unknown, err := unknownFiles(b.appDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list apktool's unknown files: %v", err)
+	}
+	if len(unknown) > 0 {
+		examples := unknown
+		if len(examples) > 3 {
+			examples = append(examples[:3:3], "...")
+		}
+		b.warnf("apktool didn't recognize %d files and kept them in unknown/ (%s); they are repacked as they are, which may not reproduce the original exactly (compression, alignment)", len(unknown), strings.Join(examples, ", "))
+	}
+	return nil
+}
+
+// checkShrinking warns when the input APK shows signs of resource
+// shrinking, see shrinkingMarkers.
+func (b *build) checkShrinking() error {
+	keep, placeholders, err := shrinkingMarkers(b.apk)
+	if err != nil {
+		return fmt.Errorf("Failed to look for resource shrinking: %v", err)
+	}
+	if keep != "" || len(placeholders) > 0 {
+		var found []string
+		if keep != "" {
+			found = append(found, keep)
+		}
+		if len(placeholders) > 0 {
+			examples := placeholders
+			if len(examples) > 3 {
+				examples = append(examples[:3:3], "...")
+			}
+			found = append(found, fmt.Sprintf("%d resources emptied to placeholders: %s", len(placeholders), strings.Join(examples, ", ")))
+		}
+		b.warnf("the app was built with resource shrinking (%s); a rebuilt APK may not have the same resources as the original, the resources that were stripped can't be restored and code looking them up by name may behave differently", strings.Join(found, "; "))
+	}
+	return nil
+}
+
+// Resource shrinking replaces the resources it removes with placeholders:
+// a 1x1 PNG (67 bytes, 68 for a 9-patch) or an XML file of just <x/>.
+var (
+	placeholderXML   = regexp.MustCompile(`^(<\?xml[^>]*\?>\s*)?<x\s*/>\s*$`)
+	placeholderSizes = map[string]int64{".png": 67, ".9.png": 68}
+	keepRulesPattern = regexp.MustCompile(`\btools:(keep|discard|shrinkMode)=`)
+)
+
+// shrinkingMarkers looks for the signs of resource shrinking in an APK:
+// keep is the res/raw/keep.xml, or another raw XML file with tools:keep,
+// tools:discard or tools:shrinkMode rules, if one made it into the APK, and
+// placeholders are the resources emptied by the shrinker. Raw files are
+// stored as they are, the other XML resources compiled to binary XML.
+func shrinkingMarkers(apk string) (keep string, placeholders []string, err error) {
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "res/") || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		name := strings.ToLower(path.Base(f.Name))
+		if strings.HasSuffix(name, ".png") {
+			ext := ".png"
+			if strings.HasSuffix(name, ".9.png") {
+				ext = ".9.png"
+			}
+			if int64(f.UncompressedSize64) == placeholderSizes[ext] {
+				placeholders = append(placeholders, f.Name)
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ".xml") || f.UncompressedSize64 > 4096 {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if elements, err := decodeAXML(data); err == nil {
+			if len(elements) == 1 && elements[0].name == "x" && len(elements[0].attrs) == 0 {
+				placeholders = append(placeholders, f.Name)
+			}
+		} else if placeholderXML.Match(data) {
+			placeholders = append(placeholders, f.Name)
+		} else if strings.HasPrefix(f.Name, "res/raw/") && (name == "keep.xml" || keepRulesPattern.Match(data)) {
+			keep = f.Name
+		}
+	}
+	return keep, placeholders, nil
+}
+
+// unknownFiles lists the files apktool copied to unknown/ in a decoded app,
+// because they are neither resources, code nor anything else it knows.
+func unknownFiles(appDir string) ([]string, error) {
+	dir := filepath.Join(appDir, "unknown")
+	if !fileExists(dir) {
+		return nil, nil
+	}
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	return files, err
+}
+
+func (b *build) manifestPath() string {
+	return filepath.Join(b.appDir, "AndroidManifest.xml")
+}
+
+// manifestEdit is one change the patch stage makes to the manifest. Edits apply to
+// the manifest in memory; it's only written once all of them succeed.
+type manifestEdit struct {
+	name  string
+	apply func(m *manifest) error
+}
+
+func (b *build) manifestEdits() []manifestEdit {
+	edits := []manifestEdit{
+		{"debuggable", func(m *manifest) error {
+			return m.setApplicationAttr("debuggable", strconv.FormatBool(!undebugMode))
+		}},
+	}
+
+	for _, name := range removeComps {
+		name := resolveClassName(b.pkg, name)
+		edits = append(edits, manifestEdit{"remove-component " + name, func(m *manifest) error {
+			fmt.Println("=> Removing component", name+"...")
+			return b.removeComponent(m, name)
+		}})
+	}
+
+	if noAnalytics {
+		edits = append(edits, manifestEdit{"disable-analytics", func(m *manifest) error {
+			fmt.Println("=> Disabling analytics...")
+			return b.disableAnalytics(m)
+		}})
+	}
+
+	if legacyStorage {
+		edits = append(edits, manifestEdit{"legacy-external-storage", func(m *manifest) error {
+			fmt.Println("=> Requesting legacy external storage...")
+			if err := m.setApplicationAttr("requestLegacyExternalStorage", "true"); err != nil {
+				return err
+			}
+			if sdk := targetSdkVersion(b.appDir); sdk >= 30 {
+				b.warnf("the app targets API %d, Android 11+ ignores requestLegacyExternalStorage for apps targeting API 30+", sdk)
+			}
+			return nil
+		}})
+	}
+
+	if allFilesAccess {
+		edits = append(edits, manifestEdit{"all-files-access", func(m *manifest) error {
+			fmt.Println("=> Requesting all files access...")
+			added, err := m.addPermission("android.permission.MANAGE_EXTERNAL_STORAGE")
+			if err != nil {
+				return err
+			}
+			if !added {
+				fmt.Println("The manifest already requests MANAGE_EXTERNAL_STORAGE")
+			}
+			// Android 10 has no all files access, only legacy storage,
+			// which is -legacy-external-storage's to request.
+			if !legacyStorage {
+				fmt.Println("On Android 10, which has no all files access, add -legacy-external-storage for the same")
+			}
+			b.warnf("all files access must still be granted on the device: Settings > Apps > Special app access > All files access, or adb shell appops set --uid %s MANAGE_EXTERNAL_STORAGE allow", b.pkg)
+			return nil
+		}})
+	}
+
+	if presetFlag("cleartext-traffic", cleartext) {
+		edits = append(edits, manifestEdit{"cleartext-traffic", func(m *manifest) error {
+			apps, err := m.find("manifest/application")
+			if err == nil && len(apps) > 0 {
+				if config, ok := apps[0].attr("networkSecurityConfig"); ok {
+					b.warnf("the app has a network security config (%s), whose cleartextTrafficPermitted takes precedence over usesCleartextTraffic", config)
+				}
+			}
+			return m.setApplicationAttr("usesCleartextTraffic", "true")
+		}})
+	}
+
+	// -theme is a -set-app-attr of android:theme.
+	attrs := appAttrs
+	if theme != "" {
+		attrs = append(attrs[:len(attrs):len(attrs)], "theme="+theme)
+	}
+	for _, attr := range attrs {
+		name, value, _ := parseAppAttr(attr)
+		edits = append(edits, manifestEdit{"set-app-attr " + name, func(m *manifest) error {
+			if err := checkResourceReference(b.appDir, value); err != nil {
+				return err
+			}
+			fmt.Printf("=> Setting android:%s=%q on the application...\n", name, value)
+			return m.setApplicationAttr(name, value)
+		}})
+	}
+
+	if injectProvider != "" {
+		class := resolveClassName(b.pkg, injectProvider)
+		edits = append(edits, manifestEdit{"inject-provider", func(m *manifest) error {
+			fmt.Println("=> Declaring the provider", class+"...")
+			// The app would die at startup, creating a provider it has no
+			// code for.
+			if file, err := findSmaliClass(b.appDir, class); err != nil {
+				return err
+			} else if file == "" {
+				return fmt.Errorf("%s is not in the app's code, add its smali with -merge-smali-dir", class)
+			}
+			p, err := m.addProvider(class, b.pkg)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Declared the provider %s with the authority %s\n", p.Class, p.Authority)
+			b.result.Provider = p
+			return nil
+		}})
+	}
+
+	if instrumentSpec != "" {
+		spec, _ := parseInstrumentation(instrumentSpec)
+		if spec.target == "" {
+			spec.target = b.pkg
+		}
+		edits = append(edits, manifestEdit{"add-instrumentation", func(m *manifest) error {
+			fmt.Println("=> Declaring the instrumentation", spec.runner+"...")
+			if err := m.addInstrumentation(spec); err != nil {
+				return err
+			}
+			// The runner is loaded from this APK, not from a test APK.
+			if file, err := findSmaliClass(b.appDir, spec.runner); err == nil && file == "" {
+				b.warnf("%s is not in the app's code, am instrument can only start it once it's added (e.g. the androidx.test runner's smali)", spec.runner)
+			}
+			b.tests = spec
+			return nil
+		}})
+	}
+
+	// wrap.sh is only run when the native libraries are extracted.
+	if presetFlag("extract-native-libs", extractLibs) || wrapSh != "" {
+		edits = append(edits, manifestEdit{"extract-native-libs", func(m *manifest) error {
+			return m.setApplicationAttr("extractNativeLibs", "true")
+		}})
+	}
+
+	// Last, so the other edits see the application as the app declares it.
+	if len(b.startupCode()) > 0 {
+		edits = append(edits, manifestEdit{"app-entry", func(m *manifest) error {
+			entry, err := resolveAppEntry(m, b.appDir, b.pkg)
+			if err != nil {
+				return err
+			}
+			if entry.generate == generateClass {
+				if err := m.setApplicationAttr("name", entry.class); err != nil {
+					return err
+				}
+			}
+			b.entry = entry
+			return nil
+		}})
+	}
+	return edits
+}
+
+// startupCode is the smali run first thing in the Application, in order, by
+// the features that need app code at startup; resolveAppEntry finds where it
+// goes. Each snippet may clobber v0 up to its locals. The other injections
+// don't run there: -inject-provider and -add-instrumentation only declare
+// classes, which findSmaliClass looks for across the smali directories, and
+// -bypass-root-detection patches the checks wherever they are.
+func (b *build) startupCode() []smaliSnippet {
+	var code []smaliSnippet
+	if strictModeOn {
+		code = append(code, smaliSnippet{name: "strict-mode", code: []string{
+			"invoke-static {}, Landroid/os/StrictMode;->enableDefaults()V",
+		}})
+	}
+	return code
+}
+
+// presetFlag resolves a flag -debug-profile turns on: given explicitly, the
+// flag wins either way.
+func presetFlag(name string, value bool) bool {
+	if isFlagSet(name) {
+		return value
+	}
+	return value || debugProfile
+}
+
+var (
+	attrNamePattern   = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+	resourceReference = regexp.MustCompile(`^@(?:\*?([a-zA-Z0-9_.]+):)?([a-z-]+)/([a-zA-Z0-9_.]+)$`)
+	styleReference    = regexp.MustCompile(`^@(?:\*?[a-zA-Z0-9_.]+:)?style/[a-zA-Z0-9_.]+$`)
+)
+
+// parseAppAttr splits a -set-app-attr NAME=VALUE. NAME is in the android
+// namespace, which may be spelled out. The flags the build sets itself
+// can't be set with it.
+func parseAppAttr(attr string) (string, string, error) {
+	name, value, ok := strings.Cut(attr, "=")
+	name = strings.TrimPrefix(name, "android:")
+	switch {
+	case !ok:
+		return "", "", errors.New("expected NAME=VALUE")
+	case !attrNamePattern.MatchString(name):
+		return "", "", fmt.Errorf("%q is not an attribute name", name)
+	case name == "debuggable" || name == "name":
+		return "", "", fmt.Errorf("android:%s can't be changed with -set-app-attr", name)
+	}
+	return name, value, nil
+}
+
+// checkResourceReference checks that a @type/name value names a resource
+// apktool decoded, i.e. one that's declared in res/values/public.xml.
+// References to the framework's resources are taken as they are, and
+// anything that isn't a reference needs no check.
+func checkResourceReference(appDir, value string) error {
+	if !strings.HasPrefix(value, "@") {
+		return nil
+	}
+	m := resourceReference.FindStringSubmatch(value)
+	if m == nil {
+		return fmt.Errorf("%q is not a resource reference like @type/name", value)
+	}
+	if m[1] == "android" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(appDir, "res", "values", "public.xml"))
+	if err != nil {
+		return fmt.Errorf("can't check %s: %v", value, err)
+	}
+	if !bytes.Contains(data, []byte(fmt.Sprintf(`type="%s" name="%s"`, m[2], m[3]))) {
+		return fmt.Errorf("the app has no resource %s", value)
+	}
+	return nil
+}
+
+// instrumentation is an -add-instrumentation spec: the runner class, the
+// package it instruments and whether to add the android.test.runner
+// library.
+type instrumentation struct {
+	runner      string
+	target      string
+	testLibrary bool
+}
+
+func parseInstrumentation(spec string) (*instrumentation, error) {
+	in := &instrumentation{}
+	for _, part := range strings.Split(spec, ",") {
+		key, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			key, value = part[:i], part[i+1:]
+		}
+		switch key {
+		case "runner":
+			in.runner = value
+		case "target":
+			in.target = value
+		case "test-library":
+			in.testLibrary = value == "" || value == "true"
+		default:
+			return nil, fmt.Errorf("unknown key %q, expected runner, target or test-library", key)
+		}
+	}
+	if in.runner == "" {
+		return nil, errors.New("runner=CLASS is required, e.g. runner=androidx.test.runner.AndroidJUnitRunner")
+	}
+	return in, nil
+}
+
+// command is the am instrument command line that runs the app's tests.
+func (in *instrumentation) command(pkg string) string {
+	return fmt.Sprintf("adb shell am instrument -w %s/%s", pkg, in.runner)
+}
+
+// manifestChange records whether an edit changed the manifest; e.g. setting
+// debuggable on an app that already is doesn't. Diff is what it changed, as
+// a unified diff of the manifest before and after it.
+type manifestChange struct {
+	Edit    string `json:"edit"`
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff,omitempty"`
+}
+
+// applyManifestEdits runs edits against the manifest at path and writes it
+// back only when they all succeed, so a failure leaves it untouched.
+func applyManifestEdits(path string, edits []manifestEdit) ([]manifestChange, error) {
+	m, err := loadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var changes []manifestChange
+	for _, edit := range edits {
+		before := string(m.data)
+		if err := edit.apply(m); err != nil {
+			return nil, fmt.Errorf("%s: %v", edit.name, err)
+		}
+		changes = append(changes, manifestChange{Edit: edit.name, Changed: string(m.data) != before, Diff: lineDiff(before, string(m.data), 2)})
+	}
+	return changes, m.save()
+}
+
+// manifestArtifact is the -emit-manifest-artifact file: enough to see what
+// a debug build changed, and to reproduce it.
+type manifestArtifact struct {
+	Input            string           `json:"input"`
+	Output           string           `json:"output"`
+	Tool             string           `json:"tool"`
+	ApktoolVersion   string           `json:"apktoolVersion,omitempty"`
+	ApktoolYml       string           `json:"apktoolYml"`
+	OriginalManifest string           `json:"originalManifest"`
+	Changes          []manifestChange `json:"changes"`
+	FinalManifest    string           `json:"finalManifest"`
+}
+
+func (b *build) patch() error {
+	// Before the manifest edits, which may declare the merged classes.
+	if mergeSmaliDir != "" {
+		dir, classes, err := mergeSmali(b.appDir, mergeSmaliDir)
+		if err != nil {
+			return fmt.Errorf("Failed to merge %s: %v", mergeSmaliDir, err)
+		}
+		fmt.Printf("Merged %d smali classes from %s into %s\n", len(classes), mergeSmaliDir, dir)
+		b.result.MergedSmali = classes
+	}
+
+	if emitManifest {
+		data, err := ioutil.ReadFile(b.manifestPath())
+		if err != nil {
+			return fmt.Errorf("Failed to read the manifest: %v", err)
+		}
+		b.manifest = stripBOM(data)
+	}
+	changes, err := applyManifestEdits(b.manifestPath(), b.manifestEdits())
+	if err != nil {
+		return fmt.Errorf("Failed to patch the manifest, it was left unchanged: %v", err)
+	}
+	b.changes = changes
+
+	if wrapSh != "" {
+		placed, err := installWrapSh(b.appDir, wrapSh)
+		if err != nil {
+			return fmt.Errorf("Failed to install wrap.sh: %v", err)
+		}
+		for _, file := range placed {
+			fmt.Println("Installed wrap.sh:", file)
+		}
+		b.result.WrapSh = placed
+	}
+
+	// Before the rebuild, so that a gadget -frida-attach can't attach to
+	// fails early.
+	if fridaAttach {
+		gadget, err := findFridaGadget(b.appDir)
+		if err != nil {
+			return fmt.Errorf("Cannot use -frida-attach: %v", err)
+		}
+		fmt.Printf("Found the Frida gadget %s, listening on %s:%d\n", gadget.lib, gadget.address, gadget.port)
+		b.gadget = gadget
+	}
+
+	if b.entry != nil {
+		if err := b.entry.inject(b.appDir, b.startupCode()); err != nil {
+			return fmt.Errorf("Failed to add the startup code to %s: %v", b.entry, err)
+		}
+		fmt.Println("Added startup code to", b.entry)
+		b.result.AppEntry = b.entry.String()
+	}
+
+	if bypassRoot {
+		patched, err := bypassRootDetection(b.appDir)
+		if err != nil {
+			return fmt.Errorf("Failed to patch the root checks: %v", err)
+		}
+		for _, p := range patched {
+			fmt.Printf("Patched root check %s in %s (%s)\n", p.Method, p.File, p.Reason)
+		}
+		if len(patched) == 0 {
+			b.warnf("-bypass-root-detection found no root checks it knows, the app may still detect root")
+		}
+		b.result.RootBypass = patched
+	}
+
+	// Code goes only once the manifest no longer declares it.
+	if removeCompCode {
+		for _, name := range b.result.Removed {
+			files, err := removeClassFiles(b.appDir, name)
+			if err != nil {
+				return fmt.Errorf("Failed to delete the code of %s: %v", name, err)
+			}
+			if len(files) == 0 {
+				fmt.Println("No smali code found for", name)
+			}
+			for _, file := range files {
+				fmt.Println("Deleted", file)
+			}
+		}
+	}
+
+	added, err := keepLibsStored(b.apk, b.appDir)
+	if err != nil {
+		return fmt.Errorf("Failed to update apktool.yml: %v", err)
+	}
+	if added {
+		fmt.Println("Added so to doNotCompress in apktool.yml, the app's native libraries are stored uncompressed")
+	}
+	return nil
+}
+
+func (b *build) removeComponent(m *manifest, name string) error {
+	found, err := m.removeComponent(b.pkg, name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("the manifest doesn't declare it")
+	}
+	b.result.Removed = append(b.result.Removed, name)
+
+	refs, err := m.references(b.pkg, name)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		b.warnf("%s is still referenced by %s", name, ref)
+	}
+	return nil
+}
+
+// checkWrapSh rejects a -wrap-sh the device couldn't run, and warns about
+// one that doesn't seem to start the app.
+func checkWrapSh(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return "", errors.New("it must start with a #! line, e.g. #!/system/bin/sh")
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		return "", errors.New("it has Windows (CRLF) line endings, the device shell can't run it")
+	}
+	if !bytes.Contains(data, []byte(`"$@"`)) {
+		return "it never runs \"$@\", the app won't start unless it execs its arguments", nil
+	}
+	return "", nil
+}
+
+// installWrapSh copies script to lib/<abi>/wrap.sh for each ABI in the
+// decoded app and returns the files it wrote, relative to appDir.
+func installWrapSh(appDir, script string) ([]string, error) {
+	data, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+	abis, err := ioutil.ReadDir(filepath.Join(appDir, "lib"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var placed []string
+	for _, abi := range abis {
+		if !abi.IsDir() {
+			continue
+		}
+		file := filepath.Join("lib", abi.Name(), "wrap.sh")
+		if err := ioutil.WriteFile(filepath.Join(appDir, file), data, 0755); err != nil {
+			return nil, err
+		}
+		placed = append(placed, filepath.ToSlash(file))
+	}
+	if len(placed) == 0 {
+		return nil, errors.New("the app has no native libraries, so there's no lib/<abi> directory for it")
+	}
+	return placed, nil
+}
+
+// analyticsSDK is an entry of the -disable-analytics catalog.
+type analyticsSDK struct {
+	id, name string
+	// packages identify the SDK: it's only touched when the manifest names
+	// something in one of them.
+	packages []string
+	// components are removed from the application.
+	components []string
+	// registrars are meta-data entries nested in other components, such as
+	// Firebase's ComponentDiscoveryService, that are removed.
+	registrars []string
+	// flags are application meta-data set to false, or added as false.
+	flags []string
+}
+
+var analyticsCatalog = []analyticsSDK{
+	{
+		id:       "firebase-analytics",
+		name:     "Firebase Analytics",
+		packages: []string{"com.google.android.gms.measurement.", "com.google.firebase.analytics."},
+		components: []string{
+			"com.google.android.gms.measurement.AppMeasurementReceiver",
+			"com.google.android.gms.measurement.AppMeasurementService",
+			"com.google.android.gms.measurement.AppMeasurementJobService",
+		},
+		registrars: []string{"com.google.firebase.components:com.google.firebase.analytics.connector.internal.AnalyticsConnectorRegistrar"},
+		flags:      []string{"firebase_analytics_collection_enabled", "google_analytics_adid_collection_enabled"},
+	},
+	{
+		id:         "crashlytics",
+		name:       "Firebase Crashlytics",
+		packages:   []string{"com.google.firebase.crashlytics."},
+		registrars: []string{"com.google.firebase.components:com.google.firebase.crashlytics.CrashlyticsRegistrar"},
+		flags:      []string{"firebase_crashlytics_collection_enabled"},
+	},
+	{
+		id:       "google-analytics",
+		name:     "Google Analytics",
+		packages: []string{"com.google.android.gms.analytics."},
+		components: []string{
+			"com.google.android.gms.analytics.AnalyticsReceiver",
+			"com.google.android.gms.analytics.AnalyticsService",
+			"com.google.android.gms.analytics.AnalyticsJobService",
+			"com.google.android.gms.analytics.CampaignTrackingReceiver",
+			"com.google.android.gms.analytics.CampaignTrackingService",
+		},
+	},
+	{
+		id:       "facebook",
+		name:     "Facebook SDK",
+		packages: []string{"com.facebook."},
+		flags: []string{
+			"com.facebook.sdk.AutoInitEnabled",
+			"com.facebook.sdk.AutoLogAppEventsEnabled",
+			"com.facebook.sdk.AdvertiserIDCollectionEnabled",
+		},
+	},
+	{
+		id:         "adjust",
+		name:       "Adjust",
+		packages:   []string{"com.adjust.sdk."},
+		components: []string{"com.adjust.sdk.AdjustReferrerReceiver"},
+	},
+	{
+		id:       "appsflyer",
+		name:     "AppsFlyer",
+		packages: []string{"com.appsflyer."},
+		components: []string{
+			"com.appsflyer.SingleInstallBroadcastReceiver",
+			"com.appsflyer.MultipleInstallBroadcastReceiver",
+		},
+	},
+}
+
+// startupProvider runs androidx.startup initializers, one meta-data entry
+// per initializer.
+const startupProvider = "androidx.startup.InitializationProvider"
+
+func analyticsKept(names ...string) bool {
+	for _, keep := range analyticsKeep {
+		for _, name := range names {
+			if keep == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *build) disableAnalytics(m *manifest) error {
+	b.result.Analytics = map[string][]string{}
+	for _, sdk := range analyticsCatalog {
+		if analyticsKept(sdk.id) {
+			fmt.Printf("%s: kept\n", sdk.name)
+			continue
+		}
+		used, err := m.mentions(sdk.packages)
+		if err != nil {
+			return err
+		}
+		if !used {
+			fmt.Printf("%s: not used by this app\n", sdk.name)
+			continue
+		}
+
+		var done []string
+		for _, class := range sdk.components {
+			if analyticsKept(class) {
+				continue
+			}
+			found, err := m.removeComponent(b.pkg, class)
+			if err != nil {
+				return err
+			}
+			if !found {
+				b.warnf("%s: %s isn't declared in this app", sdk.name, class)
+				continue
+			}
+			done = append(done, "removed "+class)
+		}
+
+		for _, name := range sdk.registrars {
+			if analyticsKept(name) {
+				continue
+			}
+			removed, err := m.removeMetaData(func(parent, key string) bool { return key == name })
+			if err != nil {
+				return err
+			}
+			if removed == 0 {
+				b.warnf("%s: no %s meta-data in this app", sdk.name, name)
+				continue
+			}
+			done = append(done, "removed meta-data "+name)
+		}
+
+		// Initializers run by androidx.startup are named after their class.
+		initializers, err := m.metaDataNames(startupProvider)
+		if err != nil {
+			return err
+		}
+		for _, name := range initializers {
+			if !hasAnyPrefix(name, sdk.packages) || analyticsKept(name) {
+				continue
+			}
+			if _, err := m.removeMetaData(func(parent, key string) bool { return parent == startupProvider && key == name }); err != nil {
+				return err
+			}
+			done = append(done, "removed startup initializer "+name)
+		}
+
+		for _, flag := range sdk.flags {
+			if analyticsKept(flag) {
+				continue
+			}
+			if err := m.setMetaData(flag, "false"); err != nil {
+				return err
+			}
+			done = append(done, "set "+flag+" to false")
+		}
+
+		if len(done) > 0 {
+			fmt.Printf("%s:\n", sdk.name)
+			for _, d := range done {
+				fmt.Println("  " + d)
+			}
+			b.result.Analytics[sdk.id] = done
+		}
+	}
+	return nil
+}
+
+// warnf prints a warning and records it in the report.
+func (b *build) warnf(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	fmt.Println("WARNING:", warning)
+	b.result.Warnings = append(b.result.Warnings, warning)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dexMethodLimit is the number of method references a dex file can hold.
+const dexMethodLimit = 65536
+
+func (b *build) countMethods() error {
+	counts, err := smaliMethodCounts(b.appDir)
+	if err != nil {
+		return fmt.Errorf("Failed to count methods: %v", err)
+	}
+	b.result.MethodCounts = counts
+
+	var dexes []string
+	for dex := range counts {
+		dexes = append(dexes, dex)
+	}
+	sort.Strings(dexes)
+	for _, dex := range dexes {
+		fmt.Printf("%-14s ~%d methods (%d%% of %d)\n", dex, counts[dex], counts[dex]*100/dexMethodLimit, dexMethodLimit)
+		if counts[dex] >= dexMethodLimit*9/10 {
+			warning := fmt.Sprintf("%s has about %d method references, close to the %d limit: move some classes to a new smali_classesN directory", dex, counts[dex], dexMethodLimit)
+			fmt.Println("WARNING:", warning)
+			b.result.Warnings = append(b.result.Warnings, warning)
+		}
+	}
+	return nil
+}
+
+// emitManifestArtifact writes the -emit-manifest-artifact file once the
+// output is built and verified, so that there's none for a failed build.
+func (b *build) emitManifestArtifact() error {
+	final, err := ioutil.ReadFile(b.manifestPath())
+	if err != nil {
+		return fmt.Errorf("Failed to write the manifest artifact: %v", err)
+	}
+	yml, err := ioutil.ReadFile(filepath.Join(b.appDir, "apktool.yml"))
+	if err != nil {
+		return fmt.Errorf("Failed to write the manifest artifact: %v", err)
+	}
+	artifact := manifestArtifact{
+		Input:            b.result.Input,
+		Output:           b.output,
+		Tool:             "debugAPK " + version,
+		ApktoolVersion:   b.result.ApktoolVersion,
+		ApktoolYml:       string(yml),
+		OriginalManifest: string(b.manifest),
+		Changes:          b.changes,
+		FinalManifest:    string(final),
+	}
+	// Unescaped, so the manifests stay readable.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(artifact); err != nil {
+		return fmt.Errorf("Failed to write the manifest artifact: %v", err)
+	}
+	path := strings.TrimSuffix(b.output, filepath.Ext(b.output)) + ".manifest.json"
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to write the manifest artifact: %v", err)
+	}
+	fmt.Println("Wrote the manifest artifact:", path)
+	b.result.ManifestJSON = path
+	return nil
+}
+
+// lineDiff is a unified diff of the lines of a and b with context lines
+// around each change, or "" when they're the same. Only the lines between
+// their common start and end are compared, by their longest common
+// subsequence unless there are too many of them.
+func lineDiff(a, b string, context int) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	if pre == len(x) && pre == len(y) {
+		return ""
+	}
+
+	type op struct {
+		kind byte // ' ', '-' or '+'
+		line string
+	}
+	var ops []op
+	for _, line := range x[:pre] {
+		ops = append(ops, op{' ', line})
+	}
+	mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	if len(mx)*len(my) > 1<<20 {
+		for _, line := range mx {
+			ops = append(ops, op{'-', line})
+		}
+		for _, line := range my {
+			ops = append(ops, op{'+', line})
+		}
+	} else {
+		lcs := make([][]int, len(mx)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(my)+1)
+		}
+		for i := len(mx) - 1; i >= 0; i-- {
+			for j := len(my) - 1; j >= 0; j-- {
+				switch {
+				case mx[i] == my[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		for i, j := 0, 0; i < len(mx) || j < len(my); {
+			switch {
+			case i < len(mx) && j < len(my) && mx[i] == my[j]:
+				ops = append(ops, op{' ', mx[i]})
+				i, j = i+1, j+1
+			case i < len(mx) && (j == len(my) || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, op{'-', mx[i]})
+				i++
+			default:
+				ops = append(ops, op{'+', my[j]})
+				j++
+			}
+		}
+	}
+	for _, line := range x[len(x)-suf:] {
+		ops = append(ops, op{' ', line})
+	}
+
+	// Hunks: the changes, merged when their context would overlap.
+	var out strings.Builder
+	span := func(from, to int) (int, int, int, int) {
+		// The first line and the number of lines of ops[from:to] in a and b.
+		var aStart, bStart int
+		for _, o := range ops[:from] {
+			if o.kind != '+' {
+				aStart++
+			}
+			if o.kind != '-' {
+				bStart++
+			}
+		}
+		var aLen, bLen int
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+		return aStart + 1, aLen, bStart + 1, bLen
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops) && j <= end+2*context; j++ {
+			if ops[j].kind != ' ' {
+				end = j
+			}
+		}
+		end += context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		aStart, aLen, bStart, bLen := span(start, end)
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, o := range ops[start:end] {
+			out.WriteByte(o.kind)
+			out.WriteString(o.line)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// scanSecrets runs before the patch, so only the app's own files are
+// scanned.
+func (b *build) scanSecrets() error {
+	findings, err := findSecrets(b.appDir)
+	if err != nil {
+		return fmt.Errorf("Failed to scan for secrets: %v", err)
+	}
+	b.result.Secrets = findings
+	for _, f := range findings {
+		fmt.Printf("%s:%d: %s %s\n", f.File, f.Line, f.Type, f.Match)
+	}
+	fmt.Printf("%d possible secrets found\n", len(findings))
+	if secretsSARIF != "" {
+		if err := writeSecretsSARIF(secretsSARIF, findings); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", secretsSARIF, err)
+		}
+	}
+	return nil
+}
+
+// resignFlags are the options an APK that's debuggable already can be
+// re-signed with, without a rebuild: they're about the input, the signing,
+// the output and what's done with it once it's signed. Any other option may
+// change the app or need its decoded sources.
+var resignFlags = map[string]bool{
+	"sha256": true, "download-timeout": true, "max-size": true,
+	"apktool-version": true, "apktool-sha256": true, "artifact-mirror": true, "allow-unverified-mirror": true, "artifact-ca-cert": true,
+	"java-heap": true, "java-opt": true, "max-parallel-java": true,
+	"signing-props": true, "next-signer": true, "keystore": true, "ks-type": true, "pkcs11-config": true,
+	"ks-alias": true, "storepass": true, "keypass": true, "audit-log": true, "allow-expired-cert": true,
+	"o": true, "output-format": true, "compression": true, "verify-with": true, "backup-original": true,
+	"strict": true, "json": true, "progress-json": true, "verbose": true, "only-if-changed": true, "force": true,
+	"update-notice": true, "obb": true, "post-command": true, "post-command-allow-fail": true,
+	"install": true, "install-user": true, "verify-install": true, "uninstall-after": true, "smoke-test": true,
+	"smoke-wait": true, "device-timeout": true,
+	"serve": true, "serve-port": true, "serve-downloads": true, "serve-timeout": true,
+}
+
+// onlyNeedsSigning reports whether the input is debuggable already and
+// only options of resignFlags are set, so that decoding and rebuilding it
+// would only cost time.
+//
+// The APK isn't decoded then, so the warnings of the unpack and patch
+// stages aren't given: apktool's unknown files are about what a rebuild
+// changes, and the entries are copied as they are. Resource shrinking is
+// checked on the APK before, so it's reported either way.
+func (b *build) onlyNeedsSigning() bool {
+	if undebugMode || b.format() != "apk" {
+		return false
+	}
+	other := false
+	flag.Visit(func(f *flag.Flag) {
+		if !resignFlags[f.Name] {
+			other = true
+		}
+	})
+	return !other && verifyDebuggable(b.apk, true) == nil
+}
+
+// stripSignature is the whole of the build of an APK that's debuggable
+// already: it's copied without its signature, to be signed again.
+func (b *build) stripSignature() error {
+	pkg, err := apkPackage(b.apk)
+	if err != nil {
+		return fmt.Errorf("Failed to read package name: %v", err)
+	}
+	b.pkg = pkg
+	b.result.Package = pkg
+
+	if err := backupOutput(b.output, b.result); err != nil {
+		return err
+	}
+	if err := retryLocked(b.output, func() error { return copyFile(b.apk, b.output, 0644) }); err != nil {
+		return fmt.Errorf("Failed to copy APK: %v", err)
+	}
+	if err := rewriteZip(b.output, zipRewrite{skip: isSignatureFile, replace: unsignedManifest}); err != nil {
+		return fmt.Errorf("Failed to remove the old signature: %v", err)
+	}
+	return nil
+}
+
+func (b *build) repack() error {
+	if err := backupOutput(b.output, b.result); err != nil {
+		return err
+	}
+
+	args := []string{"-q", "b", b.appDir, "--use-aapt2", "-o", b.output}
+	if len(aapt2Args) > 0 {
+		aapt2, err := b.aapt2Wrapper()
+		if err != nil {
+			return fmt.Errorf("Cannot use -aapt2-arg: %v", err)
+		}
+		args = append(args, "-a", aapt2)
+	}
+	if err := b.apktool.run(b.debugFlag, args...); err != nil {
+		printOOMHint(err, b.apk)
+		if errs := resourceErrors(err); len(errs) > 0 {
+			return b.resourceFailure(errs)
+		}
+		return fmt.Errorf("Failed to repackage APK: %v", err)
+	}
+
+	if preserveOrder {
+		order, err := zipEntryNames(b.apk)
+		if err != nil {
+			return fmt.Errorf("Failed to read the entry order of %s: %v", b.apk, err)
+		}
+		if err := rewriteZip(b.output, zipRewrite{order: order}); err != nil {
+			return fmt.Errorf("Failed to reorder APK: %v", err)
+		}
+	}
+	return nil
+}
+
+// aapt2Option is an aapt2 option -aapt2-arg accepts: the aapt2 command
+// taking it, and whether it has a value.
+type aapt2Option struct {
+	command string
+	value   bool
+}
+
+var aapt2Options = map[string]aapt2Option{
+	"--no-crunch":                 {"compile", false},
+	"--legacy":                    {"compile", false},
+	"--pseudo-localize":           {"compile", false},
+	"-0":                          {"link", true},
+	"--no-compress":               {"link", false},
+	"--no-compress-regex":         {"link", true},
+	"--no-version-vectors":        {"link", false},
+	"--no-version-transitions":    {"link", false},
+	"--no-auto-version":           {"link", false},
+	"--no-resource-deduping":      {"link", false},
+	"--no-resource-removal":       {"link", false},
+	"--no-xml-namespaces":         {"link", false},
+	"--enable-sparse-encoding":    {"link", false},
+	"--keep-raw-values":           {"link", false},
+	"--auto-add-overlay":          {"link", false},
+	"--no-static-lib-packages":    {"link", false},
+	"--warn-manifest-validation":  {"link", false},
+	"--strict-visibility":         {"link", false},
+	"--min-sdk-version":           {"link", true},
+	"--target-sdk-version":        {"link", true},
+	"--version-code":              {"link", true},
+	"--version-name":              {"link", true},
+	"--rename-manifest-package":   {"link", true},
+	"--preferred-density":         {"link", true},
+	"--exclude-configs":           {"link", true},
+	"--extra-packages":            {"link", true},
+	"--product":                   {"link", true},
+	"-c":                          {"link", true},
+	"--package-id":                {"link", true},
+	"--allow-reserved-package-id": {"link", false},
+}
+
+// aapt2WrapperEnv is only ever set in the environment of apktool, which
+// runs this binary as its aapt2: it holds the aapt2Wrapping, as JSON. The
+// name isn't one of the RSIW_ settings, so that none of them can make
+// the binary act as aapt2.
+const aapt2WrapperEnv = "_RSIW_INTERNAL_AAPT2_WRAPPER"
+
+// aapt2Wrapping is the aapt2 that the wrapper runs, and the options it adds
+// to each of its commands.
+type aapt2Wrapping struct {
+	AAPT2     string              `json:"aapt2"`
+	ByCommand map[string][]string `json:"byCommand"`
+}
+
+// parseAapt2Args checks the -aapt2-arg options, "FLAG", "FLAG VALUE" or
+// "FLAG=VALUE", and returns them by the aapt2 command they go to.
+func parseAapt2Args(args []string) (map[string][]string, error) {
+	byCommand := map[string][]string{}
+	for _, arg := range args {
+		var fields []string
+		if i := strings.Index(arg, "="); i > 0 && strings.HasPrefix(arg, "--") {
+			fields = []string{arg[:i], arg[i+1:]}
+		} else {
+			fields = strings.Fields(arg)
+		}
+		if len(fields) == 0 {
+			return nil, errors.New("empty option")
+		}
+		opt, ok := aapt2Options[fields[0]]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s is not an aapt2 compile or link option debugAPK knows", fields[0])
+		case opt.value && len(fields) != 2:
+			return nil, fmt.Errorf("%s takes a value, e.g. -aapt2-arg \"%s VALUE\"", fields[0], fields[0])
+		case !opt.value && len(fields) != 1:
+			return nil, fmt.Errorf("%s takes no value", fields[0])
+		}
+		byCommand[opt.command] = append(byCommand[opt.command], fields...)
+	}
+	return byCommand, nil
+}
+
+// findAapt2 returns the aapt2 on PATH, or that of the newest build-tools of
+// the Android SDK.
+func findAapt2() (string, error) {
+	if path, err := exec.LookPath("aapt2"); err == nil {
+		return path, nil
+	}
+	name := "aapt2"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	for _, env := range []string{"ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		if sdk := os.Getenv(env); sdk != "" {
+			matches, _ := filepath.Glob(filepath.Join(sdk, "build-tools", "*", name))
+			// By version, 35.0.0 after 9.0.0 and 34.0.0-rc1 before 34.0.0.
+			sort.Slice(matches, func(i, j int) bool {
+				return newerVersion(filepath.Base(filepath.Dir(matches[j])), filepath.Base(filepath.Dir(matches[i])))
+			})
+			if len(matches) > 0 {
+				return matches[len(matches)-1], nil
+			}
+		}
+	}
+	return "", errors.New("aapt2 not found on PATH or in $ANDROID_HOME/build-tools, install the SDK build-tools")
+}
+
+// aapt2Wrapper sets up apktool to run this binary as its aapt2, adding the
+// -aapt2-arg options to the real aapt2's commands, and returns its path.
+func (b *build) aapt2Wrapper() (string, error) {
+	byCommand, err := parseAapt2Args(aapt2Args)
+	if err != nil {
+		return "", err
+	}
+	aapt2, err := findAapt2()
+	if err != nil {
+		return "", err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(aapt2Wrapping{AAPT2: aapt2, ByCommand: byCommand})
+	if err != nil {
+		return "", err
+	}
+	b.apktool.env = []string{aapt2WrapperEnv + "=" + string(encoded)}
+	for _, command := range []string{"compile", "link"} {
+		if len(byCommand[command]) > 0 {
+			fmt.Printf("Adding to aapt2 %s: %s\n", command, strings.Join(byCommand[command], " "))
+		}
+	}
+	fmt.Println("Using aapt2:", aapt2)
+	b.result.AAPT2Args = byCommand
+	return self, nil
+}
+
+// runAapt2 runs the aapt2 of the aapt2WrapperEnv spec with args, its
+// options added after the command they go to, and returns its exit code.
+func runAapt2(spec string, args []string) int {
+	var w aapt2Wrapping
+	if err := json.Unmarshal([]byte(spec), &w); err != nil || w.AAPT2 == "" {
+		fmt.Fprintln(os.Stderr, "Invalid", aapt2WrapperEnv, "from debugAPK:", spec)
+		return 1
+	}
+	// Nothing aapt2 runs should act as the wrapper.
+	os.Unsetenv(aapt2WrapperEnv)
+	if len(args) > 0 && len(w.ByCommand[args[0]]) > 0 {
+		args = append(append([]string{args[0]}, w.ByCommand[args[0]]...), args[1:]...)
+	}
+	cmd := exec.Command(w.AAPT2, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// resourceFailure reports the resources aapt2 rejected. With
+// -keep-decompiled the sources are kept right away, so they can be fixed.
+func (b *build) resourceFailure(errs []resourceError) error {
+	fmt.Println("aapt2 rejected these resources:")
+	for _, e := range errs {
+		fmt.Printf("  %s:%d: %s\n", e.File, e.Line, e.Message)
+	}
+	if keepDecompiled {
+		if err := b.keep(); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Fix them in the decompiled sources:", filepath.Join(b.keptDir, filepath.FromSlash(errs[0].File)))
+		}
+	}
+	return fmt.Errorf("Failed to repackage APK: %s:%d: %s", errs[0].File, errs[0].Line, errs[0].Message)
+}
+
+func (b *build) compress() error {
+	before, _ := os.Stat(b.output)
+	if err := rewriteZip(b.output, zipRewrite{compression: compression}); err != nil {
+		return fmt.Errorf("Failed to re-compress APK: %v", err)
+	}
+	if after, err := os.Stat(b.output); err == nil && before != nil {
+		fmt.Printf("APK size: %d -> %d bytes (%s)\n", before.Size(), after.Size(), compression)
+	}
+	return nil
+}
+
+// align zip-aligns an APK left unsigned by -no-sign, which signing would
+// have done otherwise, and writes the signing manifest the sign command
+// checks it against.
+func (b *build) align() error {
+	if err := rewriteZip(b.output, zipRewrite{}); err != nil {
+		return fmt.Errorf("Failed to align APK: %v", err)
+	}
+	path, err := writeSigningManifest(b.output, b.pkg)
+	if err != nil {
+		return fmt.Errorf("Failed to write the signing manifest: %v", err)
+	}
+	b.result.SigningManifest = path
+	return nil
+}
+
+// signingManifestSuffix names the signing manifest of an unsigned APK, e.g.
+// app.debug.apk.sign.json for app.debug.apk.
+const signingManifestSuffix = ".sign.json"
+
+// signingManifest describes an APK built with -no-sign, to be signed
+// separately: the sign command refuses to sign an APK next to its manifest
+// unless its checksum is the one in it.
+type signingManifest struct {
+	Artifact string    `json:"artifact"` // file name
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Package  string    `json:"package,omitempty"`
+	BuiltBy  string    `json:"builtBy"`
+	Built    time.Time `json:"built"`
+}
+
+// writeSigningManifest writes the signing manifest of the unsigned apk next
+// to it and returns its path.
+func writeSigningManifest(apk, pkg string) (string, error) {
+	sum, err := fileSHA256(apk)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(apk)
+	if err != nil {
+		return "", err
+	}
+	manifest := signingManifest{
+		Artifact: filepath.Base(apk),
+		SHA256:   sum,
+		Size:     info.Size(),
+		Package:  pkg,
+		BuiltBy:  "debugapk " + version,
+		Built:    time.Now().UTC().Truncate(time.Second),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := apk + signingManifestSuffix
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// checkUnsigned checks that in is the artifact to sign: its SHA-256 is the
+// -sha256, if given, and the one of its signing manifest, if it has one
+// (it's required with -signing-manifest).
+func checkUnsigned(in, manifestPath string) error {
+	sum, err := fileSHA256(in)
+	if err != nil {
+		return err
+	}
+	if inputSHA256 != "" {
+		if !strings.EqualFold(sum, inputSHA256) {
+			return fmt.Errorf("%s has checksum %s, expected %s", in, sum, inputSHA256)
+		}
+		fmt.Println("The SHA-256 of", in, "is the -sha256")
+	}
+	if manifestPath == "" {
+		manifestPath = in + signingManifestSuffix
+		if !fileExists(manifestPath) {
+			return nil
+		}
+	}
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest signingManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("%s: %v", manifestPath, err)
+	}
+	if manifest.SHA256 == "" {
+		return fmt.Errorf("%s has no sha256", manifestPath)
+	}
+	if !strings.EqualFold(sum, manifest.SHA256) {
+		return fmt.Errorf("%s has checksum %s, but the signing manifest %s expects %s (%s, built by %s on %s): it changed since it was built", in, sum, manifestPath, manifest.SHA256, manifest.Artifact, manifest.BuiltBy, manifest.Built.Format(time.RFC3339))
+	}
+	fmt.Printf("%s matches its signing manifest %s (built by %s on %s)\n", in, manifestPath, manifest.BuiltBy, manifest.Built.Format(time.RFC3339))
+	return nil
+}
+
+func (b *build) sign() error {
+	if b.signing == nil {
+		b.signing = debugSigningConfig(filepath.Join(b.tmpDir, "keystore"))
+		if err := generateKeyStore(b.signing, b.debugFlag); err != nil {
+			return fmt.Errorf("Failed to generate keystore: %v", err)
+		}
+	}
+	b.signing.next = b.cosigners
+
+	signer, err := signArtifact(b.output, "apk", b.signing, b.debugFlag)
+	if err != nil {
+		return fmt.Errorf("Failed to sign APK: %v", tokenError(err))
+	}
+	b.result.Signer = signer
+	if err := auditSigning(b.apk, b.output, signer, b.signing); err != nil {
+		return fmt.Errorf("Failed to write the audit log: %v", err)
+	}
+	return nil
+}
+
+func (b *build) verify() error {
+	if noSign {
+		fmt.Println("Not checking the signature: the APK is unsigned, by request (-no-sign)")
+		status := signatureStatus{Path: b.output, Schemes: []string{}}
+		alignmentOf(&status)
+		status.print()
+		b.result.Verification = &status
+		if !status.Aligned {
+			return fmt.Errorf("Failed to verify debug APK: %s", status.problem())
+		}
+	} else {
+		status, err := checkArtifact(b.output, b.result.Verifier, "apk")
+		status.print()
+		b.result.Verification = &status
+		if err != nil {
+			return fmt.Errorf("Failed to verify debug APK: %v", err)
+		}
+		if err := checkSigningCert(status, b.result.Verifier, b.signing); err != nil {
+			return fmt.Errorf("Failed to verify debug APK: %v", err)
+		}
+		b.result.SignerSHA256 = status.SHA256
+	}
+	if err := verifyDebuggable(b.output, !undebugMode); err != nil {
+		return fmt.Errorf("Failed to verify debug APK: %v", err)
+	}
+	if len(b.result.Removed) > 0 {
+		if err := verifyRemovedComponents(b.output, b.pkg, b.result.Removed); err != nil {
+			return fmt.Errorf("Failed to verify debug APK: %v", err)
+		}
+	}
+	if err := verifyLibCompression(b.apk, b.output); err != nil {
+		return fmt.Errorf("Failed to verify debug APK: %v", err)
+	}
+	if b.result.Provider != nil {
+		if err := verifyProvider(b.output, b.result.Provider); err != nil {
+			return fmt.Errorf("Failed to verify debug APK: %v", err)
+		}
+	}
+	if b.tests != nil {
+		if err := verifyInstrumentation(b.output, b.tests); err != nil {
+			return fmt.Errorf("Failed to verify debug APK: %v", err)
+		}
+		b.result.Instrument = b.tests.command(b.pkg)
+	}
+	return b.checkSize()
+}
+
+// checkSize records the size of the signed output, and holds it against
+// -max-size.
+func (b *build) checkSize() error {
+	info, err := os.Stat(b.output)
+	if err != nil {
+		return err
+	}
+	b.result.OutputSize = info.Size()
+	limit, ok := parseSize(maxSize)
+	if !ok || uint64(info.Size()) <= limit {
+		return nil
+	}
+	msg := fmt.Sprintf("%s is %s (%d bytes), over the -max-size of %s (%d bytes)", b.output, formatBytes(info.Size()), info.Size(), formatBytes(int64(limit)), limit)
+	if strict {
+		return errors.New(msg)
+	}
+	b.warnf("%s", msg)
+	return nil
+}
+
+// parseSize parses a -max-size: a JVM-style size, which may end in B or
+// iB as well (50MB, 50MiB).
+func parseSize(s string) (uint64, bool) {
+	lower := strings.ToLower(s)
+	if strings.HasSuffix(lower, "ib") {
+		s = s[:len(s)-2]
+	} else if len(lower) > 1 && strings.HasSuffix(lower, "b") && strings.IndexByte("kmgt", lower[len(lower)-2]) >= 0 {
+		s = s[:len(s)-1]
+	}
+	return parseJavaSize(s)
+}
+
+func (b *build) install() error {
+	serial, reason, err := selectDevice()
+	if err != nil {
+		return fmt.Errorf("Failed to list devices: %v", err)
+	}
+	if reason != "" && installApp {
+		return fmt.Errorf("Cannot install: %s", reason)
+	}
+	if reason != "" {
+		fmt.Println("Skipping install check:", reason)
+		return nil
+	}
+
+	abi, err := deviceABI(serial, b.output)
+	if err != nil {
+		return fmt.Errorf("Cannot install on %s: %v", serial, err)
+	}
+	if abi != "" {
+		fmt.Printf("Device %s will load the %s native libraries\n", serial, abi)
+		b.result.ABI = abi
+	}
+
+	if err := installOnDevice(serial, b.output); err != nil {
+		return fmt.Errorf("Install failed: %v", err)
+	}
+	for _, obb := range b.result.OBB {
+		if err := pushOBB(serial, b.pkg, obb); err != nil {
+			return fmt.Errorf("Failed to push %s: %v", filepath.Base(obb), err)
+		}
+	}
+	b.serial = serial
+	b.result.Installed = installApp
+	return nil
+}
+
+func (b *build) checkDebuggable() error {
+	if b.serial == "" {
+		fmt.Println("Skipping the debuggable check, the APK wasn't installed.")
+		return nil
+	}
+
+	check := checkDebuggable(b.serial, b.pkg)
+	b.result.DebuggableCheck = check
+	for _, p := range check.Probes {
+		status := "ok"
+		if !p.Passed {
+			status = "FAILED"
+		}
+		fmt.Printf("  %-10s %s %s\n", p.Name, status, p.Detail)
+	}
+	if check.Debuggable {
+		fmt.Printf("Device %s confirms %s is debuggable.\n", b.serial, b.pkg)
+	} else {
+		fmt.Printf("Device %s does NOT treat %s as debuggable.\n", b.serial, b.pkg)
+		b.exitCode, b.failed = exitDevice, "debuggable check"
+	}
+
+	// A failed device keeps the app, to look into why.
+	if !installApp && uninstallAfter {
+		if !check.Debuggable {
+			fmt.Printf("Leaving %s installed despite -uninstall-after, to inspect it.\n", b.pkg)
+			return nil
+		}
+		return uninstallFromDevice(b.serial, b.pkg)
+	}
+	return nil
+}
+
+// copyOBBs puts the -obb files next to the debug APK, named for the
+// versionCode of the rebuilt manifest: the app looks for that exact name,
+// and downloads the files again, or crashes, when it doesn't find it.
+func (b *build) copyOBBs() error {
+	versionCode, err := apkVersionCode(b.output)
+	if err != nil {
+		return fmt.Errorf("Failed to read the versionCode: %v", err)
+	}
+	for _, file := range obbFiles {
+		dest := filepath.Join(filepath.Dir(b.output), fmt.Sprintf("%s.%s.%s.obb", obbKind(file), versionCode, b.pkg))
+		if same, err := sameFile(file, dest); err != nil || !same {
+			// A hard link spares copying gigabytes, where it's possible.
+			os.Remove(dest)
+			if err := os.Link(file, dest); err != nil {
+				if err := copyFile(file, dest, 0644); err != nil {
+					return fmt.Errorf("Failed to copy %s: %v", file, err)
+				}
+			}
+		}
+		fmt.Println("OBB file:", dest)
+		b.result.OBB = append(b.result.OBB, dest)
+	}
+	return nil
+}
+
+// obbKind is main, or patch when the file's name says so.
+func obbKind(path string) string {
+	if strings.HasPrefix(strings.ToLower(filepath.Base(path)), "patch.") {
+		return "patch"
+	}
+	return "main"
+}
+
+func sameFile(a, b string) (bool, error) {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(ai, bi), nil
+}
+
+// apkPackage reads the package name from the binary manifest of apk.
+func apkPackage(apk string) (string, error) {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return "", err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return "", fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	for _, el := range elements {
+		if el.path != "manifest" {
+			continue
+		}
+		for _, a := range el.attrs {
+			if a.ns == "" && a.name == "package" {
+				return a.value, nil
+			}
+		}
+	}
+	return "", errors.New("the manifest has no package")
+}
+
+// warnSharedUser warns, like the packer warning, that re-signing apk breaks
+// the android:sharedUserId it declares, and records it in result.
+func warnSharedUser(apk string, result *report) {
+	uid, err := sharedUserID(apk)
+	// An unreadable manifest is apktool's to report.
+	if err != nil || uid == "" {
+		return
+	}
+	warning := fmt.Sprintf("%s declares android:sharedUserId=%q: only apps signed with the same key can share a user ID, "+
+		"so re-signing breaks it. The re-signed APK won't install next to the other apps of %s "+
+		"(INSTALL_FAILED_SHARED_USER_INCOMPATIBLE) unless they're all re-signed with the same key, "+
+		"e.g. with the sign command and the same -signing-props", apk, uid, uid)
+	const prefix = "!!! WARNING: "
+	fmt.Println("\n" + prefix + wrapText(warning, 80-len(prefix), strings.Repeat(" ", len(prefix))))
+	fmt.Println()
+	result.SharedUserID = uid
+	result.Warnings = append(result.Warnings, warning)
+}
+
+// sharedUserID returns the android:sharedUserId apk declares, if any.
+func sharedUserID(apk string) (string, error) {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return "", err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return "", fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	for _, el := range elements {
+		if el.path == "manifest" {
+			uid, _ := el.attr("sharedUserId")
+			return uid, nil
+		}
+	}
+	return "", nil
+}
+
+// wrapText breaks s at its spaces into lines of at most width characters,
+// but for words longer than that, and starts all but the first with indent.
+func wrapText(s string, width int, indent string) string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"+indent)
+}
+
+// apkVersionCode reads android:versionCode from the binary manifest of apk.
+func apkVersionCode(apk string) (string, error) {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return "", err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return "", fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	for _, el := range elements {
+		if el.path == "manifest" {
+			if code, ok := el.attr("versionCode"); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", errors.New("the manifest has no android:versionCode")
+}
+
+// pushOBB pushes obb into the app's OBB directory, once the device has the
+// room for it. adb push prints no progress when it's not on a terminal, so
+// the size of the file on the device is polled instead.
+func pushOBB(serial, pkg, obb string) error {
+	info, err := os.Stat(obb)
+	if err != nil {
+		return err
+	}
+	dir := "/sdcard/Android/obb/" + pkg
+	if output, err := adb(serial, "shell", "mkdir", "-p", dir); err != nil {
+		return fmt.Errorf("mkdir %s: %s", dir, lastLine(string(output)))
+	}
+	if free, err := deviceFreeSpace(serial, dir); err != nil {
+		fmt.Println("WARNING: cannot tell the free space on the device:", err)
+	} else if free < info.Size() {
+		return fmt.Errorf("it's %s and the device only has %s free", formatBytes(info.Size()), formatBytes(free))
+	}
+
+	remote := dir + "/" + filepath.Base(obb)
+	fmt.Printf("=> Pushing %s (%s) to %s...\n", filepath.Base(obb), formatBytes(info.Size()), remote)
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			output, err := exec.Command("adb", "-s", serial, "shell", "stat", "-c", "%s", shellQuote(remote)).Output()
+			if n, perr := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64); err == nil && perr == nil {
+				fmt.Printf("  %s of %s\n", formatBytes(n), formatBytes(info.Size()))
+			}
+		}
+	}()
+	output, err := exec.Command("adb", "-s", serial, "push", obb, remote).CombinedOutput()
+	close(done)
+	if err != nil {
+		return fmt.Errorf("%s", lastLine(string(output)))
+	}
+	fmt.Printf("Pushed %s in %s\n", filepath.Base(obb), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// deviceFreeSpace returns the bytes available on the device's filesystem
+// holding dir, from the Available column of df -k.
+func deviceFreeSpace(serial, dir string) (int64, error) {
+	output, err := adb(serial, "shell", "df", "-k", dir)
+	if err != nil {
+		return 0, fmt.Errorf("df: %s", lastLine(string(output)))
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output %q", lastLine(string(output)))
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output %q", lastLine(string(output)))
+	}
+	return kb << 10, nil
+}
+
+func (b *build) attachFrida() error {
+	port := fmt.Sprintf("tcp:%d", b.gadget.port)
+	if output, err := adb(b.serial, "forward", port, port); err != nil {
+		return fmt.Errorf("Failed to forward %s: %s", port, lastLine(string(output)))
+	}
+	removeForward := func() {
+		if output, err := adb(b.serial, "forward", "--remove", port); err != nil {
+			fmt.Printf("WARNING: failed to remove the forward of %s: %s\n", port, lastLine(string(output)))
+		}
+	}
+
+	// Interrupted while the app starts, the forward goes before exiting.
+	// Once frida runs, it gets the terminal's Ctrl-C as well, and its exit
+	// ends the stage; anything else stops it.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	var mu sync.Mutex
+	var running *exec.Cmd
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-interrupts:
+				mu.Lock()
+				cmd := running
+				mu.Unlock()
+				switch {
+				case cmd == nil:
+					removeForward()
+					fmt.Println("\nInterrupted, removed the forward of", port)
+					os.Exit(exitDevice)
+				case sig != os.Interrupt:
+					cmd.Process.Kill()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if output, err := adb(b.serial, "shell", "monkey", "-p", b.pkg, "-c", "android.intent.category.LAUNCHER", "1"); err != nil || bytes.Contains(output, []byte("No activities found")) {
+		removeForward()
+		return fmt.Errorf("Failed to launch %s: %s", b.pkg, lastLine(string(output)))
+	}
+	if err := waitForGadget(b.gadget.port, 30*time.Second); err != nil {
+		removeForward()
+		return err
+	}
+
+	// A gadget in listen mode names its process Gadget.
+	args := []string{"-H", fmt.Sprintf("127.0.0.1:%d", b.gadget.port), "-n", "Gadget"}
+	if fridaScript != "" {
+		args = append(args, "-l", fridaScript)
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = hostArg(arg)
+	}
+	b.result.FridaCommand = "frida " + strings.Join(quoted, " ")
+	if b.gadget.onLoad == "wait" {
+		fmt.Println("The app is paused until frida connects (the gadget's on_load is wait).")
+	}
+
+	frida, err := exec.LookPath("frida")
+	if fridaScript == "" || err != nil {
+		if fridaScript != "" {
+			b.warnf("frida is not installed, run the command below yourself")
+		}
+		fmt.Println("Connect with:", b.result.FridaCommand)
+		fmt.Printf("and remove the forward when done: adb -s %s forward --remove %s\n", b.serial, port)
+		return nil
+	}
+
+	defer removeForward()
+	fmt.Println("Running", b.result.FridaCommand)
+	cmd := exec.Command(frida, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("frida failed: %v", err)
+	}
+	mu.Lock()
+	running = cmd
+	mu.Unlock()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("frida failed: %v", err)
+	}
+	return nil
+}
+
+// fridaGadget is a Frida gadget shipped in the app, with the listen
+// settings of its config.
+type fridaGadget struct {
+	lib     string // e.g. lib/arm64-v8a/libfrida-gadget.so
+	address string
+	port    int
+	onLoad  string
+}
+
+// findFridaGadget looks for a Frida gadget among the app's native libraries:
+// one named like frida-gadget, or with a <lib>.config.so next to it. Only a
+// gadget that listens, the default without a config, can be attached to.
+func findFridaGadget(appDir string) (*fridaGadget, error) {
+	libs, err := filepath.Glob(filepath.Join(appDir, "lib", "*", "*.so"))
+	if err != nil {
+		return nil, err
+	}
+	for _, lib := range libs {
+		base := strings.TrimSuffix(lib, ".so")
+		config := base + ".config.so"
+		if strings.HasSuffix(base, ".config") || !strings.Contains(filepath.Base(lib), "frida-gadget") && !fileExists(config) {
+			continue
+		}
+
+		gadget := &fridaGadget{address: "127.0.0.1", port: 27042, onLoad: "wait"}
+		gadget.lib, _ = filepath.Rel(appDir, lib)
+		gadget.lib = filepath.ToSlash(gadget.lib)
+		data, err := ioutil.ReadFile(config)
+		if os.IsNotExist(err) {
+			return gadget, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var settings struct {
+			Interaction struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+				Port    int    `json:"port"`
+				OnLoad  string `json:"on_load"`
+			} `json:"interaction"`
+		}
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return nil, fmt.Errorf("%s.config.so: %v", filepath.Base(base), err)
+		}
+		i := settings.Interaction
+		if i.Type != "" && i.Type != "listen" {
+			return nil, fmt.Errorf("the gadget %s is configured with the %q interaction, only a gadget in listen mode can be attached to", gadget.lib, i.Type)
+		}
+		if i.Address != "" {
+			gadget.address = i.Address
+		}
+		if i.Port != 0 {
+			gadget.port = i.Port
+		}
+		if i.OnLoad != "" {
+			gadget.onLoad = i.OnLoad
+		}
+		return gadget, nil
+	}
+	return nil, errors.New("the app has no Frida gadget among its native libraries")
+}
+
+// waitForGadget waits until the gadget listens behind the forwarded port.
+// adb accepts the connection either way, but closes it right away while
+// nothing listens on the device; the gadget waits for the client to speak.
+func waitForGadget(port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("the Frida gadget isn't listening on port %d after %s", port, timeout)
+}
+
+func (b *build) smoke() error {
+	fmt.Printf("=> Smoke testing %s for %ds...\n", b.pkg, smokeWait)
+	smoke, err := runSmokeTest(b.serial, b.pkg, time.Duration(smokeWait)*time.Second)
+	if err != nil {
+		return fmt.Errorf("Smoke test failed: %v", err)
+	}
+	b.result.SmokeTest = smoke
+	if smoke.Passed {
+		fmt.Println("Smoke test passed, top activity:", smoke.TopActivity)
+		return nil
+	}
+
+	fmt.Println("Smoke test FAILED:", smoke.Reason)
+	if smoke.Crash != "" {
+		fmt.Println(smoke.Crash)
+	}
+	b.exitCode, b.failed = exitDevice, "smoke test"
+	return nil
+}
+
+// postCommandResult is the -post-command that ran and how it exited.
+type postCommandResult struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// postCommandVars are what a -post-command can refer to, as {{.Output}} or
+// $RSIW_OUTPUT and so on. In the template they're quoted for the shell.
+type postCommandVars struct {
+	Output  string
+	Input   string
+	Package string
+}
+
+// postCommandTemplate parses the -post-command, rejecting references to
+// anything but postCommandVars.
+func postCommandTemplate(command string) (*template.Template, error) {
+	t, err := template.New("post-command").Option("missingkey=error").Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	return t, t.Execute(ioutil.Discard, postCommandVars{})
+}
+
+// runPostCommand runs the -post-command on the output, once everything
+// else succeeded.
+func (b *build) runPostCommand() error {
+	if b.exitCode != 0 {
+		fmt.Printf("Not running the post-command: the build failed its %s\n", b.failed)
+		return nil
+	}
+	vars := postCommandVars{Output: b.output, Input: b.apk, Package: b.pkg}
+	if b.format() == "dir" {
+		vars.Output = b.keptDir
+	}
+	t, err := postCommandTemplate(postCommand)
+	if err != nil {
+		return fmt.Errorf("Invalid -post-command: %v", err)
+	}
+	var command bytes.Buffer
+	quoted := postCommandVars{Output: hostQuote(vars.Output), Input: hostQuote(vars.Input), Package: hostQuote(vars.Package)}
+	if err := t.Execute(&command, quoted); err != nil {
+		return fmt.Errorf("Invalid -post-command: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", command.String())
+	if runtime.GOOS == "windows" {
+		// Go would quote the command as an argument of a C program, cmd
+		// takes its command line as it is. CmdLine only exists on Windows.
+		cmd = exec.Command("cmd")
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		reflect.ValueOf(cmd.SysProcAttr).Elem().FieldByName("CmdLine").SetString(`cmd /S /C "` + command.String() + `"`)
+	}
+	cmd.Env = append(os.Environ(), "RSIW_OUTPUT="+vars.Output, "RSIW_INPUT="+vars.Input, "RSIW_PACKAGE="+vars.Package)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	b.result.PostCommand = &postCommandResult{Command: command.String()}
+	if err == nil {
+		return nil
+	}
+	b.result.PostCommand.ExitCode = -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		b.result.PostCommand.ExitCode = exitErr.ExitCode()
+	}
+	if postAllowFail {
+		b.warnf("The post-command failed (%v), ignored with -post-command-allow-fail", err)
+		return nil
+	}
+	return fmt.Errorf("The post-command failed: %v", err)
+}
+
+func (b *build) keep() error {
+	name := projectName
+	if name == "" {
+		name = sanitizeProjectName(b.pkg)
+	}
+	keptDir := filepath.Join(filepath.Dir(b.output), name)
+	if fileExists(keptDir) {
+		return fmt.Errorf("Cannot keep decompiled sources: %s already exists", keptDir)
+	}
+	if err := keepTree(b.appDir, keptDir, keepMode); err != nil {
+		return fmt.Errorf("Failed to keep decompiled sources: %v", err)
+	}
+	b.keptDir = keptDir
+	return nil
+}
+
+// progress writes the -progress-json event stream: one JSON object per line
+// when a stage starts and ends. A nil *progress only runs the stages.
+type progress struct {
+	w io.Writer
+}
+
+type progressEvent struct {
+	Event      string `json:"event"` // "start" or "end"
+	Stage      string `json:"stage"`
+	Time       string `json:"time"`
+	Status     string `json:"status,omitempty"` // "ok" or "failed"
+	DurationMs *int64 `json:"durationMs,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (p *progress) track(name string, run func() error) error {
+	if p == nil {
+		return run()
+	}
+
+	start := time.Now()
+	p.emit(progressEvent{Event: "start", Stage: name, Time: start.UTC().Format(time.RFC3339Nano)})
+	err := run()
+	elapsed := time.Since(start).Milliseconds()
+	end := progressEvent{
+		Event:      "end",
+		Stage:      name,
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		Status:     "ok",
+		DurationMs: &elapsed,
+	}
+	if err != nil {
+		end.Status = "failed"
+		end.Error = err.Error()
+	}
+	p.emit(end)
+	return err
+}
+
+// emit writes one event with a single Write call, so it reaches the reader
+// immediately and never interleaves with another line.
+func (p *progress) emit(ev progressEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	p.w.Write(append(line, '\n'))
+}
+
+// report is the summary printed by -json.
+type report struct {
+	Input           string              `json:"input"`
+	Output          string              `json:"output,omitempty"`
+	Package         string              `json:"package,omitempty"`
+	ApktoolVersion  string              `json:"apktoolVersion,omitempty"`
+	ApktoolBundled  bool                `json:"apktoolBundled,omitempty"`
+	ArtifactType    string              `json:"artifactType,omitempty"`
+	Signer          string              `json:"signer,omitempty"`
+	SignerSHA256    []string            `json:"signerSHA256,omitempty"`
+	Verification    *signatureStatus    `json:"verification,omitempty"`
+	Unsigned        bool                `json:"unsigned,omitempty"` // by request, -no-sign
+	SigningManifest string              `json:"signingManifest,omitempty"`
+	SigningKey      string              `json:"signingKey,omitempty"`
+	Verifier        string              `json:"verifier,omitempty"`
+	Packed          bool                `json:"packed"`
+	Packer          string              `json:"packer,omitempty"`
+	SharedUserID    string              `json:"sharedUserId,omitempty"`
+	DecompiledDir   string              `json:"decompiledDir,omitempty"`
+	Installed       bool                `json:"installed,omitempty"`
+	InstallCommand  string              `json:"installCommand,omitempty"`
+	SmokeTest       *smokeResult        `json:"smokeTest,omitempty"`
+	DebuggableCheck *debuggableCheck    `json:"debuggableCheck,omitempty"`
+	Removed         []string            `json:"removedComponents,omitempty"`
+	WrapSh          []string            `json:"wrapSh,omitempty"`
+	AppEntry        string              `json:"appEntry,omitempty"`
+	AAPT2Args       map[string][]string `json:"aapt2Args,omitempty"`
+	RootBypass      []patchedMethod     `json:"rootBypass,omitempty"`
+	ABI             string              `json:"abi,omitempty"`
+	FridaCommand    string              `json:"fridaCommand,omitempty"`
+	OBB             []string            `json:"obb,omitempty"`
+	Splits          []string            `json:"splits,omitempty"`
+	Module          string              `json:"module,omitempty"`
+	Secrets         []secretFinding     `json:"secrets,omitempty"`
+	ManifestJSON    string              `json:"manifestArtifact,omitempty"`
+	Instrument      string              `json:"instrumentCommand,omitempty"`
+	Provider        *injectedProvider   `json:"injectedProvider,omitempty"`
+	MergedSmali     []string            `json:"mergedSmali,omitempty"`
+	PostCommand     *postCommandResult  `json:"postCommand,omitempty"`
+	FastResign      bool                `json:"fastResign,omitempty"`
+	UpToDate        bool                `json:"upToDate,omitempty"`
+	OutputSize      int64               `json:"outputSize,omitempty"`
+	MethodCounts    map[string]int      `json:"methodCounts,omitempty"`
+	Analytics       map[string][]string `json:"analyticsDisabled,omitempty"`
+	Backups         []string            `json:"backups,omitempty"`
+	Warnings        []string            `json:"warnings,omitempty"`
+}
+
+func usage() {
+	fmt.Println("Usage: go run debugAPK.go [OPTIONS] <APK_FILE|APK_URL> [APKTOOL_JAR]")
+	fmt.Println("Options:")
+	fmt.Println("  -verify-install               Install the signed APK on a connected device as a final check, and")
+	fmt.Println("                                confirm the device treats it as debuggable (run-as, the DEBUGGABLE")
+	fmt.Println("                                package flag and a JDWP process after a launch)")
+	fmt.Println("  -uninstall-after              Uninstall the app again after -verify-install succeeds")
+	fmt.Println("  -install                      Install the debug APK on the connected device")
+	fmt.Println("  -install-user USER            Install for this user ID, or current or all, as adb install --user")
+	fmt.Println("  -smoke-test                   After -install, launch the app and check it doesn't crash")
+	fmt.Println("  -smoke-wait SECONDS           Seconds the app has to stay alive during -smoke-test (default 5)")
+	fmt.Println("  -frida-attach                 After -install, for an app that ships a Frida gadget in listen mode:")
+	fmt.Println("                                launch it, forward the gadget's port and print the frida command")
+	fmt.Println("  -frida-script FILE            With -frida-attach, run frida attached to the gadget with FILE loaded,")
+	fmt.Println("                                removing the port forward when it exits")
+	fmt.Println("  -device-timeout SECONDS       Seconds to wait for the device to come online and finish booting (default 30)")
+	fmt.Println("  -sha256 HEX                   Expected SHA-256 of the input APK, checked before anything else")
+	fmt.Println("  -download-timeout SECONDS     Seconds each download attempt may take, of the input or of tools (default 300)")
+	fmt.Println("  -apktool-version VERSION      Use this apktool release (downloaded into the cache on demand)")
+	fmt.Println("  -apktool-sha256 HEX           Expected SHA-256 of the -apktool-version jar, checked whatever its source")
+	fmt.Println("  -artifact-mirror URL          Mirror to download tools from, tried in order before GitHub (repeatable);")
+	fmt.Println("                                it serves the apktool jar as URL/apktool/apktool_VERSION.jar.")
+	fmt.Println("                                A mirror is only used for files with a known SHA-256: apktool")
+	fmt.Println("                                releases with a pinned checksum, or -apktool-sha256.")
+	fmt.Println("                                Downloads honor HTTPS_PROXY and NO_PROXY")
+	fmt.Println("  -allow-unverified-mirror      Use the -artifact-mirror for files without a known SHA-256 too")
+	fmt.Println("  -artifact-ca-cert FILE        PEM file of CA certificates to trust for downloads, e.g. the CA of a")
+	fmt.Println("                                TLS-intercepting proxy (on top of the system roots)")
+	fmt.Println("  -output-format FORMAT         Output a signed APK (apk, default) or the patched decompiled tree (dir)")
+	fmt.Println("  -keep-decompiled              Keep the decompiled sources next to the debug APK")
+	fmt.Println("  -keep-mode MODE               How -keep-decompiled and -output-format dir make the kept tree: move")
+	fmt.Println("                                (default; renamed, or copied across filesystems), copy, or link: hard")
+	fmt.Println("                                links on the same filesystem, copies otherwise. AndroidManifest.xml and")
+	fmt.Println("                                apktool.yml are always copied, so editing them can't change the other")
+	fmt.Println("                                tree")
+	fmt.Println("  -project-name NAME            Name of the decompiled project directory (default: the app's package id)")
+	fmt.Println("  -java-heap SIZE               Maximum JVM heap for apktool, e.g. 4g")
+	fmt.Println("  -java-opt OPTION              Extra JVM option for apktool (repeatable)")
+	fmt.Println("  -aapt2-arg OPTION             Extra aapt2 option for the rebuild, with its value if it takes one,")
+	fmt.Println("                                e.g. --no-version-vectors or \"-0 webp\" (repeatable). apktool can't")
+	fmt.Println("                                pass options through, so aapt2 (from PATH or the SDK build-tools) is run")
+	fmt.Println("                                through debugAPK, which adds them to its compile or link command")
+	fmt.Println("  -max-parallel-java N          Run at most N apktool JVMs at once across all runs on this machine, so")
+	fmt.Println("                                runs started in parallel (e.g. xargs -P) don't run out of memory; the")
+	fmt.Println("                                others wait their turn (default: free memory / JVM heap, at least 1;")
+	fmt.Println("                                without /proc/meminfo, the number of CPUs, at most 4)")
+	fmt.Println("  -signing-props FILE           Sign with the keystore described by a keystore.properties file")
+	fmt.Println("                                (storeFile, storePassword, keyPassword, and keyAlias unless the keystore")
+	fmt.Println("                                holds a single key)")
+	fmt.Println("  -next-signer FILE             Sign with the key of this keystore.properties file as well, after the")
+	fmt.Println("                                first key, so the APK has several v1/v2 signers (repeatable). Needs")
+	fmt.Println("                                apksigner; v3 and v4, which take a single signer, are left out, with")
+	fmt.Println("                                a warning")
+	fmt.Println("  -keystore FILE                Sign with a key from a JKS or PKCS12 keystore. Given again, each further")
+	fmt.Println("                                keystore's key signs as well, like a -next-signer; their passwords are")
+	fmt.Println("                                prompted for")
+	fmt.Println("  -ks-type TYPE                 Keystore type: jks, pkcs12, or pkcs11 to sign with a hardware token")
+	fmt.Println("                                (default: detected from the -keystore file)")
+	fmt.Println("  -pkcs11-config FILE           SunPKCS11 provider config naming the token's library and slot")
+	fmt.Println("  -ks-alias ALIAS               Alias of the key of the -keystore before it, needed when that keystore")
+	fmt.Println("                                holds several")
+	fmt.Println("  -storepass PASSWORD           Password of the -keystore, or the token PIN; prompted for when missing")
+	fmt.Println("  -keypass PASSWORD             Password of the key when it differs from the keystore's; prompted")
+	fmt.Println("                                for when -storepass was too")
+	fmt.Println("  -audit-log FILE               Append a JSON line to FILE for every signing: time, user, input and output")
+	fmt.Println("                                SHA-256, key alias and certificate fingerprint, never passwords")
+	fmt.Println("  -allow-expired-cert           Sign even though the certificate of the -keystore or -signing-props key")
+	fmt.Println("                                has expired (some devices reject such APKs)")
+	fmt.Println("  -compression MODE             Re-compress the rebuilt APK: store, fast or best")
+	fmt.Println("                                (apktool has no level option, so the APK is re-written after the build;")
+	fmt.Println("                                resources.arsc, native libraries and entries apktool stored stay stored)")
+	fmt.Println("  -preserve-order               Reorder the rebuilt APK's entries to follow the input APK; new entries")
+	fmt.Println("                                go last, in apktool's order. Later re-writes keep the order")
+	fmt.Println("  -strip-meta-inf               With sign, remove all of META-INF; by default only the old signature goes")
+	fmt.Println("                                and the rest, such as META-INF/services, stays")
+	fmt.Println("  -module NAME                  For an app bundle (.aab) input: the module whose manifest is made")
+	fmt.Println("                                debuggable (default base), e.g. a dynamic feature's. apktool can't")
+	fmt.Println("                                decode bundles, so only the manifest is patched, and the bundle signed")
+	fmt.Println("                                with jarsigner into <name>.debug.aab; with sign, patches that module")
+	fmt.Println("                                as well as re-signing")
+	fmt.Println("  -verify-with TOOL             Verify the signature with apksigner, jarsigner or auto (default auto:")
+	fmt.Println("                                apksigner when installed, otherwise jarsigner, whichever tool signed)")
+	fmt.Println("  -json                         Print a JSON report on stdout (progress goes to stderr)")
+	fmt.Println("  -progress-json                Stream stage start/end events as JSON lines on stderr")
+	fmt.Println("  -verbose                      Print the retries of adb commands that failed for a moment")
+	fmt.Println("  -backup-original              Copy an existing output file to <name>.bak-<timestamp> before it's overwritten")
+	fmt.Println("  -o FILE                       Output file (default <name>.debug.apk next to the input); .apk is")
+	fmt.Println("                                appended when FILE has no extension")
+	fmt.Println("  -strict                       Fail instead of warning when -o doesn't end in .apk, or the output is")
+	fmt.Println("                                over -max-size")
+	fmt.Println("  -no-sign                      Leave the APK unsigned, e.g. to sign it elsewhere. Its signature isn't")
+	fmt.Println("                                checked then, the rest of the checks still run. The aligned APK comes")
+	fmt.Println("                                with its signing manifest, APK.sign.json, of its SHA-256: the sign")
+	fmt.Println("                                command refuses to sign the APK if it changed since")
+	fmt.Println("  -max-size SIZE                Warn when the signed output is bigger than SIZE bytes, or k, m, g")
+	fmt.Println("                                (KB, MB, GB: powers of 1024), e.g. to catch the growth of injected code")
+	fmt.Println("  -legacy-external-storage      Set android:requestLegacyExternalStorage=\"true\" (ignored when targeting API 30+)")
+	fmt.Println("  -debug-profile                Apply the debug-friendly preset: android:debuggable (always set),")
+	fmt.Println("                                -cleartext-traffic and -extract-native-libs. Pass one of those =false")
+	fmt.Println("                                to leave it out")
+	fmt.Println("  -cleartext-traffic            Set android:usesCleartextTraffic=\"true\", to allow plain HTTP")
+	fmt.Println("  -extract-native-libs          Set android:extractNativeLibs=\"true\", so native libraries are on disk")
+	fmt.Println("  -strict-mode                  Turn on StrictMode's default checks, logging violations to logcat, from")
+	fmt.Println("                                the start of the app's Application.onCreate")
+	fmt.Println("  -all-files-access             Request MANAGE_EXTERNAL_STORAGE; the access still has to be granted on")
+	fmt.Println("                                the device. Android 10 only has legacy storage: add")
+	fmt.Println("                                -legacy-external-storage for it")
+	fmt.Println("  -obb FILE                     OBB expansion file of the app: it's copied next to the debug APK as")
+	fmt.Println("                                main.<versionCode>.<package>.obb (patch. when FILE's name starts with")
+	fmt.Println("                                patch.), and -install pushes it to /sdcard/Android/obb/<package>/")
+	fmt.Println("  -remove-component CLASS       Remove an activity, service, receiver or provider from the manifest;")
+	fmt.Println("                                names starting with \".\" are relative to the package (repeatable)")
+	fmt.Println("  -remove-component-code        Also delete the smali classes of removed components")
+	fmt.Println("  -bypass-root-detection        Make the root checks of RootBeer and RootTools, and methods testing for")
+	fmt.Println("                                su binaries or root manager apps, return false. Best effort: only")
+	fmt.Println("                                these patterns are recognized, obfuscated or native checks are not")
+	fmt.Println("  -report-method-counts         Estimate the method references in each dex and warn near the 64K limit")
+	fmt.Println("  -emit-manifest-artifact       Once the build succeeds, write <name>.manifest.json next to the output,")
+	fmt.Println("                                with apktool.yml, the decoded manifest, the edits applied to it with")
+	fmt.Println("                                a diff of each, and the patched manifest")
+	fmt.Println("  -scan-secrets                 Look for hardcoded secrets (Google API keys, AWS access key IDs,")
+	fmt.Println("                                Firebase URLs, JWTs, private keys, Basic auth credentials) in the")
+	fmt.Println("                                decoded resources, assets and smali strings, and report them redacted")
+	fmt.Println("  -secrets-sarif FILE           With -scan-secrets, also write the findings to FILE as SARIF")
+	fmt.Println("  -disable-analytics            Remove or turn off the components of known analytics and crash reporting")
+	fmt.Println("                                SDKs (Firebase, Google Analytics, Facebook, Adjust, AppsFlyer)")
+	fmt.Println("  -analytics-keep NAME          SDK id, component or meta-data name for -disable-analytics to leave")
+	fmt.Println("                                alone (repeatable)")
+	fmt.Println("  -update-notice                Say when a newer version is released (checked at most once a day)")
+	fmt.Println("  -release-key FILE             Ed25519 public key (PEM) that self-update requires the checksums.txt of")
+	fmt.Println("                                a release to be signed with (default: the project's key, none yet)")
+	fmt.Println("  -set-app-attr NAME=VALUE      Set android:NAME=VALUE on the application (repeatable), e.g.")
+	fmt.Println("                                hardwareAccelerated=false to rule out GPU rendering bugs; a VALUE")
+	fmt.Println("                                like @type/name must name a resource of the app or of android")
+	fmt.Println("  -theme STYLE                  Set android:theme on the application, like -set-app-attr, to a")
+	fmt.Println("                                style such as @style/Theme.Debug or @android:style/Theme.Material")
+	fmt.Println("  -add-instrumentation SPEC     Declare an <instrumentation> for test runners to drive the app, with")
+	fmt.Println("                                SPEC runner=CLASS[,target=PACKAGE][,test-library]: target defaults to")
+	fmt.Println("                                the app itself, test-library also adds the android.test.runner library")
+	fmt.Println("  -inject-provider CLASS        Declare CLASS as a content provider, with an authority of its own, for")
+	fmt.Println("                                hooks that must run before Application.onCreate. CLASS must be in")
+	fmt.Println("                                the app's code, or in -merge-smali-dir")
+	fmt.Println("  -merge-smali-dir DIR          Add the .smali files under DIR (laid out by package, as apktool does)")
+	fmt.Println("                                to the app as a new smali_classesN dex; their classes must be new")
+	fmt.Println("  -post-command CMD             Once the build succeeded, run CMD with the shell (sh -c; cmd /C on")
+	fmt.Println("                                Windows), e.g. to upload or scan the output. In CMD, {{.Output}},")
+	fmt.Println("                                {{.Input}} and {{.Package}} expand to the output path (the sources")
+	fmt.Println("                                with -output-format dir), the input APK and the package, quoted for")
+	fmt.Println("                                the shell; they're also in $RSIW_OUTPUT, $RSIW_INPUT, $RSIW_PACKAGE.")
+	fmt.Println("                                The run fails when CMD exits non-zero")
+	fmt.Println("  -post-command-allow-fail      Only warn when the -post-command exits non-zero")
+	fmt.Println("  -wrap-sh FILE                 Install FILE as lib/<abi>/wrap.sh for each ABI the app ships, to launch")
+	fmt.Println("                                it under a native debugger or with a custom environment")
+	fmt.Println("  -serve                        Once it's built, serve the debug APK over HTTP to devices on the same")
+	fmt.Println("                                network, printing its URL and a QR code of it")
+	fmt.Println("  -serve-port PORT              Port to serve on (default: any free one)")
+	fmt.Println("  -serve-downloads N            Stop serving after N downloads (default 1)")
+	fmt.Println("  -serve-timeout SECONDS        Stop serving after SECONDS, downloaded or not (default 600)")
+	fmt.Println("  -only-if-changed              Skip the whole run, -install included, when the output exists and was")
+	fmt.Println("                                built from the same input, options, apktool and signing key (for CI)")
+	fmt.Println("  -force                        With -only-if-changed, run anyway")
+	fmt.Println("  -version                      Print the version of debugAPK, and of each tool it uses (with -json")
+	fmt.Println("                                as JSON), for bug reports. go run doesn't record the commit: build")
+	fmt.Println("                                with -ldflags \"-X main.revision=$(git rev-parse HEAD)\" to have it")
+	fmt.Println("  -h                            Print Help")
+	fmt.Println("Commands:")
+	fmt.Println("  apktool list                  List cached apktool versions")
+	fmt.Println("  examples                      Print common invocations, with what each does")
+	fmt.Println("  undebug [OPTIONS] APK         Rebuild and sign APK with android:debuggable=\"false\" instead, e.g. as")
+	fmt.Println("                                a clean build to compare the debug APK with (<name>.nodebug.apk)")
+	fmt.Println("  sign [OPTIONS] FILE [SPLIT...] Re-sign an existing .apk or .aab (bundles are signed with jarsigner),")
+	fmt.Println("                                and the split APKs of the app with the same key; with -install, the")
+	fmt.Println("                                APKs are installed together in one session. It first checks FILE's")
+	fmt.Println("                                SHA-256 against -sha256 and its signing manifest (-no-sign), if any:")
+	fmt.Println("                                FILE.sign.json, or -signing-manifest FILE, which is required then")
+	fmt.Println("  serve [OPTIONS] FILE          Serve FILE like -serve does")
+	fmt.Println("  verify [-recursive] [-json] PATH...")
+	fmt.Println("                                Check the alignment (zipalign -c 4) and signatures of APKs, listing")
+	fmt.Println("                                the schemes and signer fingerprints of each; with -recursive, of")
+	fmt.Println("                                every .apk under the PATH directories, but those a .rsiwignore file")
+	fmt.Println("                                in PATH or -exclude PATTERN exclude (.gitignore syntax, -exclude")
+	fmt.Println("                                wins; -v prints the rules). Unless all are signed and aligned, it")
+	fmt.Println("                                counts the failures by category: input (not an APK, exits 4),")
+	fmt.Println("                                signature or alignment (exits 8); -json -summary prints the failed")
+	fmt.Println("                                APKs of each category")
+	fmt.Println("  clean -backups [DIR...]       Delete -backup-original copies (default: current directory)")
+	fmt.Println("  clean -partials               Delete interrupted downloads kept in the cache to be resumed")
+	fmt.Println("  self-update [-check-only]     Replace this binary with the latest release for this OS and architecture,")
+	fmt.Println("                                if its signed checksums check out (there are no binary releases yet:")
+	fmt.Println("                                debugAPK.go runs from source); -check-only prints the newer version")
+	fmt.Println("                                and exits 0 if there is one, 1 if not")
+	fmt.Println("  doctor                        Check which external tools are installed")
+	fmt.Println("  pins [-json] APK|DIR          List the certificate pins of the app's network security config")
+	fmt.Println("  manifest [-format json] APK   Print the APK's manifest as XML, or a JSON summary, without apktool")
+	fmt.Println("  permissions [-json] APK       List the permissions the APK requests and declares, marking the")
+	fmt.Println("                                dangerous (runtime) ones")
+	fmt.Println("  links [-json] APK             List the deep links and app links of the APK's activities, with an")
+	fmt.Println("                                am start command for each; with a device connected, also the state")
+	fmt.Println("                                of the app links' domain verification")
+	fmt.Println("  libs [-json] APK              List the APK's native libraries: size, compression, alignment, and")
+	fmt.Println("                                the architecture, NDK and stripping read from their ELF headers")
+	fmt.Println("  keystore list -keystore FILE  List the keys and certificates of a JKS or PKCS12 keystore")
+	fmt.Println("                                (or of a token, with -ks-type pkcs11 -pkcs11-config FILE)")
+	fmt.Println("On Windows, writing the output is retried for a few seconds when another process, usually an")
+	fmt.Println("antivirus scan, has it open.")
+	fmt.Println("Options can also be set in $RSIW_ARGS, e.g. RSIW_ARGS='-install -java-heap 4g', and as")
+	fmt.Println("\"option = value\" lines in", configPath())
+	fmt.Println("(or the file named by $DEBUGAPK_CONFIG). Command line options take precedence over $RSIW_ARGS,")
+	fmt.Println("which takes precedence over the config file.")
+	fmt.Println("To embed an apktool jar, used when apktool isn't installed, build with debugAPK_bundled.go:")
+	fmt.Println("  go build -tags bundled -o debugAPK debugAPK.go debugAPK_bundled.go")
+	fmt.Println("Exit codes of a build (exit-codes -json prints them as JSON):")
+	printExitCodes()
+}
+
+// outputPath applies -o: a path without an extension gets ext appended,
+// and a different extension is a warning, or an error under -strict.
+func outputPath(path, ext string) (string, string, error) {
+	switch got := filepath.Ext(path); {
+	case got == "":
+		return path + ext, "", nil
+	case strings.EqualFold(got, ext):
+		return path, "", nil
+	}
+
+	warning := fmt.Sprintf("%s doesn't end in %s, installers may not recognize it", path, ext)
+	if strict {
+		return "", "", errors.New(warning)
+	}
+	return path, warning, nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// cmdError is returned by processCMD and keeps the failed command's stderr
+// around, so callers can recognise known failure signatures.
+type cmdError struct {
+	err    error
+	stderr string
+}
+
+func (e *cmdError) Error() string {
+	if last := lastLine(e.stderr); last != "" {
+		return e.err.Error() + ": " + last
+	}
+	return e.err.Error()
+}
+
+func (e *cmdError) Unwrap() error { return e.err }
+
+// lastLine returns the last non-blank line of a command's output, which is
+// usually where the error is.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func processCMD(cmd *exec.Cmd, debugFlag bool) error {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	if debugFlag {
+		fmt.Println("Command output:\n", stdout.String())
+		fmt.Println("Command error:\n", stderr.String())
+	}
+
+	if err != nil {
+		return &cmdError{err: err, stderr: stderr.String()}
+	}
+	return nil
+}
+
+// apktoolRunner invokes the selected apktool: the wrapper script on PATH, or
+// a jar through java when jar is set.
+type apktoolRunner struct {
+	name    string
+	jar     string
+	jvmArgs []string
+	// bundled is set when apktool isn't installed and the jar embedded in
+	// the binary runs instead.
+	bundled bool
+	// env is added to apktool's environment.
+	env []string
+}
+
+func (a *apktoolRunner) command(args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if a.jar != "" {
+		javaArgs := append(append([]string{}, a.jvmArgs...), "-jar", a.jar)
+		cmd = exec.Command("java", append(javaArgs, args...)...)
+	} else {
+		cmd = exec.Command(a.name, args...)
+		if len(a.jvmArgs) > 0 {
+			// The wrapper script starts its own JVM, so the options can only
+			// reach it through the environment.
+			opts := strings.Join(a.jvmArgs, " ")
+			cmd.Env = append(os.Environ(),
+				"_JAVA_OPTIONS="+strings.TrimSpace(os.Getenv("_JAVA_OPTIONS")+" "+opts),
+				"APKTOOL_OPTS="+strings.TrimSpace(os.Getenv("APKTOOL_OPTS")+" "+opts),
+			)
+		}
+	}
+	if len(a.env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, a.env...)
+	}
+	return cmd
+}
+
+func (a *apktoolRunner) version() (string, error) {
+	if a.jar != "" {
+		return getInstalledVersion("java", "-jar", a.jar)
+	}
+	return getInstalledVersion(a.name)
+}
+
+var heapPattern = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+// run runs apktool with args, once it holds a -max-parallel-java slot.
+func (a *apktoolRunner) run(debugFlag bool, args ...string) error {
+	release, err := acquireJavaSlot(maxJava)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return processCMD(a.command(args...), debugFlag)
+}
+
+// acquireJavaSlot waits for one of max JVM slots shared by every run on the
+// machine (max <= 0 picks by free memory), and returns the function giving
+// it back. A slot is a lock file holding the pid of its run, so the slot of
+// a run that died is taken over.
+func acquireJavaSlot(max int) (func(), error) {
+	if max <= 0 {
+		max = defaultJavaSlots()
+	}
+	dir := filepath.Join(filepath.Dir(apktoolCacheDir()), "java-slots")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	waiting := false
+	for {
+		for i := 0; i < max; i++ {
+			lock := filepath.Join(dir, fmt.Sprintf("slot-%d.lock", i))
+			f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err == nil {
+				fmt.Fprintln(f, os.Getpid())
+				f.Close()
+				return func() { os.Remove(lock) }, nil
+			}
+			if !os.IsExist(err) {
+				return nil, err
+			}
+			if data, err := ioutil.ReadFile(lock); err == nil {
+				if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && !processAlive(pid) {
+					os.Remove(lock)
+					i--
+				}
+			}
+		}
+		if !waiting {
+			fmt.Printf("Waiting for a JVM slot, %d apktool JVMs are running already (-max-parallel-java)...\n", max)
+			waiting = true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// processAlive reports whether the process pid still runs. Windows can't
+// signal, but finding the process fails there once it's gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// meminfoPath is where defaultJavaSlots reads the free memory from.
+var meminfoPath = "/proc/meminfo"
+
+// defaultJavaSlots is the -max-parallel-java default: as many JVMs as fit
+// in the available memory with the -java-heap each, or the quarter of the
+// memory the JVM defaults to. Without /proc/meminfo, as on macOS and
+// Windows, it's a JVM per CPU, but no more than the 4 the default heap
+// allows for.
+func defaultJavaSlots() int {
+	data, err := ioutil.ReadFile(meminfoPath)
+	if err != nil {
+		if n := runtime.NumCPU(); n < 4 {
+			return n
+		}
+		return 4
+	}
+	info := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			info[strings.TrimSuffix(fields[0], ":")] = kb << 10
+		}
+	}
+	heap := info["MemTotal"] / 4
+	if size, ok := parseJavaSize(javaHeap); ok {
+		heap = size
+	}
+	if heap == 0 || info["MemAvailable"] < 2*heap {
+		return 1
+	}
+	return int(info["MemAvailable"] / heap)
+}
+
+// parseJavaSize parses a JVM memory size such as 4g, 512m or 1048576, or
+// 1048576b. Sizes over 2^64 bytes aren't.
+func parseJavaSize(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	shift := uint(0)
+	suffix := true
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "b":
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	case "t":
+		shift = 40
+	default:
+		suffix = false
+	}
+	if suffix {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n<<shift>>shift != n {
+		return 0, false
+	}
+	return n << shift, true
+}
+
+func jvmOptions() []string {
+	var opts []string
+	if javaHeap != "" {
+		opts = append(opts, "-Xmx"+javaHeap)
+	}
+	return append(opts, javaOpts...)
+}
+
+// printOOMHint explains a java.lang.OutOfMemoryError from apktool and
+// suggests a -java-heap size derived from the APK's uncompressed size.
+func printOOMHint(err error, apk string) {
+	var cerr *cmdError
+	if !errors.As(err, &cerr) || !strings.Contains(cerr.stderr, "java.lang.OutOfMemoryError") {
+		return
+	}
+
+	heap := "4g"
+	if size, err := uncompressedSize(apk); err == nil {
+		gb := uint64(2)
+		for gb*(1<<30) < size*3 {
+			gb *= 2
+		}
+		heap = fmt.Sprintf("%dg", gb)
+	}
+	fmt.Printf("Hint: apktool ran out of memory, retry with -java-heap %s\n", heap)
+}
+
+var manifestErrorPattern = regexp.MustCompile(`(?:Exception|Error)\b.*AndroidManifest\.xml|AndroidManifest\.xml.*(?:Exception|Error)\b`)
+
+// isManifestDecodeError reports whether apktool failed on the manifest
+// itself, rather than on resources or code.
+func isManifestDecodeError(err error) bool {
+	var cerr *cmdError
+	return errors.As(err, &cerr) && manifestErrorPattern.MatchString(cerr.stderr)
+}
+
+// resourceError is an error aapt2 reported for a resource file, which is
+// relative to the decoded app, e.g. res/values/strings.xml.
+type resourceError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+var resourceErrorPattern = regexp.MustCompile(`(?m)(?:^|\s)\S*[\\/](res[\\/][^\s:]+\.xml):(\d+)(?::\d+)?: error: (.+?)\.?\r?$`)
+
+// resourceErrors extracts the files and lines aapt2 complained about from a
+// failed apktool build. apktool prints them amid its own stack trace.
+func resourceErrors(err error) []resourceError {
+	var cerr *cmdError
+	if !errors.As(err, &cerr) {
+		return nil
+	}
+
+	var errs []resourceError
+	seen := map[resourceError]bool{}
+	for _, m := range resourceErrorPattern.FindAllStringSubmatch(cerr.stderr, -1) {
+		line, _ := strconv.Atoi(m[2])
+		e := resourceError{File: strings.ReplaceAll(m[1], `\`, "/"), Line: line, Message: m[3]}
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+func uncompressedSize(apk string) (uint64, error) {
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	var size uint64
+	for _, f := range r.File {
+		size += f.UncompressedSize64
+	}
+	return size, nil
+}
+
+func getInstalledVersion(apktool string, args ...string) (string, error) {
+	cmd := exec.Command(apktool, append(args, "--version")...)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	scanner.Scan()
+	fields := strings.Fields(scanner.Text())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no version reported by %s", apktool)
+	}
+	return fields[0], scanner.Err()
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+func apktoolCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "debugapk", "apktool")
+}
+
+// apktoolChecksums are the SHA-256 checksums of the apktool releases, as
+// published on their release pages, so that a jar from a mirror or the
+// cache can be trusted without -apktool-sha256. The bundled jar's version
+// is added by the bundled build.
+var apktoolChecksums = map[string]string{}
+
+// cachedApktool returns the path of the cached jar for version, downloading
+// it from the apktool GitHub releases first if it isn't cached yet.
+func cachedApktool(version string) (string, error) {
+	if !versionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid apktool version %q", version)
+	}
+
+	if bundledApktool != nil && bundledApktool.version == version {
+		return bundledApktool.extract()
+	}
+
+	sum := apktoolSHA256
+	if sum == "" {
+		sum = apktoolChecksums[version]
+	}
+	jar := filepath.Join(apktoolCacheDir(), "apktool_"+version+".jar")
+	if fileExists(jar) {
+		if got, err := fileSHA256(jar); err == nil && sum != "" && !strings.EqualFold(got, sum) {
+			return "", fmt.Errorf("cached %s has checksum %s, expected %s", jar, got, sum)
+		}
+		return jar, nil
+	}
+
+	if err := os.MkdirAll(apktoolCacheDir(), 0755); err != nil {
+		return "", err
+	}
+	unlock, err := lockCacheEntry(jar)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if fileExists(jar) {
+		return jar, nil // downloaded by the run we waited for
+	}
+
+	d, err := newDownloader()
+	if err != nil {
+		return "", err
+	}
+	name := "apktool_" + version + ".jar"
+	err = d.fetch(artifact{
+		path:     "apktool/" + name,
+		upstream: fmt.Sprintf("https://github.com/iBotPeaches/Apktool/releases/download/v%s/%s", version, name),
+		sha256:   sum,
+	}, jar)
+	if err != nil {
+		return "", err
+	}
+	return jar, nil
+}
+
+func cachedApktoolVersions() ([]string, error) {
+	jars, err := filepath.Glob(filepath.Join(apktoolCacheDir(), "apktool_*.jar"))
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, jar := range jars {
+		version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(jar), "apktool_"), ".jar")
+		if versionPattern.MatchString(version) {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return newerVersion(versions[j], versions[i]) })
+	return versions, nil
+}
+
+// bundledJar is an apktool jar embedded in the binary by debugAPK_bundled.go.
+type bundledJar struct {
+	version string
+	sha256  string
+	data    []byte
+}
+
+// bundledApktool is nil unless debugAPK_bundled.go is part of the build.
+var bundledApktool *bundledJar
+
+// extract writes the bundled jar to the apktool cache, where it's used like
+// a downloaded one, after checking it against the embedded checksum.
+func (j *bundledJar) extract() (string, error) {
+	sum := sha256.Sum256(j.data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, j.sha256) {
+		return "", fmt.Errorf("bundled apktool %s has checksum %s, expected %s", j.version, got, j.sha256)
+	}
+
+	jar := filepath.Join(apktoolCacheDir(), "apktool_"+j.version+".jar")
+	if got, err := fileSHA256(jar); err == nil && strings.EqualFold(got, j.sha256) {
+		return jar, nil
+	}
+	if err := os.MkdirAll(apktoolCacheDir(), 0755); err != nil {
+		return "", err
+	}
+	unlock, err := lockCacheEntry(jar)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if got, err := fileSHA256(jar); err == nil && strings.EqualFold(got, j.sha256) {
+		return jar, nil
+	}
+
+	tmp, err := ioutil.TempFile(apktoolCacheDir(), "bundled-*.jar")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(j.data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return jar, os.Rename(tmp.Name(), jar)
+}
+
+const (
+	// cacheLockWait is how long a run waits for another one to finish
+	// writing a cache entry before writing it too.
+	cacheLockWait = 2 * time.Minute
+	// cacheLockStale is the age at which a lock is assumed to be left over
+	// by a run that died.
+	cacheLockStale = 15 * time.Minute
+)
+
+// lockCacheEntry takes the lock of the cache entry at path, a path.lock file
+// created with O_EXCL (which, unlike flock, works the same everywhere), and
+// returns the function releasing it. While another run holds the lock it
+// waits, up to cacheLockWait: then it goes on without the lock, which is
+// still safe since entries are written to a temporary file and renamed, only
+// wasteful.
+func lockCacheEntry(path string) (func(), error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(cacheLockWait)
+	waiting := false
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintln(f, os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > cacheLockStale {
+			takeStaleLock(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			fmt.Println("Gave up waiting for", lock+", writing", filepath.Base(path), "anyway")
+			return func() {}, nil
+		}
+		if !waiting {
+			fmt.Println("Waiting for another run to finish writing", filepath.Base(path)+"...")
+			waiting = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// takeStaleLock moves a stale lock out of the way for the O_EXCL create to
+// retake it. Removing it would race: another run that also found it stale
+// may have replaced it with its own lock in between. A rename only
+// succeeds for one of the runs, and the lock it got is checked again: when
+// it's a fresh one, it goes back.
+func takeStaleLock(lock string) {
+	stale := fmt.Sprintf("%s.stale-%d", lock, os.Getpid())
+	if os.Rename(lock, stale) != nil {
+		return
+	}
+	if info, err := os.Stat(stale); err == nil && time.Since(info.ModTime()) <= cacheLockStale {
+		// Unless yet another run has taken the lock since.
+		os.Link(stale, lock)
+	}
+	os.Remove(stale)
+}
+
+// artifact is a tool file the downloader fetches.
+type artifact struct {
+	// path locates it under a mirror, e.g. apktool/apktool_2.9.3.jar.
+	path     string
+	upstream string
+	// sha256 is checked whichever source served the file, unless it's "".
+	sha256 string
+	// contentTypes, when set, are the only Content-Types accepted.
+	contentTypes []string
+}
+
+// downloader fetches artifacts from each -artifact-mirror in turn, then
+// from upstream. It goes through HTTPS_PROXY/NO_PROXY and trusts the
+// -artifact-ca-cert on top of the system roots.
+type downloader struct {
+	mirrors []string
+	client  *http.Client
+}
+
+func newDownloader() (*downloader, error) {
+	if downloadTime <= 0 {
+		return nil, fmt.Errorf("Invalid -download-timeout %d, expected a number of seconds above 0", downloadTime)
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	if artifactCACert != "" {
+		data, err := ioutil.ReadFile(artifactCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("-artifact-ca-cert %s has no PEM certificates", artifactCACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	// The timeout covers the body too, so a stalled mirror doesn't hold up
+	// the next.
+	timeout := time.Duration(downloadTime) * time.Second
+	return &downloader{mirrors: mirrors, client: &http.Client{Transport: transport, Timeout: timeout}}, nil
+}
+
+// fetch downloads a into dest from the first source that has it with the
+// right checksum.
+func (d *downloader) fetch(a artifact, dest string) error {
+	var urls []string
+	for _, mirror := range d.mirrors {
+		urls = append(urls, strings.TrimRight(mirror, "/")+"/"+a.path)
+	}
+	urls = append(urls, a.upstream)
+
+	var err error
+	tlsFailed := false
+	for i, url := range urls {
+		// A mirror is only as trustworthy as its checksum; upstream is
+		// trusted by its HTTPS certificate.
+		if i < len(d.mirrors) && a.sha256 == "" && !unverifiedOK {
+			err = fmt.Errorf("not downloading %s from the mirror %s, there's no SHA-256 to check it against: pass its checksum (-apktool-sha256), or -allow-unverified-mirror", path.Base(a.path), d.mirrors[i])
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println("=> Downloading", redactURL(url))
+		var sum string
+		if sum, err = d.download(url, dest, a); err == nil {
+			if a.sha256 == "" {
+				fmt.Printf("SHA-256 of %s: %s\n", path.Base(a.path), sum)
+			}
+			return nil
+		}
+		tlsFailed = tlsFailed || isTLSError(err)
+		err = redactURLError(err, url)
+		fmt.Println("Download failed:", err)
+	}
+	if tlsFailed {
+		return fmt.Errorf("%v\nHint: a TLS-intercepting proxy may be re-signing HTTPS traffic, pass its CA certificate with -artifact-ca-cert FILE to trust it for downloads", err)
+	}
+	return err
+}
+
+// partialMeta is saved next to a <dest>.partial download, so a later
+// attempt can tell whether the server still has the same file.
+type partialMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// validator is the If-Range value for resuming, "" when there's none: weak
+// ETags can't be used for ranges.
+func (m partialMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// download fetches url into dest through dest.partial, which is kept when
+// the download is interrupted: the next attempt from the same url resumes it
+// with a Range request, if the server agrees the file hasn't changed. The
+// file only replaces dest once complete and matching a.sha256. It returns
+// the file's SHA-256.
+func (d *downloader) download(url, dest string, a artifact) (string, error) {
+	partial := dest + ".partial"
+	metaPath := partial + ".json"
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	var offset int64
+	var meta partialMeta
+	if data, err := ioutil.ReadFile(metaPath); err == nil && json.Unmarshal(data, &meta) == nil && meta.URL == url && meta.validator() != "" {
+		if info, err := os.Stat(partial); err == nil && info.Size() > 0 {
+			offset = info.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", meta.validator())
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(partial)
+			return "", fmt.Errorf("GET %s: resumed with Content-Range %q, expected offset %d", url, resp.Header.Get("Content-Range"), offset)
+		}
+		fmt.Printf("Resuming at %s\n", formatBytes(offset))
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			fmt.Println("The file changed on the server, downloading it again")
+		}
+		offset = 0
+		mode |= os.O_TRUNC
+		meta = partialMeta{URL: url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+		data, _ := json.Marshal(meta)
+		if err := ioutil.WriteFile(metaPath, data, 0644); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if a.contentTypes != nil {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+		accepted := mediaType == ""
+		for _, t := range a.contentTypes {
+			accepted = accepted || t == mediaType
+		}
+		if !accepted {
+			return "", fmt.Errorf("GET %s: got Content-Type %q, expected one of %s", url, mediaType, strings.Join(a.contentTypes, ", "))
+		}
+	}
+
+	h := sha256.New()
+	if offset > 0 {
+		if err := hashFile(h, partial); err != nil {
+			return "", err
+		}
+	}
+	f, err := os.OpenFile(partial, mode, 0644)
+	if err != nil {
+		return "", err
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	p := &downloadProgress{done: offset, resumed: offset, total: total, start: time.Now(), last: time.Now()}
+	_, err = io.Copy(io.MultiWriter(f, h, p), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v (%s kept to resume from)", err, formatBytes(p.done))
+	}
+	p.finish()
+
+	os.Remove(metaPath)
+	sum := hex.EncodeToString(h.Sum(nil))
+	if a.sha256 != "" && !strings.EqualFold(sum, a.sha256) {
+		os.Remove(partial)
+		return "", fmt.Errorf("%s has checksum %s, expected %s", url, sum, a.sha256)
+	}
+	return sum, os.Rename(partial, dest)
+}
+
+func hashFile(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// downloadProgress prints how far a download got every few seconds, with
+// the speed of this attempt.
+type downloadProgress struct {
+	done, total int64
+	// resumed is where this attempt started.
+	resumed     int64
+	start, last time.Time
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.last) >= 5*time.Second {
+		p.last = time.Now()
+		of := ""
+		if p.total >= 0 {
+			of = " of " + formatBytes(p.total)
+		}
+		fmt.Printf("  %s%s, %s/s\n", formatBytes(p.done), of, formatBytes(p.speed()))
+	}
+	return len(b), nil
+}
+
+func (p *downloadProgress) speed() int64 {
+	secs := time.Since(p.start).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return int64(float64(p.done-p.resumed) / secs)
+}
+
+func (p *downloadProgress) finish() {
+	fmt.Printf("Downloaded %s in %s, %s/s\n", formatBytes(p.done), time.Since(p.start).Round(time.Second/10), formatBytes(p.speed()))
+}
+
+// formatBytes formats a size in bytes, KiB, MiB or GiB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// isTLSError reports whether err is a certificate the download client
+// doesn't trust, as served by interception proxies.
+func isTLSError(err error) bool {
+	var unknown x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	return errors.As(err, &unknown) || errors.As(err, &invalid)
+}
+
+// version is the release this binary was built from. Release builds set it
+// with -ldflags "-X main.version=vX.Y.Z".
+var version = "v0.0.2-Beta"
+
+// revision is the commit this binary was built from, for builds the go
+// command doesn't stamp with one: go run and go build of the .go files
+// record none. Set it with -ldflags "-X main.revision=$(git rev-parse HEAD)".
+var revision = ""
+
+// releaseFeed describes the latest release of the project. self-update needs
+// a binary release to have these assets: debugapk_<os>_<arch>[.exe]
+// binaries, a checksums.txt of them in sha256sum format, and
+// checksums.txt.sig, the Ed25519 signature of checksums.txt, raw or base64.
+const releaseFeed = "https://api.github.com/repos/x00tex/RSiW/releases/latest"
+
+// releasePublicKey is the Ed25519 public key (PEM) checksums.txt.sig must
+// verify with. It's empty because the project publishes no binary
+// releases, debugAPK.go runs from source; until it does, self-update only
+// works with the -release-key of a build you trust.
+const releasePublicKey = ""
+
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) asset(name string) string {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+func latestRelease(d *downloader) (*release, error) {
+	resp, err := d.client.Get(releaseFeed)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", releaseFeed, resp.Status)
+	}
+	var r release
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s: %v", releaseFeed, err)
+	}
+	return &r, nil
+}
+
+// newerVersion reports whether version a is newer than b. The
+// vMAJOR.MINOR.PATCH parts compare as numbers, and a pre-release
+// (v1.0.0-beta) comes before its release.
+func newerVersion(a, b string) bool {
+	parse := func(v string) ([3]int, string) {
+		core, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+		var n [3]int
+		for i, part := range strings.SplitN(core, ".", 3) {
+			n[i], _ = strconv.Atoi(part)
+		}
+		return n, pre
+	}
+	an, apre := parse(a)
+	bn, bpre := parse(b)
+	for i := range an {
+		if an[i] != bn[i] {
+			return an[i] > bn[i]
+		}
+	}
+	if apre == "" || bpre == "" {
+		return apre == "" && bpre != ""
+	}
+	return apre > bpre
+}
+
+func selfUpdateCommand(args []string) {
+	checkOnly := flag.Bool("check-only", false, "Only report whether a newer version exists")
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	if flag.NArg() != 0 {
+		fmt.Println("Usage: go run debugAPK.go self-update [-check-only]")
+		os.Exit(1)
+	}
+	if !*checkOnly && releaseKey == "" && releasePublicKey == "" {
+		log.Fatal("There are no signed binary releases of debugapk to update to: it runs from source, update it with git pull instead (or pass the -release-key of the builds you trust)")
+	}
+
+	d, err := newDownloader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := latestRelease(d)
+	if err != nil {
+		log.Fatal("Failed to check for updates: ", err)
+	}
+	if !newerVersion(r.Tag, version) {
+		fmt.Println("debugapk", version, "is up to date")
+		if *checkOnly {
+			os.Exit(1)
+		}
+		return
+	}
+	if *checkOnly {
+		fmt.Println(r.Tag)
+		return
+	}
+
+	if err := selfUpdate(d, r); err != nil {
+		log.Fatal("Failed to update: ", err)
+	}
+	fmt.Printf("Updated debugapk from %s to %s\n", version, r.Tag)
+}
+
+// selfUpdate downloads the release's binary for this platform next to the
+// running executable, checks it, and swaps it in. Windows can't replace a
+// running executable, but it can rename it: the old one is moved aside to
+// .old and removed by the next update.
+func selfUpdate(d *downloader, r *release) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if strings.Contains(exe, "go-build") {
+		return errors.New("this is a go run build, update the source instead")
+	}
+	os.Remove(exe + ".old")
+
+	name := fmt.Sprintf("debugapk_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	url := r.asset(name)
+	if url == "" {
+		return fmt.Errorf("%s has no %s", r.Tag, name)
+	}
+	sum, err := releaseChecksum(d, r, name)
+	if err != nil {
+		return err
+	}
+
+	next := exe + ".new"
+	if err := d.fetch(artifact{path: "debugapk/" + r.Tag + "/" + name, upstream: url, sha256: sum}, next); err != nil {
+		return err
+	}
+	defer os.Remove(next)
+	if err := os.Chmod(next, 0755); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		return os.Rename(next, exe)
+	}
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(exe+".old", exe)
+		return err
+	}
+	return nil
+}
+
+// releaseChecksum reads the SHA-256 of the asset name from the release's
+// checksums.txt, once its signature checks out: checksums.txt comes from the
+// same place as the binaries, only the signature tells it's genuine.
+func releaseChecksum(d *downloader, r *release, name string) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "apkdebug")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fetch := func(asset string) ([]byte, error) {
+		url := r.asset(asset)
+		if url == "" {
+			return nil, fmt.Errorf("%s has no %s", r.Tag, asset)
+		}
+		dest := filepath.Join(tmpDir, asset)
+		if err := d.fetch(artifact{path: "debugapk/" + r.Tag + "/" + asset, upstream: url}, dest); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(dest)
+	}
+
+	sums, err := fetch("checksums.txt")
+	if err != nil {
+		return "", err
+	}
+	sig, err := fetch("checksums.txt.sig")
+	if err != nil {
+		return "", fmt.Errorf("%v: it's unsigned, not updating", err)
+	}
+	if err := verifyReleaseSignature(sums, sig); err != nil {
+		return "", err
+	}
+	fmt.Println("checksums.txt is signed by the release key")
+
+	for _, line := range strings.Split(string(sums), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("checksums.txt of %s has no %s", r.Tag, name)
+}
+
+// verifyReleaseSignature checks an Ed25519 signature, raw or base64, of
+// data against the -release-key, or else the releasePublicKey.
+func verifyReleaseSignature(data, sig []byte) error {
+	keyName, keyPEM := "the release key", []byte(releasePublicKey)
+	if releaseKey != "" {
+		var err error
+		if keyPEM, err = ioutil.ReadFile(releaseKey); err != nil {
+			return err
+		}
+		keyName = "-release-key " + releaseKey
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("%s is not PEM", keyName)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyName, err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s is not an Ed25519 key", keyName)
+	}
+
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+			return fmt.Errorf("checksums.txt.sig: %v", err)
+		}
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return fmt.Errorf("checksums.txt.sig doesn't match %s", keyName)
+	}
+	return nil
+}
+
+// updateCheck is the cache file of -update-notice.
+type updateCheck struct {
+	Checked time.Time `json:"checked"`
+	Latest  string    `json:"latest"`
+}
+
+// printUpdateNotice says when a newer release exists. The release feed is
+// asked at most once a day, and any failure is silent.
+func printUpdateNotice() {
+	path := filepath.Join(filepath.Dir(apktoolCacheDir()), "update-check.json")
+	var check updateCheck
+	if data, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(data, &check)
+	}
+
+	if time.Since(check.Checked) > 24*time.Hour {
+		d, err := newDownloader()
+		if err != nil {
+			return
+		}
+		d.client.Timeout = 5 * time.Second
+		r, err := latestRelease(d)
+		if err != nil {
+			return
+		}
+		check = updateCheck{Checked: time.Now(), Latest: r.Tag}
+		if data, err := json.Marshal(check); err == nil && os.MkdirAll(filepath.Dir(path), 0755) == nil {
+			ioutil.WriteFile(path, data, 0644)
+		}
+	}
+	if check.Latest != "" && newerVersion(check.Latest, version) {
+		fmt.Printf("A newer version is available: %s (you have %s), run: debugapk self-update\n", check.Latest, version)
+	}
+}
+
+// signCommand re-signs an existing APK or app bundle with the debug key (or
+// the -signing-props keystore), replacing its previous signature.
+func signCommand(args []string) {
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		exitWith(exitUsage, "Failed to load config: ", err)
+	}
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: go run debugAPK.go sign [OPTIONS] <APK_OR_AAB_FILE> [SPLIT_APK...]")
+		os.Exit(exitUsage)
+	}
+	if noSign {
+		exitWith(exitUsage, "-no-sign can't be used with sign")
+	}
+
+	// sign only re-signs, unless -module asks for a module to patch.
+	module := ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "module" {
+			module = bundleModule
+		}
+	})
+	if err := signFiles(flag.Arg(0), flag.Args()[1:], module); err != nil {
+		exitWith(exitCodeOf(err), err)
+	}
+}
+
+// bundleFlags are the options that apply to an app bundle given to the
+// regular pipeline, which only patches the -module manifest and signs it.
+var bundleFlags = map[string]bool{
+	"module": true, "sha256": true, "signing-manifest": true, "o": true, "backup-original": true,
+	"signing-props": true, "keystore": true, "ks-type": true, "pkcs11-config": true, "ks-alias": true,
+	"storepass": true, "keypass": true, "audit-log": true, "allow-expired-cert": true,
+	"verify-with": true, "strip-meta-inf": true, "json": true, "verbose": true,
+}
+
+// debugBundle is the regular pipeline for an app bundle. apktool can't
+// decode bundles, so the manifest of -module (base by default) is made
+// debuggable as it is, and the bundle re-signed like sign does.
+func debugBundle() {
+	var other []string
+	flag.Visit(func(f *flag.Flag) {
+		if !bundleFlags[f.Name] {
+			other = append(other, "-"+f.Name)
+		}
+	})
+	if len(other) > 0 {
+		exitWith(exitUsage, fmt.Sprintf("%s can't be used with an app bundle: only its -module manifest is patched, the other options need an APK", strings.Join(other, ", ")))
+	}
+	if flag.NArg() != 1 {
+		exitWith(exitUsage, "An app bundle is patched without apktool, APKTOOL_JAR can't be given")
+	}
+	if err := signFiles(flag.Arg(0), nil, bundleModule); err != nil {
+		exitWith(exitCodeOf(err), err)
+	}
+}
+
+// signFiles signs in, and the split APKs of it, replacing their previous
+// signature. With a module, in must be an app bundle, and that module's
+// manifest is made debuggable first (or not, for undebug). Its errors carry
+// the exit code, like those of run.
+func signFiles(in string, splits []string, module string) error {
+	stdout := os.Stdout
+	if jsonOutput {
+		os.Stdout = os.Stderr
+	}
+
+	var artifact string
+	switch strings.ToLower(filepath.Ext(in)) {
+	case ".apk":
+		artifact = "apk"
+	case ".aab":
+		artifact = "aab"
+	default:
+		return &exitError{exitUsage, fmt.Errorf("Cannot sign %s: expected an .apk or .aab file", in)}
+	}
+	if !fileExists(in) {
+		return &exitError{exitInput, fmt.Errorf("File not found: %s", in)}
+	}
+	var manifestEntry string
+	if module != "" {
+		if artifact != "aab" {
+			return &exitError{exitUsage, fmt.Errorf("-module picks a module of an app bundle, %s is not one", in)}
+		}
+		var err error
+		if manifestEntry, err = bundleManifest(in, module); err != nil {
+			return err
+		}
+	}
+	// The splits of an app all have to be signed with the same key.
+	for _, split := range splits {
+		if artifact != "apk" || strings.ToLower(filepath.Ext(split)) != ".apk" {
+			return &exitError{exitUsage, fmt.Errorf("Cannot sign %s with %s: only an APK has split APKs", split, in)}
+		}
+		if !fileExists(split) {
+			return &exitError{exitInput, fmt.Errorf("File not found: %s", split)}
+		}
+	}
+	if len(splits) > 0 && outputFile != "" {
+		return &exitError{exitUsage, errors.New("-o names a single output, it can't be used to sign split APKs")}
+	}
+	if err := checkUnsigned(in, signManifest); err != nil {
+		return &exitError{exitInput, fmt.Errorf("Not signing: %v", err)}
+	}
+	if installApp && artifact != "apk" {
+		return &exitError{exitUsage, errors.New("-install installs APKs, not app bundles")}
+	}
+	if _, ok := compressionLevels[compression]; compression != "" && !ok {
+		return &exitError{exitUsage, fmt.Errorf("Invalid -compression %q, expected store, fast or best", compression)}
+	}
+	if compression != "" && artifact == "aab" {
+		fmt.Println("Ignoring -compression for an app bundle.")
+		compression = ""
+	}
+	if signerFor(artifact) == "" {
+		return &exitError{exitMissingTool, fmt.Errorf("No signer for %s files is installed. Aborting.", artifact)}
+	}
+	verifier, err := verifierFor(artifact)
+	if err != nil {
+		return err
+	}
+
+	debugFlag := false
+	tmpDir, err := ioutil.TempDir("", "apkdebug")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	signing, err := userSigningConfig()
+	if err != nil {
+		return err
+	}
+	var warnings []string
+	if signing != nil {
+		if _, warnings, err = checkSigningChain(signing); err != nil {
+			return &exitError{exitSign, err}
+		}
+		for _, w := range warnings {
+			fmt.Println("WARNING:", w)
+		}
+	}
+	if signing == nil {
+		signing = debugSigningConfig(filepath.Join(tmpDir, "keystore"))
+		if err := generateKeyStore(signing, debugFlag); err != nil {
+			return &exitError{exitSign, fmt.Errorf("Failed to generate keystore: %v", err)}
+		}
+	}
+	if hasNextSigners() && artifact != "apk" {
+		return &exitError{exitUsage, errors.New("-next-signer and several -keystore can only be used with APKs, bundles are signed with jarsigner")}
+	}
+	next, nextWarnings, err := loadNextSigners()
+	if err != nil {
+		return err
+	}
+	for _, w := range nextWarnings {
+		fmt.Println("WARNING:", w)
+	}
+	signing.next = next
+	warnings = append(warnings, nextWarnings...)
+
+	result := &report{Input: in, ArtifactType: artifact, Warnings: warnings}
+	if artifact == "apk" {
+		warnSharedUser(in, result)
+	}
+	out := strings.TrimSuffix(in, filepath.Ext(in)) + ".signed" + filepath.Ext(in)
+	if module != "" {
+		out = strings.TrimSuffix(in, filepath.Ext(in)) + strings.TrimSuffix(outputSuffix(), ".apk") + ".aab"
+		result.Module = module
+	}
+	if outputFile != "" {
+		var warning string
+		if out, warning, err = outputPath(outputFile, "."+artifact); err != nil {
+			return &exitError{exitUsage, err}
+		}
+		if warning != "" {
+			fmt.Println("WARNING:", warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	sign := func(in, out string) (string, error) {
+		if err := backupOutput(out, result); err != nil {
+			return "", err
+		}
+
+		fmt.Println("=> Removing the old signature...")
+		if err := retryLocked(out, func() error { return copyFile(in, out, 0644) }); err != nil {
+			return "", err
+		}
+		rw := zipRewrite{compression: compression, bundle: artifact == "aab", skip: isSignatureFile, replace: unsignedManifest}
+		if stripMetaInf {
+			rw.skip = func(name string) bool { return strings.HasPrefix(name, "META-INF/") }
+			rw.replace = nil
+		}
+		if manifestEntry != "" {
+			fmt.Printf("=> %s (%s)\n", patchMessage(), manifestEntry)
+			rw.replace = debuggableBundleManifest(manifestEntry, rw.replace)
+		}
+		if err := rewriteZip(out, rw); err != nil {
+			return "", &exitError{exitBuild, fmt.Errorf("Failed to rewrite %s: %v", out, err)}
+		}
+
+		fmt.Printf("=> Signing %s...\n", strings.ToUpper(artifact))
+		signer, err := signArtifact(out, artifact, signing, debugFlag)
+		if err != nil {
+			return "", &exitError{exitSign, fmt.Errorf("Failed to sign: %v", tokenError(err))}
+		}
+
+		fmt.Println("=> Checking the signature...")
+		status, err := checkArtifact(out, verifier, artifact)
+		status.print()
+		if err != nil {
+			return "", &exitError{exitVerify, fmt.Errorf("Failed to verify: %v", err)}
+		}
+		if err := checkSigningCert(status, verifier, signing); err != nil {
+			return "", &exitError{exitVerify, fmt.Errorf("Failed to verify: %v", err)}
+		}
+		result.SignerSHA256 = status.SHA256
+		result.Verification = &status
+		if err := auditSigning(in, out, signer, signing); err != nil {
+			return "", &exitError{exitSign, fmt.Errorf("Failed to write the audit log: %v", err)}
+		}
+		fmt.Printf("Signed %s with %s: %s\n", artifact, signer, out)
+		return signer, nil
+	}
+
+	if result.Signer, err = sign(in, out); err != nil {
+		return err
+	}
+	result.Output = out
+	result.Verifier = verifier
+	for _, split := range splits {
+		splitOut := strings.TrimSuffix(split, filepath.Ext(split)) + ".signed.apk"
+		if _, err := sign(split, splitOut); err != nil {
+			return err
+		}
+		result.Splits = append(result.Splits, splitOut)
+	}
+
+	if installApp {
+		serial, reason, err := selectDevice()
+		if err != nil {
+			return &exitError{exitDevice, fmt.Errorf("Failed to list devices: %v", err)}
+		}
+		if reason != "" {
+			return &exitError{exitDevice, fmt.Errorf("Cannot install: %s", reason)}
+		}
+		if len(splits) == 0 {
+			err = installOnDevice(serial, out)
+		} else {
+			err = installMultipleOnDevice(serial, append([]string{out}, result.Splits...))
+		}
+		if err != nil {
+			return &exitError{exitDevice, fmt.Errorf("Install failed: %v", err)}
+		}
+		result.Installed = true
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleManifest returns the entry of module's manifest in the app bundle
+// aab, or an error listing the modules it has.
+func bundleManifest(aab, module string) (string, error) {
+	r, err := zip.OpenReader(aab)
+	if err != nil {
+		return "", &exitError{exitInput, fmt.Errorf("Failed to read app bundle: %v", err)}
+	}
+	defer r.Close()
+
+	entry := module + "/manifest/AndroidManifest.xml"
+	var modules []string
+	for _, f := range r.File {
+		if f.Name == entry {
+			return entry, nil
+		}
+		if dir, ok := strings.CutSuffix(f.Name, "/manifest/AndroidManifest.xml"); ok && !strings.Contains(dir, "/") {
+			modules = append(modules, dir)
+		}
+	}
+	if len(modules) == 0 {
+		return "", &exitError{exitInput, fmt.Errorf("%s has no module manifests, is it an app bundle?", aab)}
+	}
+	sort.Strings(modules)
+	return "", &exitError{exitUsage, fmt.Errorf("%s has no module %q, its modules are: %s", aab, module, strings.Join(modules, ", "))}
+}
+
+// debuggableBundleManifest wraps a zipRewrite replace function to also
+// set android:debuggable in the module manifest entry, which bundles keep
+// as aapt2's protobuf XML rather than binary XML.
+func debuggableBundleManifest(entry string, replace func(*zip.File) ([]byte, error)) func(*zip.File) ([]byte, error) {
+	return func(f *zip.File) ([]byte, error) {
+		if f.Name != entry {
+			if replace == nil {
+				return nil, nil
+			}
+			return replace(f)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err = setProtoDebuggable(data, !undebugMode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry, err)
+		}
+		return data, nil
+	}
+}
+
+// protoField is a field of a protobuf message: its number, wire type and,
+// for varints, value, or for length-delimited fields, bytes. raw is the
+// field as it was encoded.
+type protoField struct {
+	num   uint64
+	wire  int
+	value uint64
+	bytes []byte
+	raw   []byte
+}
+
+// protoFields splits a protobuf message into its fields.
+func protoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for off := 0; off < len(data); {
+		start := off
+		tag, n := binary.Uvarint(data[off:])
+		if n <= 0 {
+			return nil, errors.New("truncated protobuf tag")
+		}
+		off += n
+		f := protoField{num: tag >> 3, wire: int(tag & 7)}
+		switch f.wire {
+		case 0:
+			if f.value, n = binary.Uvarint(data[off:]); n <= 0 {
+				return nil, errors.New("truncated protobuf varint")
+			}
+			off += n
+		case 1:
+			off += 8
+		case 2:
+			size, n := binary.Uvarint(data[off:])
+			if n <= 0 || size > uint64(len(data)-off-n) {
+				return nil, errors.New("truncated protobuf field")
+			}
+			off += n
+			f.bytes = data[off : off+int(size)]
+			off += int(size)
+		case 5:
+			off += 4
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", f.wire)
+		}
+		if off > len(data) {
+			return nil, errors.New("truncated protobuf field")
+		}
+		f.raw = data[start:off]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// appendProtoBytes appends field num holding b, length-delimited.
+func appendProtoBytes(dst []byte, num uint64, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, num<<3|2)
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// appendProtoVarint appends field num holding v as a varint.
+func appendProtoVarint(dst []byte, num, v uint64) []byte {
+	dst = binary.AppendUvarint(dst, num<<3)
+	return binary.AppendUvarint(dst, v)
+}
+
+// Field numbers of aapt2's Resources.proto XML messages.
+const (
+	protoNodeElement    = 1 // XmlNode.element
+	protoElementName    = 3 // XmlElement.name
+	protoElementAttr    = 4 // XmlElement.attribute
+	protoElementChild   = 5 // XmlElement.child
+	protoAttrNamespace  = 1 // XmlAttribute.namespace_uri
+	protoAttrName       = 2 // XmlAttribute.name
+	protoAttrValue      = 3 // XmlAttribute.value
+	protoAttrResourceID = 5 // XmlAttribute.resource_id
+	protoAttrItem       = 6 // XmlAttribute.compiled_item
+	protoItemPrim       = 7 // Item.prim
+	protoPrimBoolean    = 8 // Primitive.boolean_value
+)
+
+// setProtoDebuggable sets android:debuggable to value on the <application>
+// of a protobuf manifest (an XmlNode), adding the element if there's none.
+func setProtoDebuggable(manifest []byte, value bool) ([]byte, error) {
+	node, err := protoFields(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	found := false
+	for _, f := range node {
+		if f.num != protoNodeElement || f.wire != 2 {
+			out = append(out, f.raw...)
+			continue
+		}
+		if name, _ := protoElementInfo(f.bytes); name != "manifest" {
+			return nil, fmt.Errorf("the root element is <%s>, not <manifest>", name)
+		}
+		element, err := setProtoApplicationDebuggable(f.bytes, value)
+		if err != nil {
+			return nil, err
+		}
+		out = appendProtoBytes(out, protoNodeElement, element)
+		found = true
+	}
+	if !found {
+		return nil, errors.New("not a protobuf XML manifest")
+	}
+	return out, nil
+}
+
+// protoElementInfo returns the name and the fields of an XmlElement.
+func protoElementInfo(element []byte) (string, []protoField) {
+	fields, err := protoFields(element)
+	if err != nil {
+		return "", nil
+	}
+	for _, f := range fields {
+		if f.num == protoElementName && f.wire == 2 {
+			return string(f.bytes), fields
+		}
+	}
+	return "", fields
+}
+
+// setProtoApplicationDebuggable sets android:debuggable on the
+// <application> child of the <manifest> element.
+func setProtoApplicationDebuggable(manifest []byte, value bool) ([]byte, error) {
+	fields, err := protoFields(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	found := false
+	for _, f := range fields {
+		if f.num != protoElementChild || f.wire != 2 || found {
+			out = append(out, f.raw...)
+			continue
+		}
+		child, err := protoFields(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		var node []byte
+		for _, c := range child {
+			if name, _ := protoElementInfo(c.bytes); c.num != protoNodeElement || name != "application" {
+				node = append(node, c.raw...)
+				continue
+			}
+			node = appendProtoBytes(node, protoNodeElement, setProtoAttr(c.bytes, "debuggable", 0x0101000f, value))
+			found = true
+		}
+		out = appendProtoBytes(out, protoElementChild, node)
+	}
+	if !found {
+		application := appendProtoBytes(nil, protoElementName, []byte("application"))
+		application = setProtoAttr(application, "debuggable", 0x0101000f, value)
+		out = appendProtoBytes(out, protoElementChild, appendProtoBytes(nil, protoNodeElement, application))
+	}
+	return out, nil
+}
+
+// setProtoAttr sets the android:name boolean attribute of an XmlElement,
+// replacing any it had, after its other attributes.
+func setProtoAttr(element []byte, name string, resID uint32, value bool) []byte {
+	fields, _ := protoFields(element)
+	text, v := "false", uint64(0)
+	if value {
+		text, v = "true", 1
+	}
+	attr := appendProtoBytes(nil, protoAttrNamespace, []byte(androidNS))
+	attr = appendProtoBytes(attr, protoAttrName, []byte(name))
+	attr = appendProtoBytes(attr, protoAttrValue, []byte(text))
+	attr = appendProtoVarint(attr, protoAttrResourceID, uint64(resID))
+	attr = appendProtoBytes(attr, protoAttrItem, appendProtoBytes(nil, protoItemPrim, appendProtoVarint(nil, protoPrimBoolean, v)))
+
+	var out []byte
+	added := false
+	for _, f := range fields {
+		if f.num == protoElementAttr && f.wire == 2 && protoAttrIs(f.bytes, androidNS, name) {
+			continue
+		}
+		if f.num == protoElementChild && !added {
+			out = appendProtoBytes(out, protoElementAttr, attr)
+			added = true
+		}
+		out = append(out, f.raw...)
+	}
+	if !added {
+		out = appendProtoBytes(out, protoElementAttr, attr)
+	}
+	return out
+}
+
+// protoAttrIs reports whether an XmlAttribute is ns:name.
+func protoAttrIs(attr []byte, ns, name string) bool {
+	fields, err := protoFields(attr)
+	if err != nil {
+		return false
+	}
+	var gotNS, gotName string
+	for _, f := range fields {
+		switch {
+		case f.num == protoAttrNamespace && f.wire == 2:
+			gotNS = string(f.bytes)
+		case f.num == protoAttrName && f.wire == 2:
+			gotName = string(f.bytes)
+		}
+	}
+	return gotNS == ns && gotName == name
+}
+
+var signatureFilePattern = regexp.MustCompile(`(?i)^META-INF/([^/]+\.(SF|RSA|DSA|EC)|SIG-[^/]+)$`)
+
+// isSignatureFile reports whether a zip entry belongs to the JAR signature:
+// the signature files and signature block files of each signer. Other
+// META-INF content, such as services/, isn't part of it.
+func isSignatureFile(name string) bool {
+	return signatureFilePattern.MatchString(name)
+}
+
+// unsignedManifest returns META-INF/MANIFEST.MF without the entry digests
+// a signer added, keeping its main attributes. It returns nil for any other
+// entry.
+func unsignedManifest(f *zip.File) ([]byte, error) {
+	if !strings.EqualFold(f.Name, "META-INF/MANIFEST.MF") {
+		return nil, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The main section ends at the first empty line.
+	for _, end := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(data, []byte(end)); i >= 0 {
+			return data[:i+len(end)], nil
+		}
+	}
+	return data, nil
+}
+
+func serveCommand(args []string) {
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: go run debugAPK.go serve [-serve-port PORT] [-serve-downloads N] [-serve-timeout SECONDS] <FILE>")
+		os.Exit(1)
+	}
+	if err := serveFile(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveFile serves path, and nothing else, over HTTP on every interface,
+// under a random token so that other devices on the network can't guess
+// the URL. It returns after -serve-downloads downloads or -serve-timeout.
+func serveFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", path)
+	}
+	token := make([]byte, 12)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	urlPath := "/" + base64.RawURLEncoding.EncodeToString(token) + "/" + url.PathEscape(name)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", servePort))
+	if err != nil {
+		return err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	done := make(chan struct{})
+	downloads := 0
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != urlPath || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			fmt.Printf("Refused %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "file is gone", http.StatusGone)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+		// FormatMediaType switches to filename*= for names that aren't ASCII.
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+
+		client, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+			fmt.Printf("%s %s (range %q) by %s\n", r.Method, name, r.Header.Get("Range"), client)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		downloads++
+		fmt.Printf("Downloaded by %s (%d/%d)\n", client, downloads, serveDownloads)
+		if downloads == serveDownloads {
+			close(done)
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+
+	urls := localURLs(port, urlPath)
+	if len(urls) == 0 {
+		srv.Close()
+		return errors.New("no network interface other than loopback is up")
+	}
+	fmt.Printf("Serving %s to the local network, open on the device:\n", name)
+	for _, u := range urls {
+		fmt.Println("  " + u)
+	}
+	if qr, err := qrCode(urls[0]); err != nil {
+		fmt.Println("No QR code:", err)
+	} else {
+		printQRCode(qr)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Duration(serveTimeout) * time.Second):
+		fmt.Printf("Stopped serving after %ds\n", serveTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// localURLs returns the URL of urlPath at port for each address of the
+// interfaces that are up, except loopback and link-local ones.
+func localURLs(port int, urlPath string) []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	// IPv4 first, it's what the QR code shows.
+	var v4, v6 []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			u := "http://" + net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(port)) + urlPath
+			if ipnet.IP.To4() != nil {
+				v4 = append(v4, u)
+			} else {
+				v6 = append(v6, u)
+			}
+		}
+	}
+	return append(v4, v6...)
+}
+
+// QR code versions 1 to 10 at error correction level L are plenty for a
+// URL: the total codewords, error correction codewords per block and blocks
+// of each, and the alignment pattern positions.
+var (
+	qrCodewords  = []int{26, 44, 70, 100, 134, 172, 196, 242, 292, 346}
+	qrBlockECC   = []int{7, 10, 15, 20, 26, 18, 20, 24, 30, 18}
+	qrBlocks     = []int{1, 1, 1, 1, 1, 2, 2, 2, 2, 4}
+	qrAlignments = [][]int{nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}
+)
+
+// qrCode encodes text in byte mode as the smallest QR code that holds it,
+// true being a dark module, indexed [y][x].
+func qrCode(text string) ([][]bool, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v <= len(qrCodewords); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		capacity := qrCodewords[v-1] - qrBlockECC[v-1]*qrBlocks[v-1]
+		if 4+countBits+8*len(data) <= 8*capacity {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes is too long for a QR code up to version %d", len(data), len(qrCodewords))
+	}
+
+	// The data codewords: byte mode, the count, the bytes, a terminator
+	// and padding.
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>uint(i)&1 == 1)
+		}
+	}
+	capacity := qrCodewords[version-1] - qrBlockECC[version-1]*qrBlocks[version-1]
+	appendBits(0x4, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, c := range data {
+		appendBits(int(c), 8)
+	}
+	for i := 0; i < 4 && len(bits) < 8*capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < 8*capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+	codewords := make([]byte, capacity)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	// Split into blocks, the later ones a codeword longer when it doesn't
+	// divide evenly, and interleave them with their error correction.
+	blocks, ecc := qrBlocks[version-1], qrBlockECC[version-1]
+	short := blocks - capacity%blocks
+	divisor := rsDivisor(ecc)
+	var dataBlocks, eccBlocks [][]byte
+	for i, k := 0, 0; i < blocks; i++ {
+		n := capacity / blocks
+		if i >= short {
+			n++
+		}
+		dataBlocks = append(dataBlocks, codewords[k:k+n])
+		eccBlocks = append(eccBlocks, rsRemainder(codewords[k:k+n], divisor))
+		k += n
+	}
+	var final []byte
+	for i := 0; i <= capacity/blocks; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				final = append(final, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecc; i++ {
+		for _, block := range eccBlocks {
+			final = append(final, block[i])
+		}
+	}
+
+	q := newQRMatrix(version)
+	q.placeData(final)
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // undoes it
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q.modules, nil
+}
+
+type qrMatrix struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // finder, timing, alignment, format and version modules
+}
+
+func newQRMatrix(version int) *qrMatrix {
+	size := 17 + 4*version
+	q := &qrMatrix{size: size}
+	for i := 0; i < size; i++ {
+		q.modules = append(q.modules, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := qrMax(qrAbs(dx), qrAbs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	positions := qrAlignments[version-1]
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // the finders are there
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format modules; drawFormat fills them in.
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := bits>>uint(i)&1 == 1
+			a, b := size-11+i%3, i/3
+			q.set(a, b, bit)
+			q.set(b, a, bit)
+		}
+	}
+	return q
+}
+
+func (q *qrMatrix) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFormat writes both copies of the format information: level L and the
+// mask, BCH-protected.
+func (q *qrMatrix) drawFormat(mask int) {
+	data := 1<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // the dark module
+}
+
+// placeData fills the non-function modules in the zigzag order, two columns
+// at a time from the bottom right.
+func (q *qrMatrix) placeData(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upwards
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>uint(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by mask; applying it twice
+// undoes it.
+func (q *qrMatrix) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to scan, by the four rules of the
+// standard: runs, 2x2 blocks, finder-like patterns and dark/light balance.
+func (q *qrMatrix) penalty() int {
+	p := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= q.size; x++ {
+				match := true
+				for i, dark := range finder {
+					if at(x+i, y, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				light := func(from, to int) bool {
+					for i := from; i < to; i++ {
+						if i >= 0 && i < q.size && at(i, y, transpose) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	percent := dark * 100 / (q.size * q.size)
+	return p + qrAbs(percent-50)/5*10
+}
+
+// printQRCode prints the code two rows per line with half blocks, in white
+// on black whatever the terminal's colors, inside the 4 modules wide quiet
+// zone the QR spec requires; with less, some scanners can't find the code.
+func printQRCode(modules [][]bool) {
+	const quiet = 4
+	size := len(modules)
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < size && y >= 0 && y < size && modules[y][x]
+	}
+	for y := 0; y < size+2*quiet; y += 2 {
+		var line strings.Builder
+		line.WriteString("\x1b[97;40m")
+		for x := 0; x < size+2*quiet; x++ {
+			top, bottom := !dark(x, y), !dark(x, y+1) && y+1 < size+2*quiet
+			switch {
+			case top && bottom:
+				line.WriteString("█")
+			case top:
+				line.WriteString("▀")
+			case bottom:
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		line.WriteString("\x1b[0m")
+		fmt.Println(line.String())
+	}
+}
+
+// rsDivisor is the Reed-Solomon generator polynomial of degree n over
+// GF(256), without its leading term.
+func rsDivisor(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrAbs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func cleanCommand(args []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	backups := flags.Bool("backups", false, "Delete -backup-original copies")
+	partials := flags.Bool("partials", false, "Delete interrupted downloads from the cache")
+	flags.Parse(args)
+	if !*backups && !*partials {
+		fmt.Println("Usage: go run debugAPK.go clean [-backups [DIR...]] [-partials]")
+		os.Exit(1)
+	}
+	if *partials {
+		cleanPartials()
+	}
+	if !*backups {
+		return
+	}
+
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	removed := 0
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !backupPattern.MatchString(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Removed", path)
+			removed++
+		}
+	}
+	fmt.Printf("Removed %d backup(s).\n", removed)
+}
+
+// cleanPartials deletes the .partial downloads left in the cache, except
+// those another run is downloading right now.
+func cleanPartials() {
+	root := filepath.Dir(apktoolCacheDir())
+	removed := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".partial") {
+			return err
+		}
+		lock := strings.TrimSuffix(path, ".partial") + ".lock"
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) < cacheLockStale {
+			fmt.Println("Skipping", path+", it's being downloaded")
+			return nil
+		}
+		for _, file := range []string{path, path + ".json"} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		fmt.Println("Removed", path)
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Removed %d partial download(s).\n", removed)
+}
+
+func pinsCommand(args []string) {
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: go run debugAPK.go pins [-json] <APK_FILE|DECODED_DIR>")
+		os.Exit(1)
+	}
+
+	stdout := os.Stdout
+	if jsonOutput {
+		os.Stdout = os.Stderr
+	}
+
+	// A directory is taken to be decoded already, by apktool or -keep-decompiled.
+	appDir := flag.Arg(0)
+	if info, err := os.Stat(appDir); err != nil {
+		log.Fatal("File not found: ", appDir)
+	} else if !info.IsDir() {
+		apktool, _, err := selectApktool("")
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpDir, err := ioutil.TempDir("", "apkdebug")
+		if err != nil {
+			log.Fatal("Failed to create temporary directory:", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		fmt.Println("=> Decoding resources...")
+		appDir = filepath.Join(tmpDir, "app")
+		if err := apktool.run(false, "-q", "d", "-s", flag.Arg(0), "-o", appDir); err != nil {
+			log.Fatal("Failed to unpack APK: ", err)
+		}
+	}
+
+	pins, err := networkSecurityPins(appDir, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	printPins(pins)
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(pins); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func printPins(pins *pinReport) {
+	if pins.Config == "" {
+		fmt.Println("The app has no network security config.")
+		return
+	}
+
+	fmt.Println("Network security config:", pins.Config)
+	if pins.DebugOverrides {
+		fmt.Println("WARNING: the config has debug-overrides, which apply to debuggable builds such as the debug APK")
+	}
+	if len(pins.Domains) == 0 {
+		fmt.Println("No pinned domains.")
+	}
+	for _, d := range pins.Domains {
+		domain := d.Domain
+		if d.IncludeSubdomains {
+			domain += " (and subdomains)"
+		}
+		fmt.Println(domain)
+		switch {
+		case d.Expired:
+			fmt.Printf("  expired on %s, the pins are no longer enforced\n", d.Expiration)
+		case d.Expiration != "":
+			fmt.Printf("  expires on %s\n", d.Expiration)
+		}
+		if d.Inherited {
+			fmt.Println("  pin-set inherited from an enclosing domain-config")
+		}
+		for _, p := range d.Pins {
+			fmt.Printf("  %s/%s\n", strings.ToLower(p.Digest), p.Value)
+		}
+	}
+}
+
+// pinReport lists the certificate pins of a network security config.
+type pinReport struct {
+	Config         string         `json:"config,omitempty"`
+	DebugOverrides bool           `json:"debugOverrides"`
+	Domains        []pinnedDomain `json:"domains"`
+}
+
+// pinnedDomain is a domain with the pin-set that applies to it.
+type pinnedDomain struct {
+	Domain            string   `json:"domain"`
+	IncludeSubdomains bool     `json:"includeSubdomains"`
+	Pins              []nscPin `json:"pins"`
+	Expiration        string   `json:"expiration,omitempty"`
+	Expired           bool     `json:"expired"`
+	Inherited         bool     `json:"inherited,omitempty"`
+}
+
+// networkSecurityConfig is res/xml/<name>.xml as decoded by apktool. The
+// base-config can't hold a pin-set, so it doesn't matter here.
+type networkSecurityConfig struct {
+	DomainConfigs  []nscDomainConfig `xml:"domain-config"`
+	DebugOverrides *struct{}         `xml:"debug-overrides"`
+}
+
+type nscDomainConfig struct {
+	Domains []struct {
+		Name              string `xml:",chardata"`
+		IncludeSubdomains bool   `xml:"includeSubdomains,attr"`
+	} `xml:"domain"`
+	PinSet   *nscPinSet        `xml:"pin-set"`
+	Children []nscDomainConfig `xml:"domain-config"`
+}
+
+type nscPinSet struct {
+	Expiration string   `xml:"expiration,attr"`
+	Pins       []nscPin `xml:"pin"`
+}
+
+type nscPin struct {
+	Digest string `xml:"digest,attr" json:"digest"`
+	Value  string `xml:",chardata" json:"value"`
+}
+
+// networkSecurityPins finds the network security config the manifest of a
+// decoded app references and resolves the pin-set of each domain. A nested
+// domain-config without a pin-set of its own inherits its parent's.
+func networkSecurityPins(appDir string, now time.Time) (*pinReport, error) {
+	m, err := loadManifest(filepath.Join(appDir, "AndroidManifest.xml"))
+	if err != nil {
+		return nil, err
+	}
+	apps, err := m.find("manifest/application")
+	if err != nil {
+		return nil, err
+	}
+	report := &pinReport{Domains: []pinnedDomain{}}
+	if len(apps) == 0 {
+		return report, nil
+	}
+	ref, ok := apps[0].attr("networkSecurityConfig")
+	if !ok || !strings.HasPrefix(ref, "@xml/") {
+		return report, nil
+	}
+
+	report.Config = "res/xml/" + strings.TrimPrefix(ref, "@xml/") + ".xml"
+	data, err := ioutil.ReadFile(filepath.Join(appDir, filepath.FromSlash(report.Config)))
+	if err != nil {
+		return nil, err
+	}
+	var config networkSecurityConfig
+	if err := xml.Unmarshal(stripBOM(data), &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", report.Config, err)
+	}
+	report.DebugOverrides = config.DebugOverrides != nil
+
+	var walk func(configs []nscDomainConfig, inherited *nscPinSet)
+	walk = func(configs []nscDomainConfig, inherited *nscPinSet) {
+		for _, c := range configs {
+			pinSet := c.PinSet
+			if pinSet == nil {
+				pinSet = inherited
+			}
+			if pinSet != nil && len(pinSet.Pins) > 0 {
+				for _, d := range c.Domains {
+					report.Domains = append(report.Domains, pinnedDomain{
+						Domain:            strings.TrimSpace(d.Name),
+						IncludeSubdomains: d.IncludeSubdomains,
+						Pins:              trimPins(pinSet.Pins),
+						Expiration:        pinSet.Expiration,
+						Expired:           pinSetExpired(pinSet.Expiration, now),
+						Inherited:         c.PinSet == nil,
+					})
+				}
+			}
+			walk(c.Children, pinSet)
+		}
+	}
+	walk(config.DomainConfigs, nil)
+	return report, nil
+}
+
+func trimPins(pins []nscPin) []nscPin {
+	trimmed := make([]nscPin, len(pins))
+	for i, p := range pins {
+		trimmed[i] = nscPin{Digest: p.Digest, Value: strings.TrimSpace(p.Value)}
+	}
+	return trimmed
+}
+
+// pinSetExpired reports whether a pin-set expiration date (yyyy-MM-dd) has
+// passed. Android stops enforcing the pins after that day.
+func pinSetExpired(expiration string, now time.Time) bool {
+	day, err := time.Parse("2006-01-02", expiration)
+	return err == nil && now.After(day.AddDate(0, 0, 1))
+}
+
+// externalTools are the external tools debugAPK can use, what for, and the
+// arguments that make them print their version for -version. zipalign has
+// none.
+var externalTools = []struct {
+	name, use string
+	args      []string
+}{
+	{"java", "runs apktool jars", []string{"-version"}},
+	{"apktool", "decodes and rebuilds APKs", []string{"--version"}},
+	{"keytool", "generates the debug keystore", []string{"-J-version"}},
+	{"apksigner", "signs APKs with v1-v3 signatures", []string{"--version"}},
+	{"jarsigner", "signs app bundles, and APKs with a v1 signature only", []string{"-version"}},
+	{"zipalign", "checks the alignment for check", nil},
+	{"adb", "-install, -verify-install and -smoke-test", []string{"version"}},
+}
+
+func doctorCommand(args []string) {
+	if len(args) != 0 {
+		fmt.Println("Usage: go run debugAPK.go doctor")
+		os.Exit(1)
+	}
+
+	for _, tool := range externalTools {
+		if path, err := exec.LookPath(tool.name); err == nil {
+			fmt.Printf("%-10s %s\n", tool.name, path)
+		} else {
+			fmt.Printf("%-10s not found (%s)\n", tool.name, tool.use)
+		}
+	}
+	if version, err := getInstalledVersion("apktool"); err == nil {
+		fmt.Println("Installed apktool version:", version)
+	}
+
+	if bundledApktool == nil {
+		fmt.Println("Bundled apktool: not in this build (go build -tags bundled debugAPK.go debugAPK_bundled.go)")
+	} else {
+		fmt.Printf("Bundled apktool: %s (sha256 %s)\n", bundledApktool.version, bundledApktool.sha256)
+	}
+
+	versions, err := cachedApktoolVersions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(versions) > 0 {
+		fmt.Println("Cached apktool versions:", strings.Join(versions, ", "))
+	}
+}
+
+// versionInfo is what -version prints. Tools maps each external tool to
+// its version, "installed" when it has no way to tell, or "not found".
+type versionInfo struct {
+	Version  string            `json:"version"`
+	Go       string            `json:"go"`
+	Platform string            `json:"platform"`
+	Revision string            `json:"revision,omitempty"`
+	Bundled  string            `json:"bundledApktool,omitempty"`
+	Tools    map[string]string `json:"tools"`
+}
+
+func printVersion() {
+	info := versionInfo{
+		Version:  version,
+		Go:       runtime.Version(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		Revision: revision,
+		Tools:    map[string]string{},
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && revision == "" {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Revision = s.Value
+			}
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.modified" && s.Value == "true" && info.Revision != "" {
+				info.Revision += "-dirty"
+			}
+		}
+	}
+	if bundledApktool != nil {
+		info.Bundled = bundledApktool.version
+	}
+	for _, tool := range externalTools {
+		info.Tools[tool.name] = toolVersion(tool.name, tool.args)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Printf("debugAPK %s (%s, %s)\n", info.Version, info.Go, info.Platform)
+	if info.Revision != "" {
+		fmt.Println("Revision:", info.Revision)
+	} else {
+		fmt.Println("Revision: unknown (go run records none; build with -ldflags \"-X main.revision=COMMIT\")")
+	}
+	if info.Bundled != "" {
+		fmt.Println("Bundled apktool:", info.Bundled)
+	}
+	for _, tool := range externalTools {
+		fmt.Printf("%-10s %s\n", tool.name, info.Tools[tool.name])
+	}
+}
+
+// toolVersion runs name with args and returns the first line it prints,
+// which for all of externalTools is or has the version.
+func toolVersion(name string, args []string) string {
+	if _, err := exec.LookPath(name); err != nil {
+		return "not found"
+	}
+	if args == nil {
+		return "installed"
+	}
+	output, err := exec.Command(name, args...).CombinedOutput()
+	line := ""
+	for _, l := range strings.Split(string(output), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "Picked up") {
+			line = l
+			break
+		}
+	}
+	if err != nil || line == "" {
+		return "installed (version unknown)"
+	}
+	return line
+}
+
+func apktoolCommand(args []string) {
+	if len(args) != 1 || args[0] != "list" {
+		fmt.Println("Usage: go run debugAPK.go apktool list")
+		os.Exit(1)
+	}
+
+	versions, err := cachedApktoolVersions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if version, err := getInstalledVersion("apktool"); err == nil {
+		fmt.Printf("%-12s (installed)\n", version)
+	}
+	for _, version := range versions {
+		fmt.Printf("%-12s %s\n", version, filepath.Join(apktoolCacheDir(), "apktool_"+version+".jar"))
+	}
+	if len(versions) == 0 {
+		fmt.Println("No cached apktool jars in", apktoolCacheDir())
+	}
+}
+
+func configPath() string {
+	if path := os.Getenv("DEBUGAPK_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "debugapk", "config")
+}
+
+// loadConfig applies the options in $RSIW_ARGS, then "flag = value" lines
+// from the config file, to every flag that wasn't given on the command line.
+func loadConfig() error {
+	if err := loadEnvArgs(); err != nil {
+		return fmt.Errorf("$RSIW_ARGS: %v", err)
+	}
+
+	path := configPath()
+	if path == "" || !fileExists(path) {
+		return nil
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if flag.Lookup(key) == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", path, i+1, key)
+		}
+		if set[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// envArg records a flag given in $RSIW_ARGS instead of setting it, so that
+// it only applies once it's known not to be on the command line.
+type envArg struct {
+	name   string
+	isBool bool
+	values *[][2]string
+}
+
+func (a envArg) String() string { return "" }
+
+func (a envArg) Set(value string) error {
+	*a.values = append(*a.values, [2]string{a.name, value})
+	return nil
+}
+
+func (a envArg) IsBoolFlag() bool { return a.isBool }
+
+// loadEnvArgs applies the options of $RSIW_ARGS, split like a shell would,
+// that weren't given on the command line. A repeatable option given there
+// replaces all of its $RSIW_ARGS values.
+func loadEnvArgs() error {
+	args, err := splitShellWords(os.Getenv("RSIW_ARGS"))
+	if err != nil || len(args) == 0 {
+		return err
+	}
+
+	var values [][2]string
+	env := flag.NewFlagSet("RSIW_ARGS", flag.ContinueOnError)
+	env.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		env.Var(envArg{name: f.Name, isBool: ok && b.IsBoolFlag(), values: &values}, f.Name, "")
+	})
+	if err := env.Parse(args); err != nil {
+		return err
+	}
+	if env.NArg() > 0 {
+		return fmt.Errorf("only options can be set there, not %q", env.Arg(0))
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, v := range values {
+		if set[v[0]] {
+			continue
+		}
+		if err := flag.Set(v[0], v[1]); err != nil {
+			return fmt.Errorf("-%s: %v", v[0], err)
+		}
+	}
+	return nil
+}
+
+// splitShellWords splits s into words like a POSIX shell, without any
+// expansion: words are separated by blanks, quotes group them, and a
+// backslash escapes the next character outside of single quotes.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+const androidNS = "http://schemas.android.com/apk/res/android"
+
+// manifest is a decoded AndroidManifest.xml. It's edited as text, splicing
+// only the tags that change, so the rest of apktool's output is untouched.
+// Attributes in the android namespace are assumed to use the "android"
+// prefix, as apktool always writes them.
+type manifest struct {
+	path string
+	data []byte
+}
+
+// xmlElement is the position of an element's start tag in manifest.data.
+type xmlElement struct {
+	path       string // e.g. "manifest/application/activity"
+	start, end int    // the start tag, "<" to ">"
+	close      int    // the end of the element, after its end tag
+	attrs      []xml.Attr
+}
+
+// name is the element's tag name.
+func (el xmlElement) name() string {
+	return path.Base(el.path)
+}
+
+func loadManifest(path string) (*manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{path: path, data: stripBOM(data)}, nil
+}
+
+func (m *manifest) save() error {
+	return ioutil.WriteFile(m.path, stripBOM(m.data), 0644)
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// stripBOM drops the UTF-8 byte order marks data starts with. An editor
+// saving a decoded file can add one, which aapt2 chokes on, so XML is read,
+// and written back, without it.
+func stripBOM(data []byte) []byte {
+	for bytes.HasPrefix(data, utf8BOM) {
+		data = data[len(utf8BOM):]
+	}
+	return data
+}
+
+// elements returns every element, in document order. Offsets are only
+// valid until the next edit.
+func (m *manifest) elements() ([]xmlElement, error) {
+	var elements []xmlElement
+	var open []int
+	var stack []string
+	d := xml.NewDecoder(bytes.NewReader(m.data))
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.Token()
+		if err == io.EOF {
+			return elements, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.path, err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, tok.Name.Local)
+			elements = append(elements, xmlElement{path: strings.Join(stack, "/"), start: start, end: int(d.InputOffset()), attrs: tok.Attr})
+			open = append(open, len(elements)-1)
+		case xml.EndElement:
+			elements[open[len(open)-1]].close = int(d.InputOffset())
+			open = open[:len(open)-1]
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// find returns the elements at path, in document order.
+func (m *manifest) find(path string) ([]xmlElement, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []xmlElement
+	for _, el := range elements {
+		if el.path == path {
+			found = append(found, el)
+		}
+	}
+	return found, nil
+}
+
+// attr returns the value of el's android:<name> attribute.
+func (el xmlElement) attr(name string) (string, bool) {
+	for _, a := range el.attrs {
+		if a.Name.Space == androidNS && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// setAttr sets android:<name> on el, replacing any value it already has.
+func (m *manifest) setAttr(el xmlElement, name, value string) {
+	tag := removeAttr(string(m.data[el.start:el.end]), name)
+	i := strings.IndexFunc(tag, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' || r == '/' || r == '>' })
+	tag = tag[:i] + fmt.Sprintf(` android:%s="%s"`, name, escapeAttr(value)) + tag[i:]
+	m.splice(el.start, el.end, tag)
+}
+
+// setApplicationAttr sets android:<name> on the <application> element.
+func (m *manifest) setApplicationAttr(name, value string) error {
+	apps, err := m.find("manifest/application")
+	if err != nil {
+		return err
+	}
+	if len(apps) == 0 {
+		return fmt.Errorf("no <application> in %s", m.path)
+	}
+	m.setAttr(apps[0], name, value)
+	return nil
+}
+
+// mentions reports whether any attribute value in the manifest names
+// something in one of the packages.
+func (m *manifest) mentions(packages []string) (bool, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return false, err
+	}
+	for _, el := range elements {
+		for _, a := range el.attrs {
+			if hasAnyPrefix(strings.TrimPrefix(a.Value, "com.google.firebase.components:"), packages) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// metaDataEntry is a meta-data element and the class name of the component
+// it belongs to, "" for the application's own.
+type metaDataEntry struct {
+	el     xmlElement
+	name   string
+	parent string
+}
+
+func (m *manifest) metaData() ([]metaDataEntry, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []metaDataEntry
+	component := ""
+	for _, el := range elements {
+		name, _ := el.attr("name")
+		switch {
+		case isComponent(el.path):
+			component = name
+		case el.path == "manifest/application/meta-data":
+			entries = append(entries, metaDataEntry{el: el, name: name})
+		case el.name() == "meta-data" && isComponent(path.Dir(el.path)):
+			entries = append(entries, metaDataEntry{el: el, name: name, parent: component})
+		}
+	}
+	return entries, nil
+}
+
+// metaDataNames lists the names of the meta-data entries of the component
+// declared as class.
+func (m *manifest) metaDataNames(class string) ([]string, error) {
+	entries, err := m.metaData()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.parent == class {
+			names = append(names, e.name)
+		}
+	}
+	return names, nil
+}
+
+// removeMetaData deletes the meta-data entries that match, returning how
+// many there were.
+func (m *manifest) removeMetaData(match func(parent, name string) bool) (int, error) {
+	removed := 0
+	for {
+		entries, err := m.metaData()
+		if err != nil {
+			return removed, err
+		}
+
+		var victim *metaDataEntry
+		for i, e := range entries {
+			if match(e.parent, e.name) {
+				victim = &entries[i]
+			}
+		}
+		if victim == nil {
+			return removed, nil
+		}
+		// Parse again after each removal, the offsets after it have moved.
+		m.remove(victim.el)
+		removed++
+	}
+}
+
+// setMetaData sets the value of an application meta-data entry, adding it
+// when it's missing.
+func (m *manifest) setMetaData(name, value string) error {
+	entries, err := m.find("manifest/application/meta-data")
+	if err != nil {
+		return err
+	}
+	for _, el := range entries {
+		if key, _ := el.attr("name"); key == name {
+			m.setAttr(el, "value", value)
+			return nil
+		}
+	}
+
+	apps, err := m.find("manifest/application")
+	if err != nil {
+		return err
+	}
+	if len(apps) == 0 {
+		return fmt.Errorf("no <application> in %s", m.path)
+	}
+	m.insertChild(apps[0], fmt.Sprintf(`<meta-data android:name="%s" android:value="%s"/>`, escapeAttr(name), escapeAttr(value)))
+	return nil
+}
+
+// addPermission adds a <uses-permission> for name before the <application>,
+// unless the manifest already requests it, with either a <uses-permission>
+// or a <uses-permission-sdk-23>. It reports whether it was added.
+func (m *manifest) addPermission(name string) (bool, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return false, err
+	}
+
+	var root, app *xmlElement
+	for i, el := range elements {
+		switch el.path {
+		case "manifest":
+			root = &elements[i]
+		case "manifest/application":
+			app = &elements[i]
+		case "manifest/uses-permission", "manifest/uses-permission-sdk-23":
+			if value, _ := el.attr("name"); value == name {
+				return false, nil
+			}
+		}
+	}
+
+	tag := fmt.Sprintf(`<uses-permission android:name="%s"/>`, escapeAttr(name))
+	switch {
+	case app != nil:
+		m.splice(app.start, app.start, tag+"\n"+m.indent(app.start))
+	case root != nil:
+		m.insertChild(*root, tag)
+	default:
+		return false, fmt.Errorf("no <manifest> in %s", m.path)
+	}
+	return true, nil
+}
+
+// addInstrumentation declares in, or updates the target of the
+// instrumentation already declared with its runner.
+func (m *manifest) addInstrumentation(in *instrumentation) error {
+	elements, err := m.elements()
+	if err != nil {
+		return err
+	}
+	var root *xmlElement
+	for i, el := range elements {
+		name, _ := el.attr("name")
+		switch {
+		case el.path == "manifest":
+			root = &elements[i]
+		case el.path == "manifest/instrumentation" && name == in.runner:
+			m.setAttr(el, "targetPackage", in.target)
+			root = nil
+		}
+	}
+	if root != nil {
+		m.insertChild(*root, fmt.Sprintf(`<instrumentation android:name="%s" android:targetPackage="%s"/>`, escapeAttr(in.runner), escapeAttr(in.target)))
+	}
+	if !in.testLibrary {
+		return nil
+	}
+
+	// The edit above moved the elements after it.
+	apps, err := m.find("manifest/application")
+	if err != nil || len(apps) == 0 {
+		return fmt.Errorf("no <application> in %s", m.path)
+	}
+	libraries, err := m.find("manifest/application/uses-library")
+	if err != nil {
+		return err
+	}
+	for _, el := range libraries {
+		if name, _ := el.attr("name"); name == "android.test.runner" {
+			return nil
+		}
+	}
+	m.insertChild(apps[0], `<uses-library android:name="android.test.runner" android:required="false"/>`)
+	return nil
+}
+
+// classNamePattern matches a Java class name, com.example.Outer$Inner.
+var classNamePattern = regexp.MustCompile(`^[A-Za-z_$][\w$]*(\.[A-Za-z_$][\w$]*)*$`)
+
+// injectedProvider is the provider -inject-provider declared.
+type injectedProvider struct {
+	Class     string `json:"class"`
+	Authority string `json:"authority"`
+}
+
+// addProvider declares class as a provider of the application, with an
+// authority, <pkg>.<class in lower case>.rsiw, that no other provider of
+// the manifest has.
+func (m *manifest) addProvider(class, pkg string) (*injectedProvider, error) {
+	apps, err := m.find("manifest/application")
+	if err != nil || len(apps) == 0 {
+		return nil, fmt.Errorf("no <application> in %s", m.path)
+	}
+	providers, err := m.find("manifest/application/provider")
+	if err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for _, el := range providers {
+		if name, _ := el.attr("name"); resolveClassName(pkg, name) == class {
+			return nil, fmt.Errorf("the manifest declares the provider %s already", class)
+		}
+		authorities, _ := el.attr("authorities")
+		for _, a := range strings.Split(authorities, ";") {
+			taken[strings.TrimSpace(a)] = true
+		}
+	}
+	base := pkg + "." + strings.ToLower(class[strings.LastIndex(class, ".")+1:]) + ".rsiw"
+	authority := base
+	for i := 2; taken[authority]; i++ {
+		authority = fmt.Sprintf("%s%d", base, i)
+	}
+	m.insertChild(apps[0], fmt.Sprintf(`<provider android:name="%s" android:authorities="%s" android:exported="false"/>`, escapeAttr(class), escapeAttr(authority)))
+	return &injectedProvider{Class: class, Authority: authority}, nil
+}
+
+// insertChild adds tag as the last child of el, indented one level deeper.
+func (m *manifest) insertChild(el xmlElement, tag string) {
+	indent := m.indent(el.start)
+	if m.data[el.end-2] == '/' {
+		m.splice(el.end-2, el.end, ">\n"+indent+"    "+tag+"\n"+indent+"</"+el.name()+">")
+		return
+	}
+
+	closeTag := el.start + bytes.LastIndex(m.data[el.start:el.close], []byte("</"))
+	at := closeTag
+	for at > 0 && (m.data[at-1] == ' ' || m.data[at-1] == '\t') {
+		at--
+	}
+	if at > 0 && m.data[at-1] == '\n' {
+		m.splice(at, at, indent+"    "+tag+"\n")
+	} else {
+		m.splice(closeTag, closeTag, tag)
+	}
+}
+
+// indent returns the whitespace the line holding offset starts with.
+func (m *manifest) indent(offset int) string {
+	start := offset
+	for start > 0 && (m.data[start-1] == ' ' || m.data[start-1] == '\t') {
+		start--
+	}
+	return string(m.data[start:offset])
+}
+
+// remove deletes el, with its children and the indentation before it.
+func (m *manifest) remove(el xmlElement) {
+	start := el.start
+	for start > 0 && (m.data[start-1] == ' ' || m.data[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && m.data[start-1] == '\n' {
+		start--
+	} else {
+		start = el.start
+	}
+	m.splice(start, el.close, "")
+}
+
+// componentTags are the elements that declare app components.
+var componentTags = []string{"activity", "activity-alias", "service", "receiver", "provider"}
+
+func isComponent(elementPath string) bool {
+	for _, tag := range componentTags {
+		if elementPath == "manifest/application/"+tag {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClassName expands a class name from the manifest relative to pkg,
+// as the package manager does.
+func resolveClassName(pkg, name string) string {
+	switch {
+	case strings.HasPrefix(name, "."):
+		return pkg + name
+	case !strings.Contains(name, "."):
+		return pkg + "." + name
+	}
+	return name
+}
+
+// removeComponent deletes every component declared as class, reporting
+// whether there was one.
+func (m *manifest) removeComponent(pkg, class string) (bool, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	// Back to front, so removing one doesn't move the ones still to check.
+	for i := len(elements) - 1; i >= 0; i-- {
+		el := elements[i]
+		if name, ok := el.attr("name"); ok && isComponent(el.path) && resolveClassName(pkg, name) == class {
+			m.remove(el)
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// references describes the attributes left in the manifest that name class,
+// such as an activity-alias targeting it or a meta-data value.
+func (m *manifest) references(pkg, class string) ([]string, error) {
+	elements, err := m.elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, el := range elements {
+		for _, a := range el.attrs {
+			if a.Value == class || strings.HasPrefix(a.Value, ".") && pkg+a.Value == class {
+				refs = append(refs, fmt.Sprintf("<%s %s=%q>", el.name(), xmlAttrName(a.Name), a.Value))
+			}
+		}
+	}
+	return refs, nil
+}
+
+func xmlAttrName(name xml.Name) string {
+	if name.Space == androidNS {
+		return "android:" + name.Local
+	}
+	return name.Local
+}
+
+// removeClassFiles deletes the smali files of class, and of its inner
+// classes, from every smali directory of the decoded app. It returns the
+// deleted files relative to appDir.
+func removeClassFiles(appDir, class string) ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "smali*"))
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.FromSlash(strings.ReplaceAll(class, ".", "/"))
+	var removed []string
+	for _, dir := range dirs {
+		inner, err := filepath.Glob(filepath.Join(dir, base+"$*.smali"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range append([]string{filepath.Join(dir, base+".smali")}, inner...) {
+			if !fileExists(file) {
+				continue
+			}
+			if err := os.Remove(file); err != nil {
+				return nil, err
+			}
+			rel, _ := filepath.Rel(appDir, file)
+			removed = append(removed, rel)
+		}
+	}
+	return removed, nil
+}
+
+// rootCheckClasses are the root detection libraries bypassRootDetection
+// patches, by their smali class names, with the methods that are checks.
+var rootCheckClasses = map[string]*regexp.Regexp{
+	"Lcom/scottyab/rootbeer/RootBeer;":    regexp.MustCompile(`^(is|detect|check)[A-Z]`),
+	"Lcom/stericson/RootTools/RootTools;": regexp.MustCompile(`^(isRootAvailable|isAccessGiven|isBusyboxAvailable)\(`),
+	"Lcom/stericson/RootShell/RootShell;": regexp.MustCompile(`^(isRootAvailable|isAccessGiven|isBusyboxAvailable)\(`),
+}
+
+// rootCheckStrings are the strings whose use marks an app's own method as a
+// root check: su binaries, root manager packages and the test-keys build tag.
+var rootCheckStrings = map[string]bool{
+	"/system/bin/su":             true,
+	"/system/xbin/su":            true,
+	"/sbin/su":                   true,
+	"/su/bin/su":                 true,
+	"/system/app/Superuser.apk":  true,
+	"/system/xbin/which":         true,
+	"com.topjohnwu.magisk":       true,
+	"eu.chainfire.supersu":       true,
+	"com.noshufou.android.su":    true,
+	"com.koushikdutta.superuser": true,
+	"test-keys":                  true,
+}
+
+var smaliConstStringPattern = regexp.MustCompile(`^\s*const-string(?:/jumbo)?\s+[vp]\d+,\s*"((?:[^"\\]|\\.)*)"`)
+
+// patchedMethod is a method whose code was replaced.
+type patchedMethod struct {
+	File   string `json:"file"`             // relative to the decoded app
+	Method string `json:"method"`           // class and method, e.g. Lcom/example/A;->isRooted()Z
+	Reason string `json:"reason,omitempty"` // the library, or the string that gave it away
+}
+
+// bypassRootDetection makes the boolean root checks of the decoded app
+// return false: the checks of the rootCheckClasses libraries, and the
+// app's own boolean methods using a rootCheckStrings string. Abstract and
+// native methods are left alone, as are checks that return anything else.
+func bypassRootDetection(appDir string) ([]patchedMethod, error) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "smali*"))
+	if err != nil {
+		return nil, err
+	}
+	var patched []patchedMethod
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(path, ".smali") {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			lines, methods := patchRootChecks(strings.Split(string(data), "\n"))
+			if len(methods) == 0 {
+				return nil
+			}
+			if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), info.Mode()); err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(appDir, path)
+			for i := range methods {
+				methods[i].File = rel
+			}
+			patched = append(patched, methods...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return patched, nil
+}
+
+// patchRootChecks replaces the body of the root checks in the lines of a
+// smali file with a return of false.
+func patchRootChecks(lines []string) ([]string, []patchedMethod) {
+	var class string
+	if len(lines) > 0 {
+		if m := smaliClassPattern.FindStringSubmatch(strings.TrimRight(lines[0], "\r")); m != nil {
+			class = m[1]
+		}
+	}
+	checks := rootCheckClasses[class]
+
+	var out []string
+	var patched []patchedMethod
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		m := smaliMethodPattern.FindStringSubmatch(line)
+		if m == nil || !strings.HasSuffix(m[1], ")Z") || strings.Contains(line, " abstract ") || strings.Contains(line, " native ") {
+			out = append(out, lines[i])
+			continue
+		}
+		end := i
+		for end < len(lines) && strings.TrimSpace(lines[end]) != ".end method" {
+			end++
+		}
+		if end == len(lines) {
+			out = append(out, lines[i:]...)
+			break
+		}
+
+		reason := ""
+		switch {
+		case checks != nil && checks.MatchString(m[1]):
+			reason = "root detection library"
+		case checks == nil:
+			for _, l := range lines[i+1 : end] {
+				if s := smaliConstStringPattern.FindStringSubmatch(l); s != nil && rootCheckStrings[s[1]] {
+					reason = fmt.Sprintf("uses %q", s[1])
+					break
+				}
+			}
+		}
+		if reason == "" {
+			out = append(out, lines[i:end+1]...)
+		} else {
+			out = append(out, lines[i], "    .locals 1", "", "    const/4 v0, 0x0", "", "    return v0", lines[end])
+			patched = append(patched, patchedMethod{Method: class + "->" + m[1], Reason: reason})
+		}
+		i = end
+	}
+	return out, patched
+}
+
+// mergeSmali copies the smali files under src into a new smali_classesN
+// directory of the decoded app, which becomes a dex of its own, and returns
+// that directory and the classes it added. A class the app has already is
+// an error rather than a replacement.
+func mergeSmali(appDir, src string) (string, []string, error) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "smali*"))
+	if err != nil {
+		return "", nil, err
+	}
+	next := 2
+	for _, dir := range dirs {
+		if n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "smali_classes")); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	dest := fmt.Sprintf("smali_classes%d", next)
+
+	var classes []string
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".smali") {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		class := strings.ReplaceAll(filepath.ToSlash(strings.TrimSuffix(rel, ".smali")), "/", ".")
+		if file, err := findSmaliClass(appDir, class); err != nil {
+			return err
+		} else if file != "" {
+			return fmt.Errorf("the app has %s already, in %s", class, file)
+		}
+		target := filepath.Join(appDir, dest, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(path, target, 0644); err != nil {
+			return err
+		}
+		classes = append(classes, class)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(classes) == 0 {
+		return "", nil, errors.New("it holds no .smali files")
+	}
+	return dest, classes, nil
+}
+
+// smaliSnippet is code injected at the start of a method. It runs before
+// anything else there, so it's free to use v0 up to locals-1.
+type smaliSnippet struct {
+	name   string
+	locals int
+	code   []string
+}
+
+// What resolveAppEntry found missing and inject has to write.
+const (
+	generateNothing = iota
+	generateMethod  // onCreate, calling the superclass's
+	generateClass   // an Application subclass, set as android:name
+)
+
+const (
+	onCreateMethod          = "onCreate()V"
+	attachBaseContextMethod = "attachBaseContext(Landroid/content/Context;)V"
+	instantiateAppMethod    = "instantiateApplication(Ljava/lang/ClassLoader;Ljava/lang/String;)Landroid/app/Application;"
+	// generatedAppClass is the Application declared for an app that has
+	// none of its own.
+	generatedAppClass = "rsiw.DebugApplication"
+)
+
+// appEntry is the method of the app's Application class code that must run
+// at startup goes into.
+type appEntry struct {
+	class    string // e.g. com.example.App
+	file     string // its smali file, relative to the decoded app
+	super    string // the superclass, e.g. Landroid/app/Application;
+	method   string // onCreateMethod or attachBaseContextMethod
+	generate int
+}
+
+func (e *appEntry) String() string {
+	s := e.class + "." + strings.SplitN(e.method, "(", 2)[0]
+	switch e.generate {
+	case generateMethod:
+		s += " (added)"
+	case generateClass:
+		s += " (new class)"
+	}
+	return s
+}
+
+var (
+	smaliSuperPattern       = regexp.MustCompile(`(?m)^\.super\s+(L[^;\s]+;)`)
+	smaliNewInstancePattern = regexp.MustCompile(`^\s*new-instance\s+[vp]\d+,\s*(L[^;\s]+;)`)
+	smaliRegistersPattern   = regexp.MustCompile(`^(\s*)\.(locals|registers)\s+(\d+)\s*$`)
+)
+
+// resolveAppEntry finds where the app's startup code goes: onCreate of the
+// Application class it declares, in whichever smali directory that is, or
+// attachBaseContext when it only overrides that, or else a new onCreate.
+// Without an Application class it plans a new one. An appComponentFactory
+// that creates the Application itself wins over the manifest.
+func resolveAppEntry(m *manifest, appDir, pkg string) (*appEntry, error) {
+	apps, err := m.find("manifest/application")
+	if err != nil {
+		return nil, err
+	}
+	if len(apps) == 0 {
+		return nil, fmt.Errorf("no <application> in %s", m.path)
+	}
+
+	class := ""
+	if name, ok := apps[0].attr("name"); ok {
+		class = resolveClassName(pkg, name)
+	}
+	if factory, ok := apps[0].attr("appComponentFactory"); ok {
+		created, err := factoryApplication(appDir, resolveClassName(pkg, factory))
+		if err != nil {
+			return nil, err
+		}
+		if created != "" {
+			class = created
+		}
+	}
+	if class == "" {
+		return &appEntry{
+			class:    generatedAppClass,
+			file:     filepath.Join("smali", smaliClassPath(generatedAppClass)),
+			super:    "Landroid/app/Application;",
+			method:   onCreateMethod,
+			generate: generateClass,
+		}, nil
+	}
+
+	file, err := findSmaliClass(appDir, class)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return nil, fmt.Errorf("the application class %s isn't in the app's smali, a packer may load it at runtime", class)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(appDir, file))
+	if err != nil {
+		return nil, err
+	}
+	entry := &appEntry{class: class, file: file}
+	if super := smaliSuperPattern.FindSubmatch(data); super != nil {
+		entry.super = string(super[1])
+	}
+	switch {
+	case smaliMethodStart(data, onCreateMethod) >= 0:
+		entry.method = onCreateMethod
+	case smaliMethodStart(data, attachBaseContextMethod) >= 0:
+		entry.method = attachBaseContextMethod
+	case entry.super != "":
+		entry.method, entry.generate = onCreateMethod, generateMethod
+	default:
+		return nil, fmt.Errorf("%s has no .super, it can't be given an onCreate", file)
+	}
+	return entry, nil
+}
+
+// factoryApplication returns the class an appComponentFactory creates as the
+// Application, "" when it leaves that to the framework.
+func factoryApplication(appDir, factory string) (string, error) {
+	file, err := findSmaliClass(appDir, factory)
+	if err != nil || file == "" {
+		// androidx's CoreComponentFactory and the like are only in the
+		// app when it ships them, and then they don't override it.
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(appDir, file))
+	if err != nil {
+		return "", err
+	}
+	body := smaliMethodBody(data, instantiateAppMethod)
+	if body == nil {
+		return "", nil
+	}
+
+	created := map[string]bool{}
+	for _, line := range body {
+		if m := smaliNewInstancePattern.FindStringSubmatch(line); m != nil {
+			created[m[1]] = true
+		}
+	}
+	if len(created) != 1 {
+		return "", fmt.Errorf("the appComponentFactory %s overrides instantiateApplication, and it's unclear which Application it creates", factory)
+	}
+	for class := range created {
+		return strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(class, "L"), ";"), "/", "."), nil
+	}
+	return "", nil
+}
+
+// smaliClassPath is the path of class's smali file in a smali directory.
+func smaliClassPath(class string) string {
+	return filepath.FromSlash(strings.ReplaceAll(class, ".", "/")) + ".smali"
+}
+
+// findSmaliClass returns the smali file of class relative to appDir, in
+// whichever smali directory holds it, or "" when none does.
+func findSmaliClass(appDir, class string) (string, error) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "smali*"))
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		file := filepath.Join(dir, smaliClassPath(class))
+		if fileExists(file) {
+			return filepath.Rel(appDir, file)
+		}
+	}
+	return "", nil
+}
+
+// smaliMethodStart returns the index of the .method line defining method
+// (name and descriptor) in data's lines, -1 if there's none with code.
+func smaliMethodStart(data []byte, method string) int {
+	for i, line := range strings.Split(string(data), "\n") {
+		m := smaliMethodPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m != nil && m[1] == method && !strings.Contains(line, " abstract ") && !strings.Contains(line, " native ") {
+			return i
+		}
+	}
+	return -1
+}
+
+// smaliMethodBody returns the lines of method, nil if data doesn't define it.
+func smaliMethodBody(data []byte, method string) []string {
+	start := smaliMethodStart(data, method)
+	if start < 0 {
+		return nil
+	}
+	lines := strings.Split(string(data), "\n")[start:]
+	for i, line := range lines {
+		if strings.TrimSpace(line) == ".end method" {
+			return lines[:i+1]
+		}
+	}
+	return lines
+}
+
+// inject writes code at the start of the entry method, creating the method
+// or the whole class first when resolveAppEntry found them missing.
+func (e *appEntry) inject(appDir string, code []smaliSnippet) error {
+	locals := 0
+	var lines []string
+	for _, snippet := range code {
+		if snippet.locals > locals {
+			locals = snippet.locals
+		}
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "    # "+snippet.name)
+		for _, line := range snippet.code {
+			lines = append(lines, "    "+line)
+		}
+	}
+	path := filepath.Join(appDir, e.file)
+	self := "L" + strings.ReplaceAll(e.class, ".", "/") + ";"
+
+	switch e.generate {
+	case generateClass:
+		if fileExists(path) {
+			return fmt.Errorf("%s already exists", e.file)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		class := []string{
+			".class public " + self,
+			".super " + e.super,
+			"",
+			"",
+			".method public constructor <init>()V",
+			"    .locals 0",
+			"",
+			"    invoke-direct {p0}, " + e.super + "-><init>()V",
+			"",
+			"    return-void",
+			".end method",
+			"",
+		}
+		return ioutil.WriteFile(path, []byte(strings.Join(append(class, generatedOnCreate(e.super, locals, lines)...), "\n")), 0644)
+	case generateMethod:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		method := strings.Join(generatedOnCreate(e.super, locals, lines), "\n")
+		data = append(bytes.TrimRight(data, "\n"), []byte("\n\n"+method)...)
+		return ioutil.WriteFile(path, data, 0644)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	all := strings.Split(string(data), "\n")
+	start := smaliMethodStart(data, e.method)
+	if start < 0 {
+		return fmt.Errorf("%s no longer defines %s", e.file, e.method)
+	}
+	for i := start + 1; i < len(all) && strings.TrimSpace(all[i]) != ".end method"; i++ {
+		m := smaliRegistersPattern.FindStringSubmatch(strings.TrimRight(all[i], "\r"))
+		if m == nil {
+			continue
+		}
+		// .registers counts the parameters too: this and one per
+		// argument of the two methods an entry can be.
+		n, _ := strconv.Atoi(m[3])
+		have, ins := n, 0
+		if m[2] == "registers" {
+			ins = 1 + strings.Count(e.method, ";")
+			have = n - ins
+		}
+		if have < locals {
+			all[i] = fmt.Sprintf("%s.%s %d", m[1], m[2], locals+ins)
+		}
+		injected := append([]string{all[i], ""}, lines...)
+		if i+1 < len(all) && strings.TrimSpace(all[i+1]) != "" {
+			injected = append(injected, "")
+		}
+		all = append(all[:i], append(injected, all[i+1:]...)...)
+		return ioutil.WriteFile(path, []byte(strings.Join(all, "\n")), 0644)
+	}
+	return fmt.Errorf("%s has no .locals in %s", e.file, e.method)
+}
+
+// generatedOnCreate is an onCreate running code and then the superclass's.
+func generatedOnCreate(super string, locals int, code []string) []string {
+	method := []string{
+		".method public onCreate()V",
+		fmt.Sprintf("    .locals %d", locals),
+		"",
+	}
+	method = append(method, code...)
+	return append(method,
+		"",
+		"    invoke-super {p0}, "+super+"->onCreate()V",
+		"",
+		"    return-void",
+		".end method",
+		"",
+	)
+}
+
+func (m *manifest) splice(start, end int, text string) {
+	data := make([]byte, 0, len(m.data)-(end-start)+len(text))
+	data = append(data, m.data[:start]...)
+	data = append(data, text...)
+	m.data = append(data, m.data[end:]...)
+}
+
+// removeAttr deletes every android:<name> attribute from a start tag.
+func removeAttr(tag, name string) string {
+	pattern := regexp.MustCompile(`\s+android:` + regexp.QuoteMeta(name) + `\s*=\s*(?:"[^"]*"|'[^']*')`)
+	return pattern.ReplaceAllString(tag, "")
+}
+
+func escapeAttr(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+// axmlElement is a start tag of a binary XML file, as found in a built APK.
+type axmlElement struct {
+	name       string
+	path       string // e.g. "manifest/application/activity"
+	depth      int    // 0 for the root
+	namespaces []axmlNamespace
+	attrs      []axmlAttr
+}
+
+// axmlNamespace is a namespace declared on an element.
+type axmlNamespace struct {
+	prefix, uri string
+}
+
+type axmlAttr struct {
+	ns, name, value string
+	// dataType and data are the typed value (a Res_value) behind value.
+	dataType byte
+	data     uint32
+}
+
+// attr returns the value of el's android:<name> attribute.
+func (el axmlElement) attr(name string) (string, bool) {
+	for _, a := range el.attrs {
+		if a.ns == androidNS && a.name == name {
+			return a.value, true
+		}
+	}
+	return "", false
+}
+
+// androidAttrNames names framework attributes by resource ID, for files
+// where the attribute name strings have been stripped.
+var androidAttrNames = map[uint32]string{
+	0x01010000: "theme",
+	0x01010001: "label",
+	0x01010002: "icon",
+	0x01010003: "name",
+	0x01010006: "permission",
+	0x0101000f: "debuggable",
+	0x01010010: "exported",
+	0x01010011: "process",
+	0x01010018: "authorities",
+	0x01010021: "targetPackage",
+	0x01010026: "mimeType",
+	0x01010027: "scheme",
+	0x01010028: "host",
+	0x01010029: "port",
+	0x0101002a: "path",
+	0x0101002b: "pathPrefix",
+	0x0101002c: "pathPattern",
+	0x01010024: "value",
+	0x01010025: "resource",
+	0x01010202: "targetActivity",
+	0x0101020c: "minSdkVersion",
+	0x0101021b: "versionCode",
+	0x0101021c: "versionName",
+	0x01010270: "targetSdkVersion",
+	0x01010271: "maxSdkVersion",
+	0x01010280: "allowBackup",
+	0x0101028e: "required",
+	0x010104ee: "autoVerify",
+}
+
+// Chunk types of the binary XML and resource table formats (ResourceTypes.h).
+const (
+	axmlStringPool     = 0x0001
+	arscTable          = 0x0002
+	axmlFile           = 0x0003
+	axmlStartNamespace = 0x0100
+	axmlStartElement   = 0x0102
+	axmlEndElement     = 0x0103
+	axmlResourceMap    = 0x0180
+	arscPackage        = 0x0200
+	arscType           = 0x0201
+)
+
+// Res_value types.
+const (
+	typeReference = 0x01
+	typeAttribute = 0x02
+	typeString    = 0x03
+	typeFloat     = 0x04
+	typeDimension = 0x05
+	typeFraction  = 0x06
+	typeIntDec    = 0x10
+	typeIntHex    = 0x11
+	typeBoolean   = 0x12
+	typeColorMin  = 0x1c
+	typeColorMax  = 0x1f
+)
+
+// chunks calls fn for each chunk in data, starting at offset off.
+func chunks(data []byte, off int, fn func(typ uint16, headerSize int, chunk []byte) error) error {
+	le := binary.LittleEndian
+	for off+8 <= len(data) {
+		headerSize := int(le.Uint16(data[off+2:]))
+		size := int(le.Uint32(data[off+4:]))
+		if size < 8 || headerSize < 8 || headerSize > size || size > len(data)-off {
+			return fmt.Errorf("bad chunk at offset %d", off)
+		}
+		if err := fn(le.Uint16(data[off:]), headerSize, data[off:off+size]); err != nil {
+			return err
+		}
+		off += size
+	}
+	return nil
+}
+
+// decodeAXML lists the elements of a binary XML file, in document order.
+func decodeAXML(data []byte) ([]axmlElement, error) {
+	le := binary.LittleEndian
+	if len(data) < 8 || le.Uint16(data) != axmlFile {
+		return nil, errors.New("not a binary XML file")
+	}
+
+	var strs []string
+	var resMap []uint32
+	str := func(i uint32) string {
+		if int(i) < len(strs) {
+			return strs[i]
+		}
+		return ""
+	}
+
+	var elements []axmlElement
+	var stack []string
+	var namespaces []axmlNamespace
+	err := chunks(data, int(le.Uint16(data[2:])), func(typ uint16, headerSize int, chunk []byte) error {
+		ext := chunk[headerSize:]
+		switch typ {
+		case axmlStringPool:
+			var err error
+			strs, err = decodeStringPool(chunk)
+			return err
+		case axmlResourceMap:
+			for i := 0; i+4 <= len(ext); i += 4 {
+				resMap = append(resMap, le.Uint32(ext[i:]))
+			}
+		case axmlStartNamespace:
+			if len(ext) < 8 {
+				return errors.New("bad namespace")
+			}
+			namespaces = append(namespaces, axmlNamespace{prefix: str(le.Uint32(ext)), uri: str(le.Uint32(ext[4:]))})
+		case axmlStartElement:
+			if len(ext) < 20 {
+				return errors.New("bad start element")
+			}
+			name := str(le.Uint32(ext[4:]))
+			stack = append(stack, name)
+			el := axmlElement{name: name, path: strings.Join(stack, "/"), depth: len(stack) - 1, namespaces: namespaces}
+			namespaces = nil
+
+			attrStart, attrSize, count := int(le.Uint16(ext[8:])), int(le.Uint16(ext[10:])), int(le.Uint16(ext[12:]))
+			for i := 0; i < count; i++ {
+				at := attrStart + i*attrSize
+				if attrSize < 20 || at+20 > len(ext) {
+					return errors.New("bad attribute")
+				}
+				a := ext[at:]
+				nameIdx := le.Uint32(a[4:])
+				attr := axmlAttr{ns: str(le.Uint32(a)), name: str(nameIdx), dataType: a[15], data: le.Uint32(a[16:])}
+				// Obfuscators rename the pool strings of android attributes;
+				// the resource ID they map to is what the platform reads.
+				if int(nameIdx) < len(resMap) {
+					if name, ok := androidAttrNames[resMap[nameIdx]]; ok {
+						attr.name = name
+					}
+				}
+				if raw := le.Uint32(a[8:]); raw != 0xffffffff {
+					attr.value = str(raw)
+				} else {
+					attr.value = formatTypedValue(attr.dataType, attr.data, str)
+				}
+				el.attrs = append(el.attrs, attr)
+			}
+			elements = append(elements, el)
+		case axmlEndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		return nil
+	})
+	return elements, err
+}
+
+// formatTypedValue renders a Res_value the way aapt dumps it.
+func formatTypedValue(dataType byte, data uint32, str func(uint32) string) string {
+	switch {
+	case dataType == typeReference:
+		return fmt.Sprintf("@0x%08x", data)
+	case dataType == typeAttribute:
+		return fmt.Sprintf("?0x%08x", data)
+	case dataType == typeString:
+		return str(data)
+	case dataType == typeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(data)), 'g', -1, 32)
+	case dataType == typeDimension:
+		units := []string{"px", "dp", "sp", "pt", "in", "mm"}
+		unit := "px"
+		if int(data&0xf) < len(units) {
+			unit = units[data&0xf]
+		}
+		return strconv.FormatFloat(complexValue(data), 'g', -1, 32) + unit
+	case dataType == typeFraction:
+		unit := "%"
+		if data&0xf == 1 {
+			unit = "%p"
+		}
+		return strconv.FormatFloat(complexValue(data)*100, 'g', -1, 32) + unit
+	case dataType == typeIntDec:
+		return strconv.Itoa(int(int32(data)))
+	case dataType == typeBoolean:
+		return strconv.FormatBool(data != 0)
+	case dataType >= typeColorMin && dataType <= typeColorMax:
+		return fmt.Sprintf("#%08x", data)
+	}
+	return fmt.Sprintf("0x%08x", data)
+}
+
+// complexValue decodes the number of a dimension or fraction: a 24-bit
+// mantissa with one of four radixes.
+func complexValue(data uint32) float64 {
+	mantissa := float64(int32(data&0xffffff00) >> 8)
+	radix := []float64{1, 1 << 7, 1 << 15, 1 << 23}[(data>>4)&3]
+	return mantissa / radix
+}
+
+// decodeStringPool reads the strings of a string pool chunk.
+func decodeStringPool(chunk []byte) ([]string, error) {
+	le := binary.LittleEndian
+	if len(chunk) < 28 {
+		return nil, errors.New("bad string pool")
+	}
+	headerSize := int(le.Uint16(chunk[2:]))
+	count := int(le.Uint32(chunk[8:]))
+	isUTF8 := le.Uint32(chunk[16:])&0x100 != 0
+	stringsStart := int(le.Uint32(chunk[20:]))
+	if count > (len(chunk)-headerSize)/4 {
+		return nil, errors.New("bad string pool")
+	}
+
+	strs := make([]string, count)
+	for i := range strs {
+		o := stringsStart + int(le.Uint32(chunk[headerSize+4*i:]))
+		if o < 0 || o >= len(chunk) {
+			return nil, errors.New("bad string pool offset")
+		}
+		b := chunk[o:]
+		if isUTF8 {
+			// The length in UTF-16 units, then in bytes, each 1 or 2 bytes long.
+			n := 1
+			if len(b) > 0 && b[0]&0x80 != 0 {
+				n = 2
+			}
+			if len(b) < n+2 {
+				return nil, errors.New("bad string pool entry")
+			}
+			b = b[n:]
+			size, n := int(b[0]), 1
+			if b[0]&0x80 != 0 {
+				size, n = int(b[0]&0x7f)<<8|int(b[1]), 2
+			}
+			if n+size > len(b) {
+				return nil, errors.New("bad string pool entry")
+			}
+			strs[i] = string(b[n : n+size])
+			continue
+		}
+
+		if len(b) < 2 {
+			return nil, errors.New("bad string pool entry")
+		}
+		size, n := int(le.Uint16(b)), 2
+		if size&0x8000 != 0 {
+			if len(b) < 4 {
+				return nil, errors.New("bad string pool entry")
+			}
+			size, n = (size&0x7fff)<<16|int(le.Uint16(b[2:])), 4
+		}
+		if n+2*size > len(b) {
+			return nil, errors.New("bad string pool entry")
+		}
+		units := make([]uint16, size)
+		for j := range units {
+			units[j] = le.Uint16(b[n+2*j:])
+		}
+		strs[i] = string(utf16.Decode(units))
+	}
+	return strs, nil
+}
+
+// readZipEntry returns the contents of one file in a zip.
+func readZipEntry(path, name string) ([]byte, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("no %s in %s", name, path)
+}
+
+// resourceTable is the part of a resources.arsc needed to resolve the
+// references in a manifest: one value per resource, from the default
+// configuration when there is one.
+type resourceTable struct {
+	strings []string
+	entries map[uint32]resourceEntry
+}
+
+type resourceEntry struct {
+	typeName, key string
+	complex       bool // a style, array or other bag with no single value
+	dataType      byte
+	data          uint32
+	isDefault     bool
+}
+
+func decodeResourceTable(data []byte) (*resourceTable, error) {
+	le := binary.LittleEndian
+	if len(data) < 12 || le.Uint16(data) != arscTable {
+		return nil, errors.New("not a resource table")
+	}
+
+	t := &resourceTable{entries: map[uint32]resourceEntry{}}
+	err := chunks(data, int(le.Uint16(data[2:])), func(typ uint16, headerSize int, chunk []byte) error {
+		switch typ {
+		case axmlStringPool:
+			var err error
+			t.strings, err = decodeStringPool(chunk)
+			return err
+		case arscPackage:
+			return t.decodePackage(headerSize, chunk)
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (t *resourceTable) decodePackage(headerSize int, chunk []byte) error {
+	le := binary.LittleEndian
+	if headerSize < 284 {
+		return errors.New("bad resource package")
+	}
+	id := le.Uint32(chunk[8:])
+
+	var typeNames, keys []string
+	return chunks(chunk, headerSize, func(typ uint16, headerSize int, sub []byte) error {
+		// The type names pool comes first, then the key names.
+		switch {
+		case typ == axmlStringPool && typeNames == nil:
+			var err error
+			typeNames, err = decodeStringPool(sub)
+			return err
+		case typ == axmlStringPool && keys == nil:
+			var err error
+			keys, err = decodeStringPool(sub)
+			return err
+		case typ == arscType:
+			return t.decodeType(id, headerSize, sub, typeNames, keys)
+		}
+		return nil
+	})
+}
+
+// Flags of a ResTable_type and of its entries.
+const (
+	typeFlagSparse   = 0x01
+	typeFlagOffset16 = 0x02
+	entryFlagComplex = 0x0001
+	entryFlagCompact = 0x0008
+)
+
+func (t *resourceTable) decodeType(pkg uint32, headerSize int, chunk []byte, typeNames, keys []string) error {
+	le := binary.LittleEndian
+	if headerSize < 24 {
+		return errors.New("bad resource type")
+	}
+	typeID, flags := chunk[8], chunk[9]
+	count := int(le.Uint32(chunk[12:]))
+	entriesStart := int(le.Uint32(chunk[16:]))
+	name := func(strs []string, i uint32) string {
+		if int(i) < len(strs) {
+			return strs[i]
+		}
+		return ""
+	}
+
+	// The configuration is the default one when everything after its size
+	// field is zero.
+	isDefault := true
+	for _, b := range chunk[24:headerSize] {
+		if b != 0 {
+			isDefault = false
+			break
+		}
+	}
+
+	offsets := chunk[headerSize:]
+	for i := 0; i < count; i++ {
+		idx, offset := i, -1
+		switch {
+		case flags&typeFlagSparse != 0:
+			if 4*i+4 > len(offsets) {
+				return errors.New("bad resource type")
+			}
+			idx, offset = int(le.Uint16(offsets[4*i:])), 4*int(le.Uint16(offsets[4*i+2:]))
+		case flags&typeFlagOffset16 != 0:
+			if 2*i+2 > len(offsets) {
+				return errors.New("bad resource type")
+			}
+			if o := le.Uint16(offsets[2*i:]); o != 0xffff {
+				offset = 4 * int(o)
+			}
+		default:
+			if 4*i+4 > len(offsets) {
+				return errors.New("bad resource type")
+			}
+			if o := le.Uint32(offsets[4*i:]); o != 0xffffffff {
+				offset = int(o)
+			}
+		}
+		if offset < 0 {
+			continue
+		}
+
+		at := entriesStart + offset
+		if at < 0 || at+8 > len(chunk) {
+			return errors.New("bad resource entry")
+		}
+		e := chunk[at:]
+		size, entryFlags := int(le.Uint16(e)), le.Uint16(e[2:])
+		entry := resourceEntry{typeName: name(typeNames, uint32(typeID)-1), isDefault: isDefault}
+		switch {
+		case entryFlags&entryFlagCompact != 0:
+			entry.key = name(keys, uint32(size))
+			entry.dataType = byte(entryFlags >> 8)
+			entry.data = le.Uint32(e[4:])
+		case entryFlags&entryFlagComplex != 0:
+			entry.key = name(keys, le.Uint32(e[4:]))
+			entry.complex = true
+		default:
+			entry.key = name(keys, le.Uint32(e[4:]))
+			if size+8 > len(e) {
+				return errors.New("bad resource entry")
+			}
+			entry.dataType = e[size+3]
+			entry.data = le.Uint32(e[size+4:])
+		}
+
+		id := pkg<<24 | uint32(typeID)<<16 | uint32(idx)
+		if old, ok := t.entries[id]; !ok || entry.isDefault && !old.isDefault {
+			t.entries[id] = entry
+		}
+	}
+	return nil
+}
+
+// resolve returns the value of resource id, following references. Bags,
+// such as themes, resolve to their @type/name.
+func (t *resourceTable) resolve(id uint32) (string, bool) {
+	str := func(i uint32) string {
+		if int(i) < len(t.strings) {
+			return t.strings[i]
+		}
+		return ""
+	}
+	for depth := 0; depth < 8; depth++ {
+		e, ok := t.entries[id]
+		switch {
+		case !ok:
+			return "", false
+		case e.complex:
+			return "@" + e.typeName + "/" + e.key, true
+		case e.dataType == typeReference:
+			id = e.data
+			continue
+		}
+		return formatTypedValue(e.dataType, e.data, str), true
+	}
+	return "", false
+}
+
+func manifestCommand(args []string) {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	format := flags.String("format", "xml", "Output format: xml or json")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *format != "xml" && *format != "json" {
+		fmt.Println("Usage: go run debugAPK.go manifest [-format xml|json] <APK_FILE>")
+		os.Exit(1)
+	}
+
+	apk := flags.Arg(0)
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		log.Fatal("Failed to decode AndroidManifest.xml: ", err)
+	}
+
+	if arsc, err := readZipEntry(apk, "resources.arsc"); err == nil {
+		if table, err := decodeResourceTable(arsc); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: can't read resources.arsc, references are left unresolved:", err)
+		} else {
+			resolveReferences(elements, table)
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summarizeManifest(elements)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	w := bufio.NewWriter(os.Stdout)
+	writeAXML(w, elements)
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dangerousPermissions are the platform permissions with the dangerous
+// protection level, which the user grants at runtime.
+var dangerousPermissions = map[string]bool{}
+
+func init() {
+	for _, name := range []string{
+		"READ_CALENDAR", "WRITE_CALENDAR", "CAMERA", "READ_CONTACTS", "WRITE_CONTACTS", "GET_ACCOUNTS",
+		"ACCESS_FINE_LOCATION", "ACCESS_COARSE_LOCATION", "ACCESS_BACKGROUND_LOCATION", "ACCESS_MEDIA_LOCATION",
+		"RECORD_AUDIO", "READ_PHONE_STATE", "READ_PHONE_NUMBERS", "CALL_PHONE", "ANSWER_PHONE_CALLS",
+		"READ_CALL_LOG", "WRITE_CALL_LOG", "USE_SIP", "PROCESS_OUTGOING_CALLS", "ACCEPT_HANDOVER",
+		"BODY_SENSORS", "BODY_SENSORS_BACKGROUND", "ACTIVITY_RECOGNITION",
+		"SEND_SMS", "RECEIVE_SMS", "READ_SMS", "RECEIVE_WAP_PUSH", "RECEIVE_MMS",
+		"READ_EXTERNAL_STORAGE", "WRITE_EXTERNAL_STORAGE", "READ_MEDIA_IMAGES", "READ_MEDIA_VIDEO",
+		"READ_MEDIA_AUDIO", "READ_MEDIA_VISUAL_USER_SELECTED",
+		"BLUETOOTH_SCAN", "BLUETOOTH_CONNECT", "BLUETOOTH_ADVERTISE", "UWB_RANGING", "NEARBY_WIFI_DEVICES",
+		"POST_NOTIFICATIONS",
+	} {
+		dangerousPermissions["android.permission."+name] = true
+	}
+	dangerousPermissions["com.android.voicemail.permission.ADD_VOICEMAIL"] = true
+}
+
+type permissionReport struct {
+	Package   string                `json:"package"`
+	Requested []requestedPermission `json:"requested"`
+	Declared  []declaredPermission  `json:"declared"`
+}
+
+type requestedPermission struct {
+	Name          string `json:"name"`
+	Dangerous     bool   `json:"dangerous"`
+	MaxSdkVersion string `json:"maxSdkVersion,omitempty"`
+	// SDK23 is set for uses-permission-sdk-23, only requested on
+	// Android 6.0 and later.
+	SDK23 bool `json:"sdk23,omitempty"`
+}
+
+type declaredPermission struct {
+	Name            string `json:"name"`
+	ProtectionLevel string `json:"protectionLevel"`
+	Dangerous       bool   `json:"dangerous"`
+}
+
+// protectionLevels names the base android:protectionLevel values; the
+// higher bits are flags.
+var protectionLevels = []string{"normal", "dangerous", "signature", "signatureOrSystem"}
+
+func permissionsCommand(args []string) {
+	flags := flag.NewFlagSet("permissions", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the permissions as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: go run debugAPK.go permissions [-json] <APK_FILE>")
+		os.Exit(1)
+	}
+
+	data, err := readZipEntry(flags.Arg(0), "AndroidManifest.xml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		log.Fatal("Failed to decode AndroidManifest.xml: ", err)
+	}
+	report := listPermissions(elements)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Printf("%s requests %d permissions:\n", report.Package, len(report.Requested))
+	for _, p := range report.Requested {
+		var notes []string
+		if p.Dangerous {
+			notes = append(notes, "DANGEROUS")
+		}
+		if p.MaxSdkVersion != "" {
+			notes = append(notes, "up to API "+p.MaxSdkVersion)
+		}
+		if p.SDK23 {
+			notes = append(notes, "API 23+")
+		}
+		fmt.Printf("  %-60s %s\n", p.Name, strings.Join(notes, ", "))
+	}
+	if len(report.Declared) > 0 {
+		fmt.Printf("and declares %d:\n", len(report.Declared))
+		for _, p := range report.Declared {
+			fmt.Printf("  %-60s %s\n", p.Name, p.ProtectionLevel)
+		}
+	}
+}
+
+// linkReport is the output of the links command. Verification is the
+// device's domain verification state of each host, when a device running
+// Android 12+ was connected.
+type linkReport struct {
+	Package      string            `json:"package"`
+	Links        []linkFilter      `json:"links"`
+	Verification map[string]string `json:"verification,omitempty"`
+}
+
+// linkFilter is an intent filter of an activity that handles ACTION_VIEW.
+// Its data elements combine: any scheme with any host and any path.
+type linkFilter struct {
+	Activity   string   `json:"activity"`
+	Exported   string   `json:"exported,omitempty"`
+	Browsable  bool     `json:"browsable"`
+	AutoVerify bool     `json:"autoVerify"`
+	Schemes    []string `json:"schemes"`
+	Hosts      []string `json:"hosts,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+	Commands   []string `json:"commands"`
+}
+
+func linksCommand(args []string) {
+	flags := flag.NewFlagSet("links", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the links as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: go run debugAPK.go links [-json] <APK_FILE>")
+		os.Exit(1)
+	}
+
+	data, err := readZipEntry(flags.Arg(0), "AndroidManifest.xml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		log.Fatal("Failed to decode AndroidManifest.xml: ", err)
+	}
+	report := listLinks(elements)
+	report.Verification = appLinkStates(report.Package)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	fmt.Printf("%s declares %d link intent filters:\n", report.Package, len(report.Links))
+	for _, l := range report.Links {
+		var notes []string
+		if l.Browsable {
+			notes = append(notes, "browsable")
+		}
+		if l.AutoVerify {
+			notes = append(notes, "autoVerify")
+		}
+		if l.Exported == "false" {
+			notes = append(notes, "not exported")
+		}
+		fmt.Printf("  %s (%s)\n", l.Activity, strings.Join(notes, ", "))
+		fmt.Printf("    schemes: %s\n", strings.Join(l.Schemes, " "))
+		for _, host := range l.Hosts {
+			state := ""
+			if s, ok := report.Verification[strings.SplitN(host, ":", 2)[0]]; ok {
+				state = " (" + s + ")"
+			}
+			fmt.Printf("    host:    %s%s\n", host, state)
+		}
+		for _, p := range l.Paths {
+			fmt.Printf("    path:    %s\n", p)
+		}
+		for _, c := range l.Commands {
+			fmt.Printf("    %s\n", c)
+		}
+	}
+}
+
+// listLinks collects the ACTION_VIEW intent filters with a data scheme of
+// the activities and activity aliases in a binary manifest.
+func listLinks(elements []axmlElement) *linkReport {
+	report := &linkReport{Links: []linkFilter{}}
+	var activity, exported string
+	var filter *linkFilter
+	var filterPath string
+	view := false
+	flush := func() {
+		if filter != nil && view && len(filter.Schemes) > 0 {
+			filter.Commands = linkCommands(report.Package, filter)
+			report.Links = append(report.Links, *filter)
+		}
+		filter, view = nil, false
+	}
+	for _, el := range elements {
+		switch {
+		case el.path == "manifest":
+			for _, a := range el.attrs {
+				if a.ns == "" && a.name == "package" {
+					report.Package = a.value
+				}
+			}
+		case el.path == "manifest/application/activity" || el.path == "manifest/application/activity-alias":
+			flush()
+			name, _ := el.attr("name")
+			activity = resolveClassName(report.Package, name)
+			exported, _ = el.attr("exported")
+		case el.depth <= 2:
+			// A service, receiver or provider: its intent filters aren't links.
+			flush()
+		case el.name == "intent-filter" && (strings.HasSuffix(el.path, "/activity/intent-filter") || strings.HasSuffix(el.path, "/activity-alias/intent-filter")):
+			flush()
+			autoVerify, _ := el.attr("autoVerify")
+			filter = &linkFilter{Activity: activity, Exported: exported, AutoVerify: autoVerify == "true", Schemes: []string{}}
+			filterPath = el.path
+		case filter != nil && path.Dir(el.path) == filterPath:
+			name, _ := el.attr("name")
+			switch el.name {
+			case "action":
+				view = view || name == "android.intent.action.VIEW"
+			case "category":
+				filter.Browsable = filter.Browsable || name == "android.intent.category.BROWSABLE"
+			case "data":
+				filter.addData(el)
+			}
+		}
+	}
+	flush()
+	return report
+}
+
+func (f *linkFilter) addData(el axmlElement) {
+	add := func(list *[]string, value string) {
+		for _, v := range *list {
+			if v == value {
+				return
+			}
+		}
+		*list = append(*list, value)
+	}
+	if scheme, ok := el.attr("scheme"); ok {
+		add(&f.Schemes, scheme)
+	}
+	if host, ok := el.attr("host"); ok {
+		if port, ok := el.attr("port"); ok {
+			host += ":" + port
+		}
+		add(&f.Hosts, host)
+	}
+	if p, ok := el.attr("path"); ok {
+		add(&f.Paths, p)
+	}
+	if p, ok := el.attr("pathPrefix"); ok {
+		add(&f.Paths, p+"*")
+	}
+	if p, ok := el.attr("pathPattern"); ok {
+		add(&f.Paths, "pattern "+p)
+	}
+}
+
+// linkCommands are am start commands that open an example URL of each
+// scheme, host and path of f in pkg. Wildcards in hosts and paths are
+// filled in with "example".
+func linkCommands(pkg string, f *linkFilter) []string {
+	hosts, paths := f.Hosts, f.Paths
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	var commands []string
+	for _, scheme := range f.Schemes {
+		for _, host := range hosts {
+			host = strings.Replace(host, "*", "example", 1)
+			for _, p := range paths {
+				p = strings.TrimPrefix(p, "pattern ")
+				p = strings.NewReplacer(".*", "example", "*", "", "\\", "").Replace(p)
+				url := scheme + "://" + host + p
+				commands = append(commands, fmt.Sprintf("adb shell am start -a android.intent.action.VIEW -d '%s' %s", url, pkg))
+			}
+		}
+	}
+	return commands
+}
+
+var appLinkStatePattern = regexp.MustCompile(`^\s+(\S+): (\S+)$`)
+
+// appLinkStates reads the domain verification state of pkg's hosts from
+// the connected device with pm get-app-links, which needs Android 12+. It's
+// nil without a device, or when it can't tell.
+func appLinkStates(pkg string) map[string]string {
+	if _, err := exec.LookPath("adb"); err != nil {
+		return nil
+	}
+	// Not selectDevice: that waits for a device to show up.
+	serial := os.Getenv("ANDROID_SERIAL")
+	if devices, err := connectedDevices(); err != nil || len(devices) == 0 || serial == "" && len(devices) > 1 {
+		return nil
+	} else if serial == "" {
+		serial = devices[0]
+	}
+	output, err := adb(serial, "shell", "pm", "get-app-links", pkg)
+	if err != nil {
+		return nil
+	}
+
+	var states map[string]string
+	inState := false
+	for _, line := range strings.Split(strings.ReplaceAll(string(output), "\r", ""), "\n") {
+		if strings.TrimSpace(line) == "Domain verification state:" {
+			inState = true
+			continue
+		}
+		m := appLinkStatePattern.FindStringSubmatch(line)
+		if !inState || m == nil {
+			inState = false
+			continue
+		}
+		if states == nil {
+			states = map[string]string{}
+		}
+		states[m[1]] = m[2]
+	}
+	return states
+}
+
+// nativeLib is a lib/<abi>/*.so of an APK, as the libs command lists it.
+// Alignment is the largest power of two, up to 64K, the offset of its data
+// in the APK is a multiple of; a stored library has to be page aligned to
+// be loaded from the APK.
+type nativeLib struct {
+	Path           string `json:"path"`
+	ABI            string `json:"abi"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize"`
+	Stored         bool   `json:"stored"`
+	Offset         int64  `json:"offset"`
+	Alignment      int64  `json:"alignment"`
+	Machine        string `json:"machine,omitempty"` // the ABI of the ELF machine type
+	Mislabeled     bool   `json:"mislabeled,omitempty"`
+	Stripped       bool   `json:"stripped"`
+	NDK            string `json:"ndk,omitempty"`
+	Comment        string `json:"comment,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func libsCommand(args []string) {
+	flags := flag.NewFlagSet("libs", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the libraries as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: go run debugAPK.go libs [-json] <APK_FILE>")
+		os.Exit(1)
+	}
+
+	libs, err := listNativeLibs(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(libs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(libs) == 0 {
+		fmt.Println("The APK has no native libraries.")
+		return
+	}
+	for _, l := range libs {
+		compression := fmt.Sprintf("deflated to %s", formatBytes(l.CompressedSize))
+		if l.Stored {
+			compression = fmt.Sprintf("stored, %d-byte aligned", l.Alignment)
+		}
+		fmt.Printf("%s  %s, %s\n", l.Path, formatBytes(l.Size), compression)
+		if l.Error != "" {
+			fmt.Println("  ", l.Error)
+			continue
+		}
+		var notes []string
+		if l.Mislabeled {
+			notes = append(notes, "MISLABELED: built for "+l.Machine)
+		}
+		if l.Stripped {
+			notes = append(notes, "stripped")
+		} else {
+			notes = append(notes, "not stripped")
+		}
+		if l.NDK != "" {
+			notes = append(notes, "NDK "+l.NDK)
+		}
+		if l.Stored && l.Alignment < 4096 {
+			notes = append(notes, "NOT PAGE ALIGNED")
+		}
+		fmt.Println("  ", strings.Join(notes, ", "))
+		if l.Comment != "" {
+			fmt.Println("  ", l.Comment)
+		}
+	}
+}
+
+// elfMachineABIs maps ELF machine types to the ABI whose libraries have it.
+// Both 32-bit ARM ABIs are EM_ARM.
+var elfMachineABIs = map[uint16]string{
+	3:   "x86",
+	8:   "mips",
+	40:  "armeabi-v7a",
+	62:  "x86_64",
+	183: "arm64-v8a",
+	243: "riscv64",
+}
+
+// listNativeLibs reads the native libraries of apk straight from the zip:
+// stored ones in place, deflated ones into memory.
+func listNativeLibs(apk string) ([]nativeLib, error) {
+	f, err := os.Open(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	libs := []nativeLib{}
+	for _, zf := range r.File {
+		parts := strings.Split(zf.Name, "/")
+		if len(parts) != 3 || parts[0] != "lib" || !strings.HasSuffix(parts[2], ".so") {
+			continue
+		}
+		lib := nativeLib{
+			Path:           zf.Name,
+			ABI:            parts[1],
+			Size:           int64(zf.UncompressedSize64),
+			CompressedSize: int64(zf.CompressedSize64),
+			Stored:         zf.Method == zip.Store,
+		}
+		if lib.Offset, err = zf.DataOffset(); err != nil {
+			return nil, fmt.Errorf("%s: %v", zf.Name, err)
+		}
+		for lib.Alignment = 1; lib.Alignment < 1<<16 && lib.Offset%(lib.Alignment*2) == 0; lib.Alignment *= 2 {
+		}
+
+		var data io.ReaderAt
+		if lib.Stored {
+			data = io.NewSectionReader(f, lib.Offset, lib.Size)
+		} else {
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", zf.Name, err)
+			}
+			content, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", zf.Name, err)
+			}
+			data = bytes.NewReader(content)
+		}
+		if err := lib.readELF(data); err != nil {
+			lib.Error = "not a valid ELF file: " + err.Error()
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// readELF reads the machine type and the sections of an ELF file, as far
+// as the libs command needs them: .symtab is gone from stripped libraries,
+// .comment holds the compiler version and .note.android.ident the NDK
+// release.
+func (l *nativeLib) readELF(r io.ReaderAt) error {
+	ident := make([]byte, 64)
+	if _, err := r.ReadAt(ident, 0); err == io.EOF {
+		return errors.New("too short for an ELF header")
+	} else if err != nil {
+		return err
+	}
+	if string(ident[:4]) != "\x7fELF" {
+		return errors.New("no ELF magic")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if ident[5] == 2 {
+		order = binary.BigEndian
+	}
+
+	var shoff int64
+	var shentsize, shnum, shstrndx int
+	switch ident[4] {
+	case 1:
+		shoff = int64(order.Uint32(ident[32:]))
+		shentsize, shnum, shstrndx = int(order.Uint16(ident[46:])), int(order.Uint16(ident[48:])), int(order.Uint16(ident[50:]))
+	case 2:
+		shoff = int64(order.Uint64(ident[40:]))
+		shentsize, shnum, shstrndx = int(order.Uint16(ident[58:])), int(order.Uint16(ident[60:])), int(order.Uint16(ident[62:]))
+	default:
+		return fmt.Errorf("unknown ELF class %d", ident[4])
+	}
+	machine := order.Uint16(ident[18:])
+	if abi, ok := elfMachineABIs[machine]; ok {
+		l.Machine = abi
+		l.Mislabeled = abi != l.ABI && !(abi == "armeabi-v7a" && l.ABI == "armeabi") && !(abi == "mips" && l.ABI == "mips64")
+	} else {
+		l.Machine = fmt.Sprintf("machine %d", machine)
+		l.Mislabeled = true
+	}
+	if shnum == 0 || shstrndx >= shnum || shentsize < 40 || shnum > 4096 {
+		l.Stripped = true
+		return nil
+	}
+
+	headers := make([]byte, shnum*shentsize)
+	if _, err := r.ReadAt(headers, shoff); err != nil {
+		return fmt.Errorf("section headers: %v", err)
+	}
+	// section returns the name offset, file offset and size of a section.
+	section := func(i int) (uint32, int64, int64) {
+		h := headers[i*shentsize:]
+		if ident[4] == 1 {
+			return order.Uint32(h), int64(order.Uint32(h[16:])), int64(order.Uint32(h[20:]))
+		}
+		return order.Uint32(h), int64(order.Uint64(h[24:])), int64(order.Uint64(h[32:]))
+	}
+	read := func(offset, size int64) []byte {
+		if size <= 0 || size > 1<<20 {
+			return nil
+		}
+		b := make([]byte, size)
+		if _, err := r.ReadAt(b, offset); err != nil {
+			return nil
+		}
+		return b
+	}
+	_, off, size := section(shstrndx)
+	names := read(off, size)
+
+	l.Stripped = true
+	for i := 0; i < shnum; i++ {
+		nameOff, off, size := section(i)
+		if int(nameOff) >= len(names) {
+			continue
+		}
+		name := names[nameOff:]
+		if n := bytes.IndexByte(name, 0); n >= 0 {
+			name = name[:n]
+		}
+		switch string(name) {
+		case ".symtab":
+			l.Stripped = false
+		case ".comment":
+			if comment := read(off, size); comment != nil {
+				l.Comment = strings.TrimSpace(string(bytes.SplitN(bytes.TrimLeft(comment, "\x00"), []byte{0}, 2)[0]))
+			}
+		case ".note.android.ident":
+			l.NDK = androidNoteNDK(read(off, size), order)
+		}
+	}
+	return nil
+}
+
+// androidNoteNDK reads the NDK release, e.g. "r25c", from an
+// .note.android.ident section: a note named "Android" whose descriptor is
+// the API level and, since r14, the NDK version and build number as
+// NUL-padded 64-byte strings.
+func androidNoteNDK(note []byte, order binary.ByteOrder) string {
+	if len(note) < 12 {
+		return ""
+	}
+	namesz, descsz := int(order.Uint32(note)), int(order.Uint32(note[4:]))
+	desc := 12 + (namesz+3)&^3
+	if desc+descsz > len(note) || descsz < 4+64 {
+		return ""
+	}
+	version := note[desc+4 : desc+4+64]
+	if n := bytes.IndexByte(version, 0); n >= 0 {
+		version = version[:n]
+	}
+	return string(version)
+}
+
+// listPermissions collects the uses-permission and permission elements of
+// a decoded manifest. A permission the app declares dangerous itself counts
+// as such when it requests it too.
+func listPermissions(elements []axmlElement) *permissionReport {
+	report := &permissionReport{Requested: []requestedPermission{}, Declared: []declaredPermission{}}
+	for _, el := range elements {
+		name, _ := el.attr("name")
+		switch el.path {
+		case "manifest":
+			for _, a := range el.attrs {
+				if a.ns == "" && a.name == "package" {
+					report.Package = a.value
+				}
+			}
+		case "manifest/uses-permission", "manifest/uses-permission-sdk-23":
+			max, _ := el.attr("maxSdkVersion")
+			report.Requested = append(report.Requested, requestedPermission{
+				Name:          name,
+				Dangerous:     dangerousPermissions[name],
+				MaxSdkVersion: max,
+				SDK23:         el.name == "uses-permission-sdk-23",
+			})
+		case "manifest/permission":
+			level := "normal"
+			if value, ok := el.attr("protectionLevel"); ok {
+				level = value
+				if n, err := strconv.ParseUint(value, 0, 32); err == nil && int(n&0xf) < len(protectionLevels) {
+					level = protectionLevels[n&0xf]
+				}
+			}
+			report.Declared = append(report.Declared, declaredPermission{Name: name, ProtectionLevel: level, Dangerous: level == "dangerous"})
+		}
+	}
+
+	for i, p := range report.Requested {
+		for _, d := range report.Declared {
+			if d.Name == p.Name && d.Dangerous {
+				report.Requested[i].Dangerous = true
+			}
+		}
+	}
+	return report
+}
+
+// resolveReferences replaces the references to the app's own resources with
+// their values. Framework resources aren't in the table and stay as IDs.
+func resolveReferences(elements []axmlElement, table *resourceTable) {
+	for _, el := range elements {
+		for i, a := range el.attrs {
+			if a.dataType != typeReference {
+				continue
+			}
+			if value, ok := table.resolve(a.data); ok {
+				el.attrs[i].value = value
+			}
+		}
+	}
+}
+
+// writeAXML prints decoded elements as indented XML.
+func writeAXML(w io.Writer, elements []axmlElement) {
+	// Obfuscators sometimes drop the namespace declarations.
+	prefixes := map[string]string{androidNS: "android"}
+	var open []string
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="utf-8"?>`)
+	for i, el := range elements {
+		for len(open) > el.depth {
+			fmt.Fprintf(w, "%s</%s>\n", strings.Repeat("    ", len(open)-1), open[len(open)-1])
+			open = open[:len(open)-1]
+		}
+
+		fmt.Fprintf(w, "%s<%s", strings.Repeat("    ", el.depth), el.name)
+		for _, ns := range el.namespaces {
+			prefixes[ns.uri] = ns.prefix
+			fmt.Fprintf(w, ` xmlns:%s="%s"`, ns.prefix, escapeAttr(ns.uri))
+		}
+		for _, a := range el.attrs {
+			name := a.name
+			if prefix, ok := prefixes[a.ns]; ok && a.ns != "" {
+				name = prefix + ":" + name
+			}
+			fmt.Fprintf(w, ` %s="%s"`, name, escapeAttr(a.value))
+		}
+
+		if i+1 < len(elements) && elements[i+1].depth > el.depth {
+			fmt.Fprintln(w, ">")
+			open = append(open, el.name)
+		} else {
+			fmt.Fprintln(w, "/>")
+		}
+	}
+	for len(open) > 0 {
+		fmt.Fprintf(w, "%s</%s>\n", strings.Repeat("    ", len(open)-1), open[len(open)-1])
+		open = open[:len(open)-1]
+	}
+}
+
+// manifestSummary is the -format json output of the manifest command.
+type manifestSummary struct {
+	Package     string              `json:"package"`
+	Attributes  map[string]string   `json:"attributes"`
+	UsesSdk     map[string]string   `json:"usesSdk,omitempty"`
+	Permissions []string            `json:"permissions"`
+	Application map[string]string   `json:"application,omitempty"`
+	Components  []manifestComponent `json:"components"`
+}
+
+type manifestComponent struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes"`
+	Actions    []string          `json:"actions,omitempty"`
+}
+
+func summarizeManifest(elements []axmlElement) *manifestSummary {
+	attrs := func(el axmlElement) map[string]string {
+		m := map[string]string{}
+		for _, a := range el.attrs {
+			name := a.name
+			if a.ns == androidNS {
+				name = "android:" + name
+			}
+			m[name] = a.value
+		}
+		return m
+	}
+
+	summary := &manifestSummary{Permissions: []string{}, Components: []manifestComponent{}}
+	var component *manifestComponent
+	for _, el := range elements {
+		switch {
+		case el.path == "manifest":
+			summary.Attributes = attrs(el)
+			summary.Package = summary.Attributes["package"]
+		case el.path == "manifest/uses-sdk":
+			summary.UsesSdk = attrs(el)
+		case el.path == "manifest/uses-permission" || el.path == "manifest/uses-permission-sdk-23":
+			if name, ok := el.attr("name"); ok {
+				summary.Permissions = append(summary.Permissions, name)
+			}
+		case el.path == "manifest/application":
+			summary.Application = attrs(el)
+		case isComponent(el.path):
+			name, _ := el.attr("name")
+			summary.Components = append(summary.Components, manifestComponent{
+				Type:       el.name,
+				Name:       resolveClassName(summary.Package, name),
+				Attributes: attrs(el),
+			})
+			component = &summary.Components[len(summary.Components)-1]
+		case el.name == "action" && strings.HasSuffix(path.Dir(el.path), "/intent-filter") && component != nil:
+			if name, ok := el.attr("name"); ok {
+				component.Actions = append(component.Actions, name)
+			}
+		}
+	}
+	return summary
+}
+
+// verifyInstrumentation checks that the instrumentation made it into the
+// binary manifest of the rebuilt APK.
+func verifyInstrumentation(apk string, in *instrumentation) error {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	for _, el := range elements {
+		name, _ := el.attr("name")
+		if el.path == "manifest/instrumentation" && name == in.runner {
+			if target, _ := el.attr("targetPackage"); target != in.target {
+				return fmt.Errorf("the rebuilt manifest has the instrumentation %s target %q, not %q", in.runner, target, in.target)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("the rebuilt manifest lost the instrumentation %s", in.runner)
+}
+
+// verifyProvider checks that the manifest of a rebuilt APK declares the
+// injected provider with its authority.
+func verifyProvider(apk string, p *injectedProvider) error {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	for _, el := range elements {
+		name, _ := el.attr("name")
+		if el.path == "manifest/application/provider" && name == p.Class {
+			if authorities, _ := el.attr("authorities"); authorities != p.Authority {
+				return fmt.Errorf("the rebuilt manifest has the provider %s authorities %q, not %q", p.Class, authorities, p.Authority)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("the rebuilt manifest lost the provider %s", p.Class)
+}
+
+// verifyRemovedComponents checks that the manifest of a rebuilt APK no
+// longer declares the removed components.
+func verifyRemovedComponents(apk, pkg string, classes []string) error {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+
+	for _, el := range elements {
+		name, ok := el.attr("name")
+		if !ok || !isComponent(el.path) {
+			continue
+		}
+		for _, class := range classes {
+			if resolveClassName(pkg, name) == class {
+				return fmt.Errorf("%s is still declared in the rebuilt manifest", class)
+			}
+		}
+	}
+	return nil
+}
+
+// verifyDebuggable checks that the rebuilt manifest of apk has the
+// android:debuggable the patch stage set.
+func verifyDebuggable(apk string, want bool) error {
+	data, err := readZipEntry(apk, "AndroidManifest.xml")
+	if err != nil {
+		return err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+
+	for _, el := range elements {
+		if el.path == "manifest/application" {
+			if got, _ := el.attr("debuggable"); got != strconv.FormatBool(want) {
+				return fmt.Errorf("the rebuilt manifest has android:debuggable=%q, not %q", got, strconv.FormatBool(want))
+			}
+			return nil
+		}
+	}
+	return errors.New("the rebuilt manifest has no <application>")
+}
+
+// installCommand is the adb command line that installs apk on a device,
+// with the installArgs the install stage uses.
+func installCommand(apk string) (string, error) {
+	install, err := installArgs(apk)
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{"adb", "-s", "<SERIAL>", "install"}, install...)
+	return strings.Join(append(args, hostArg(apk)), " "), nil
+}
+
+var installUserPattern = regexp.MustCompile(`^([0-9]+|current|all)$`)
+
+// installArgs are the options of adb install, install-multiple and pm
+// install-create for the app of base, the base APK of a split set: -r to
+// replace it, -t when its manifest marks it testOnly, and --user with
+// -install-user.
+func installArgs(base string) ([]string, error) {
+	data, err := readZipEntry(base, "AndroidManifest.xml")
+	if err != nil {
+		return nil, err
+	}
+	elements, err := decodeAXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+
+	args := []string{"-r"}
+	for _, el := range elements {
+		if testOnly, _ := el.attr("testOnly"); el.path == "manifest/application" && testOnly == "true" {
+			args = append(args, "-t")
+		}
+	}
+	if installUser != "" {
+		args = append(args, "--user", installUser)
+	}
+	return args, nil
+}
+
+var (
+	smaliClassPattern     = regexp.MustCompile(`^\.class\b.*\s(L[^;\s]+;)`)
+	smaliMethodPattern    = regexp.MustCompile(`^\.method\b.*\s(\S+\([^)]*\)\S+)`)
+	smaliMethodRefPattern = regexp.MustCompile(`L[^;\s]+;->[^(\s]+\([^)]*\)\S+`)
+)
+
+// smaliMethodCounts estimates the method references each dex of a decoded
+// app will hold, keyed by dex name: the smali directory becomes the dex
+// ("smali" is classes.dex, "smali_classes2" is classes2.dex) and each
+// distinct method defined or invoked in it counts once.
+func smaliMethodCounts(appDir string) (map[string]int, error) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "smali*"))
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, dir := range dirs {
+		dex := strings.TrimPrefix(filepath.Base(dir), "smali")
+		if dex != "" && !strings.HasPrefix(dex, "_classes") {
+			continue
+		}
+		dex = "classes" + strings.TrimPrefix(dex, "_classes") + ".dex"
+
+		methods := map[string]bool{}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(path, ".smali") {
+				return err
+			}
+			return smaliMethods(path, methods)
+		})
+		if err != nil {
+			return nil, err
+		}
+		counts[dex] = len(methods)
+	}
+	return counts, nil
+}
+
+// smaliMethods adds the methods a smali file defines or references.
+func smaliMethods(path string, methods map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	class := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := smaliClassPattern.FindStringSubmatch(line); m != nil {
+			class = m[1]
+		} else if m := smaliMethodPattern.FindStringSubmatch(line); m != nil {
+			methods[class+"->"+m[1]] = true
+		} else if strings.HasPrefix(line, "invoke-") {
+			for _, ref := range smaliMethodRefPattern.FindAllString(line, -1) {
+				methods[ref] = true
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// secretPattern is a kind of secret -scan-secrets looks for. Matches of
+// group 1 (or of all of the pattern) with less than minEntropy bits of
+// Shannon entropy per character are placeholders like "xxxx" or
+// "password" and skipped, as are those valid, when set, rejects.
+type secretPattern struct {
+	name       string
+	re         *regexp.Regexp
+	minEntropy float64
+	valid      func(secret string) bool
+}
+
+var secretPatterns = []secretPattern{
+	{"google-api-key", regexp.MustCompile(`AIza[0-9A-Za-z_\-]{35}`), 3.5, nil},
+	{"aws-access-key-id", regexp.MustCompile(`\b(?:AKIA|ASIA)([0-9A-Z]{16})\b`), 3, nil},
+	{"firebase-url", regexp.MustCompile(`https://[a-z0-9-]+\.(?:firebaseio\.com|firebasedatabase\.app)`), 0, nil},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.([A-Za-z0-9_-]{16,})`), 3.5, nil},
+	{"private-key", regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`), 0, nil},
+	{"basic-auth-url", regexp.MustCompile(`\bhttps?://[^\s/:@"'<>]+:([^\s/:@"'<>]{4,})@[A-Za-z0-9.-]+`), 2.5, nil},
+	{"basic-auth-header", regexp.MustCompile(`\bBasic ([A-Za-z0-9+/]{12,}={0,2})`), 3, basicCredentials},
+}
+
+// basicCredentials reports whether s is what an Authorization: Basic header
+// carries, a base64 "user:password", rather than a word like
+// "authentication" following "Basic" in some text.
+func basicCredentials(s string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && bytes.IndexByte(decoded, ':') > 0
+}
+
+// Bounds of -scan-secrets on huge apps: bigger files are skipped, and the
+// scan stops after this many findings or bytes.
+const (
+	secretsMaxFileSize = 4 << 20
+	secretsMaxBytes    = 512 << 20
+	secretsMaxFindings = 500
+)
+
+// secretFinding is a possible secret, with the match redacted so the report
+// doesn't spread it further. Line is 1-based.
+type secretFinding struct {
+	Type  string `json:"type"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Match string `json:"match"`
+}
+
+// findSecrets scans the text files under res/, assets/ and the root of a
+// decoded app, and the const-string instructions of its smali, for
+// secretPatterns.
+func findSecrets(appDir string) ([]secretFinding, error) {
+	var findings []secretFinding
+	var scanned int64
+	errStop := errors.New("stop")
+	err := filepath.Walk(appDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(appDir, path)
+		rel = filepath.ToSlash(rel)
+		top := strings.SplitN(rel, "/", 2)[0]
+		smali := strings.HasPrefix(top, "smali")
+		if info.IsDir() {
+			if path != appDir && top != "res" && top != "assets" && !smali {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() > secretsMaxFileSize || rel == "apktool.yml" {
+			return nil
+		}
+		if scanned += info.Size(); scanned > secretsMaxBytes || len(findings) >= secretsMaxFindings {
+			return errStop
+		}
+		found, err := fileSecrets(path, rel, smali)
+		findings = append(findings, found...)
+		return err
+	})
+	if err == errStop {
+		fmt.Println("WARNING: stopped the secrets scan early, the app is too big to scan in full")
+		err = nil
+	}
+	if len(findings) > secretsMaxFindings {
+		findings = findings[:secretsMaxFindings]
+	}
+	return findings, err
+}
+
+// fileSecrets scans one file, reported as rel. Files with a NUL byte in
+// their first 8KB are binary and skipped; in smali only the string
+// constants are scanned.
+func fileSecrets(path, rel string, smali bool) ([]secretFinding, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	head := data
+	if len(head) > 8192 {
+		head = head[:8192]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []secretFinding
+	for i, line := range strings.Split(string(data), "\n") {
+		if smali && !strings.HasPrefix(strings.TrimSpace(line), "const-string") {
+			continue
+		}
+		for _, p := range secretPatterns {
+			for _, m := range p.re.FindAllStringSubmatch(line, -1) {
+				secret := m[0]
+				if len(m) > 1 {
+					secret = m[1]
+				}
+				if shannonEntropy(secret) < p.minEntropy || (p.valid != nil && !p.valid(secret)) {
+					continue
+				}
+				findings = append(findings, secretFinding{Type: p.name, File: rel, Line: i + 1, Match: redactSecret(m[0])})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// shannonEntropy is the entropy of s in bits per character.
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	var h float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// redactSecret keeps enough of a match to find and recognize it again.
+// Private key headers and Firebase URLs aren't secret themselves and are
+// kept whole.
+func redactSecret(s string) string {
+	if strings.HasPrefix(s, "-----BEGIN") || strings.HasPrefix(s, "https://") && !strings.Contains(s, "@") {
+		return s
+	}
+	if len(s) <= 12 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:6] + strings.Repeat("*", len(s)-10) + s[len(s)-4:]
+}
+
+// writeSecretsSARIF writes findings as a SARIF 2.1.0 log, with a rule for
+// each kind of secret.
+func writeSecretsSARIF(path string, findings []secretFinding) error {
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region struct {
+				StartLine int `json:"startLine"`
+			} `json:"region"`
+		} `json:"physicalLocation"`
+	}
+	type message struct {
+		Text string `json:"text"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	type rule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+
+	var rules []rule
+	for _, p := range secretPatterns {
+		rules = append(rules, rule{ID: p.name, ShortDescription: message{"Possible hardcoded " + strings.ReplaceAll(p.name, "-", " ")}})
+	}
+	results := []result{}
+	for _, f := range findings {
+		var loc location
+		loc.PhysicalLocation.ArtifactLocation.URI = f.File
+		loc.PhysicalLocation.Region.StartLine = f.Line
+		results = append(results, result{RuleID: f.Type, Level: "warning", Message: message{f.Match}, Locations: []location{loc}})
+	}
+
+	type driver struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		Rules   []rule `json:"rules"`
+	}
+	type run struct {
+		Tool struct {
+			Driver driver `json:"driver"`
+		} `json:"tool"`
+		Results []result `json:"results"`
+	}
+	r := run{Results: results}
+	r.Tool.Driver = driver{Name: "debugAPK", Version: version, Rules: rules}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs":    []run{r},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+var doNotCompressPattern = regexp.MustCompile(`(?m)^doNotCompress:[ \t]*\r?\n((?:- .*\r?\n?)*)`)
+
+// keepLibsStored makes sure apktool stores the native libraries
+// uncompressed again when the input APK has them stored, as apps with
+// extractNativeLibs="false" need: it adds so to the doNotCompress list of
+// apktool.yml when the libraries aren't all in it already. It reports
+// whether it did.
+func keepLibsStored(apk, appDir string) (bool, error) {
+	libs, err := listNativeLibs(apk)
+	if err != nil {
+		return false, err
+	}
+	var stored []string
+	for _, lib := range libs {
+		if lib.Stored {
+			stored = append(stored, lib.Path)
+		}
+	}
+	if len(stored) == 0 {
+		return false, nil
+	}
+
+	path := filepath.Join(appDir, "apktool.yml")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	m := doNotCompressPattern.FindSubmatchIndex(data)
+	if m == nil {
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		return true, ioutil.WriteFile(path, append(data, "doNotCompress:\n- so\n"...), 0644)
+	}
+	listed := map[string]bool{}
+	for _, line := range strings.Split(string(data[m[2]:m[3]]), "\n") {
+		listed[strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "- ")), `'"`)] = true
+	}
+	if listed["so"] || listed[".so"] {
+		return false, nil
+	}
+	missing := false
+	for _, lib := range stored {
+		missing = missing || !listed[lib]
+	}
+	if !missing {
+		return false, nil
+	}
+	entries := string(data[m[2]:m[3]])
+	if entries != "" && !strings.HasSuffix(entries, "\n") {
+		entries += "\n"
+	}
+	edited := append(append([]byte{}, data[:m[2]]...), entries+"- so\n"...)
+	return true, ioutil.WriteFile(path, append(edited, data[m[3]:]...), 0644)
+}
+
+// verifyLibCompression checks that the native libraries stored in the
+// input are still stored in the output, and page aligned: an app with
+// extractNativeLibs="false" loads them straight from the APK, and can't if
+// they're compressed. Libraries the input had compressed end up stored as
+// well, which only costs size.
+func verifyLibCompression(in, out string) error {
+	before, err := listNativeLibs(in)
+	if err != nil || len(before) == 0 {
+		return err
+	}
+	after, err := listNativeLibs(out)
+	if err != nil {
+		return err
+	}
+	output := map[string]nativeLib{}
+	for _, lib := range after {
+		output[lib.Path] = lib
+	}
+	uncompressed := 0
+	for _, lib := range before {
+		if !lib.Stored {
+			if got, ok := output[lib.Path]; ok && got.Stored {
+				uncompressed++
+			}
+			continue
+		}
+		got, ok := output[lib.Path]
+		switch {
+		case !ok:
+			return fmt.Errorf("the rebuilt APK lost %s", lib.Path)
+		case !got.Stored:
+			return fmt.Errorf("%s is stored uncompressed in the input but compressed in the rebuilt APK, the app can't load it with extractNativeLibs=\"false\"", lib.Path)
+		case got.Offset%4096 != 0:
+			return fmt.Errorf("%s is not 4 KiB aligned in the rebuilt APK, the app can't load it with extractNativeLibs=\"false\"", lib.Path)
+		}
+	}
+	if uncompressed > 0 {
+		fmt.Printf("%d of the input's %d native libraries were compressed, they're stored uncompressed now\n", uncompressed, len(before))
+	}
+	return nil
+}
+
+var targetSdkPattern = regexp.MustCompile(`(?m)^\s*targetSdkVersion:\s*'?(\d+)'?`)
+
+// targetSdkVersion reads the target SDK apktool recorded in apktool.yml, or
+// returns 0 when it's unknown.
+func targetSdkVersion(appDir string) int {
+	data, err := ioutil.ReadFile(filepath.Join(appDir, "apktool.yml"))
+	if err != nil {
+		return 0
+	}
+	m := targetSdkPattern.FindSubmatch(data)
+	if m == nil {
+		return 0
+	}
+	sdk, _ := strconv.Atoi(string(m[1]))
+	return sdk
+}
+
+// signingConfig names the keystore entry used to sign the debug APK, using
+// the same fields as a Gradle signingConfig.
+type signingConfig struct {
+	storeFile     string
+	storePassword string
+	keyAlias      string
+	keyPassword   string
+
+	// storeType is the -ks-type, "" to let the tools detect it. A pkcs11
+	// store has no file: storeFile is NONE and providerArg is the
+	// -pkcs11-config.
+	storeType   string
+	providerArg string
+	// cert is the certificate of the key, and chain its certificate chain,
+	// when they were read from the store.
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	// next are the -next-signer keys, which sign after this one.
+	next []*signingConfig
+}
+
+// passwordFiles writes each password to a file of its own for keytool,
+// jarsigner or apksigner to read it from, never their command line, which
+// ps shows to every user, nor their environment, which their children
+// inherit. The files are 0600 in a 0700 directory, which remove deletes
+// once the tool is done.
+func passwordFiles(passwords ...string) (paths []string, remove func(), err error) {
+	dir, err := ioutil.TempDir("", "rsiw-pass-")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove = func() { os.RemoveAll(dir) }
+	for i, password := range passwords {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+			remove()
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, remove, nil
+}
+
+// keytoolPasswordArgs are the keytool or jarsigner options reading the
+// store password of s, and its key password with withKey, from
+// passwordFiles.
+func (s *signingConfig) keytoolPasswordArgs(withKey bool) ([]string, func(), error) {
+	passwords := []string{s.storePassword}
+	if withKey {
+		passwords = append(passwords, s.keyPassword)
+	}
+	paths, remove, err := passwordFiles(passwords...)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{"-storepass:file", paths[0]}
+	if withKey {
+		args = append(args, "-keypass:file", paths[1])
+	}
+	return args, remove, nil
+}
+
+// pkcs11Provider is the JDK's PKCS#11 provider, configured with the
+// -pkcs11-config file.
+const pkcs11Provider = "sun.security.pkcs11.SunPKCS11"
+
+// keytoolArgs locates the store for keytool and jarsigner.
+func (s *signingConfig) keytoolArgs() []string {
+	args := []string{"-keystore", s.storeFile}
+	if s.storeType != "" {
+		args = append(args, "-storetype", strings.ToUpper(s.storeType))
+	}
+	if s.storeType == "pkcs11" {
+		args = append(args, "-providerClass", pkcs11Provider, "-providerArg", s.providerArg)
+	}
+	return args
+}
+
+// apksignerArgs locates the store for apksigner.
+func (s *signingConfig) apksignerArgs() []string {
+	args := []string{"--ks", s.storeFile}
+	if s.storeType != "" {
+		args = append(args, "--ks-type", strings.ToUpper(s.storeType))
+	}
+	if s.storeType == "pkcs11" {
+		args = append(args, "--provider-class", pkcs11Provider, "--provider-arg", s.providerArg)
+	}
+	return args
+}
+
+// debugSigningConfig is the throwaway key generated for every run when no
+// keystore is given.
+func debugSigningConfig(storeFile string) *signingConfig {
+	return &signingConfig{
+		storeFile:     storeFile,
+		storePassword: "password",
+		keyAlias:      "alias1",
+		keyPassword:   "password",
+	}
+}
+
+// loadSigningProps reads a keystore.properties/gradle.properties style file
+// with the storeFile, storePassword, keyAlias and keyPassword keys. A relative
+// storeFile is resolved against the directory of the properties file. keyAlias
+// may be left out when the keystore holds a single key.
+func loadSigningProps(path string) (*signingConfig, error) {
+	props, err := readProperties(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, key := range []string{"storeFile", "storePassword", "keyPassword"} {
+		if props[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: missing %s", path, strings.Join(missing, ", "))
+	}
+
+	storeFile := props["storeFile"]
+	if !filepath.IsAbs(storeFile) {
+		storeFile = filepath.Join(filepath.Dir(path), storeFile)
+	}
+	if !fileExists(storeFile) {
+		return nil, fmt.Errorf("%s: storeFile %s not found", path, storeFile)
+	}
+
+	return &signingConfig{
+		storeFile:     storeFile,
+		storePassword: props["storePassword"],
+		keyAlias:      props["keyAlias"],
+		keyPassword:   props["keyPassword"],
+	}, nil
+}
+
+// userSigningConfig returns the key given with -signing-props or -keystore,
+// or nil when a debug key should be generated. Its errors are exitErrors:
+// invalid options, a missing keystore, or a key that can't be unlocked.
+func userSigningConfig() (*signingConfig, error) {
+	switch {
+	case signingProps != "" && keystore != "":
+		return nil, &exitError{exitUsage, errors.New("-signing-props and -keystore can't be used together")}
+	case signingProps != "":
+		return propsSigningConfig(signingProps)
+	case keystore != "" || keystoreType != "":
+		return keystoreSigningConfig()
+	}
+
+	for _, name := range []string{"ks-alias", "storepass", "keypass", "pkcs11-config"} {
+		if isFlagSet(name) {
+			return nil, &exitError{exitUsage, fmt.Errorf("-%s has no effect without -keystore", name)}
+		}
+	}
+	return nil, nil
+}
+
+// propsSigningConfig returns the key described by a keystore.properties
+// file, once it's unlocked.
+func propsSigningConfig(path string) (*signingConfig, error) {
+	signing, err := loadSigningProps(path)
+	if err != nil {
+		return nil, &exitError{exitInput, fmt.Errorf("Failed to load signing properties: %v", err)}
+	}
+	warnReadable(path)
+	warnReadable(signing.storeFile)
+	entry, err := keystoreAlias(signing, signing.keyAlias)
+	if err != nil {
+		return nil, &exitError{exitSign, err}
+	}
+	signing.keyAlias, signing.cert, signing.chain = entry.Alias, entry.Cert, entry.Chain
+	if err := checkKeyPassword(signing); err != nil {
+		return nil, &exitError{exitSign, err}
+	}
+	return signing, nil
+}
+
+// loadNextSigners returns the -next-signer keys and those of the -keystore
+// options after the first, with the warnings about their certificates and
+// about the signature schemes several signers leave out.
+func loadNextSigners() ([]*signingConfig, []string, error) {
+	if hasNextSigners() && signerFor("apk") != "apksigner" {
+		return nil, nil, &exitError{exitMissingTool, errors.New("-next-signer and several -keystore need apksigner, jarsigner signs with one key")}
+	}
+	var signers []*signingConfig
+	var warnings []string
+	add := func(option string, signing *signingConfig, err error) error {
+		if err != nil {
+			return &exitError{exitCodeOf(err), fmt.Errorf("%s: %v", option, err)}
+		}
+		_, w, err := checkSigningChain(signing)
+		if err != nil {
+			return &exitError{exitSign, fmt.Errorf("%s: %v", option, err)}
+		}
+		fmt.Printf("Also signing with %s from %s\n", signing.keyAlias, signing.storeFile)
+		signers = append(signers, signing)
+		warnings = append(warnings, w...)
+		return nil
+	}
+	for _, path := range nextSigners {
+		signing, err := propsSigningConfig(path)
+		if err := add("-next-signer "+path, signing, err); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, pair := range extraKeystores {
+		var signing *signingConfig
+		var err error
+		if !fileExists(pair.file) {
+			err = &exitError{exitInput, fmt.Errorf("Keystore %s not found", pair.file)}
+		} else {
+			warnReadable(pair.file)
+			signing, err = unlockKeystore(&signingConfig{storeFile: pair.file}, pair.alias, "", "")
+		}
+		if err := add("-keystore "+pair.file, signing, err); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(signers) > 0 {
+		warnings = append(warnings, fmt.Sprintf("with %d signers the APK only has v1 and v2 signatures: v3 and v4 take a single signer, "+
+			"so the APK can't rotate its key, and can't be installed with adb install --incremental", len(signers)+1))
+	}
+	return signers, warnings, nil
+}
+
+// hasNextSigners reports whether more than one key signs: with -next-signer,
+// or -keystore given more than once.
+func hasNextSigners() bool {
+	return len(nextSigners) > 0 || len(extraKeystores) > 0
+}
+
+// keystoreStore is the store given with -keystore, or -ks-type pkcs11 and
+// -pkcs11-config, without its passwords.
+func keystoreStore() (*signingConfig, error) {
+	signing := &signingConfig{storeFile: keystore, storeType: keystoreType}
+	switch keystoreType {
+	case "pkcs11":
+		if keystore != "" {
+			return nil, &exitError{exitUsage, errors.New("-keystore can't be used with -ks-type pkcs11, the key is on the token")}
+		}
+		if pkcs11Config == "" {
+			return nil, &exitError{exitUsage, errors.New("-ks-type pkcs11 needs -pkcs11-config")}
+		}
+		if !fileExists(pkcs11Config) {
+			return nil, &exitError{exitInput, fmt.Errorf("PKCS#11 config %s not found", pkcs11Config)}
+		}
+		signing.storeFile, signing.providerArg = "NONE", pkcs11Config
+		return signing, nil
+	case "", "jks", "pkcs12":
+	default:
+		return nil, &exitError{exitUsage, fmt.Errorf("Invalid -ks-type %q, expected jks, pkcs12 or pkcs11", keystoreType)}
+	}
+
+	if pkcs11Config != "" {
+		return nil, &exitError{exitUsage, errors.New("-pkcs11-config has no effect without -ks-type pkcs11")}
+	}
+	if keystore == "" {
+		return nil, &exitError{exitUsage, fmt.Errorf("-ks-type %s needs -keystore", keystoreType)}
+	}
+	if !fileExists(keystore) {
+		return nil, &exitError{exitInput, fmt.Errorf("Keystore %s not found", keystore)}
+	}
+	warnReadable(keystore)
+	return signing, nil
+}
+
+// auditEntry is a line of the -audit-log. It has no password fields, so
+// none can end up there.
+type auditEntry struct {
+	Time           string `json:"time"`
+	User           string `json:"user"`
+	Operation      string `json:"operation"`
+	Input          string `json:"input"`
+	InputSHA256    string `json:"inputSha256"`
+	Output         string `json:"output"`
+	OutputSHA256   string `json:"outputSha256"`
+	Signer         string `json:"signer"`
+	Keystore       string `json:"keystore"`
+	KeyAlias       string `json:"keyAlias"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"` // SHA-256 of the certificate
+}
+
+// auditSigning appends the signing of in into out to the -audit-log, if
+// there is one. The log is only ever appended to, and only readable by its
+// owner.
+func auditSigning(in, out, signer string, signing *signingConfig) error {
+	if auditLog == "" {
+		return nil
+	}
+
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Operation: "sign",
+		Input:     in,
+		Output:    out,
+		Signer:    signer,
+		Keystore:  storeName(signing),
+		KeyAlias:  signing.keyAlias,
+	}
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+	var err error
+	if entry.InputSHA256, err = fileSHA256(in); err != nil {
+		return err
+	}
+	if entry.OutputSHA256, err = fileSHA256(out); err != nil {
+		return err
+	}
+	cert := signing.cert
+	if cert == nil {
+		if e, err := keystoreAlias(signing, signing.keyAlias); err == nil {
+			cert = e.Cert
+		}
+	}
+	if cert != nil {
+		sum := sha256.Sum256(cert.Raw)
+		entry.KeyFingerprint = certFingerprint(sum[:])
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// warnReadable warns when the user's keystore or file with passwords can
+// be read by others. Its mode is theirs to change, only the files the tool
+// creates are restricted. Windows has no such mode bits.
+func warnReadable(path string) {
+	info, err := os.Stat(path)
+	if err != nil || runtime.GOOS == "windows" || info.Mode().Perm()&0044 == 0 {
+		return
+	}
+	fmt.Printf("WARNING: %s is readable by other users (%#o), chmod 600 it to keep its keys to yourself\n", path, info.Mode().Perm())
+}
+
+// keystoreSigningConfig is the first -keystore key.
+func keystoreSigningConfig() (*signingConfig, error) {
+	signing, err := keystoreStore()
+	if err != nil {
+		return nil, err
+	}
+	if signing.storeType == "pkcs11" && keyPassword != "" {
+		return nil, &exitError{exitUsage, errors.New("-keypass has no effect with -ks-type pkcs11, give the token PIN with -storepass")}
+	}
+	return unlockKeystore(signing, keyAlias, storePassword, keyPassword)
+}
+
+// unlockKeystore picks the alias key of signing's store and unlocks it,
+// prompting for the passwords it isn't given. The key password defaults
+// to the keystore password, unless that had to be prompted for: then the
+// key password is prompted for too. Keys on a PKCS#11 token only have the
+// PIN.
+func unlockKeystore(signing *signingConfig, alias, storePass, keyPass string) (*signingConfig, error) {
+	token := signing.storeType == "pkcs11"
+	signing.storePassword, signing.keyPassword = storePass, keyPass
+	prompted := false
+	if signing.storePassword == "" {
+		password, err := promptPassword(storePrompt(signing))
+		if err != nil {
+			return nil, &exitError{exitSign, err}
+		}
+		signing.storePassword, prompted = password, true
+	}
+
+	entry, err := keystoreAlias(signing, alias)
+	if err != nil {
+		return nil, &exitError{exitSign, err}
+	}
+	signing.keyAlias, signing.cert, signing.chain = entry.Alias, entry.Cert, entry.Chain
+	alias = entry.Alias
+
+	if signing.keyPassword == "" && prompted && !token {
+		password, err := promptPassword(fmt.Sprintf("Key password for %s (Enter for the keystore password): ", alias))
+		if err != nil {
+			return nil, &exitError{exitSign, err}
+		}
+		signing.keyPassword = password
+	}
+	if signing.keyPassword == "" {
+		signing.keyPassword = signing.storePassword
+	}
+	if err := checkKeyPassword(signing); err != nil {
+		return nil, &exitError{exitSign, err}
+	}
+	return signing, nil
+}
+
+// checkKeyPassword unlocks the signing key before anything is decoded: the
+// keystore password only opens the store, and a wrong key password would
+// otherwise only show when signing, after the rebuild. keytool -certreq
+// needs the private key, so it fails on a wrong one. A token's key is
+// unlocked by the PIN, which listing the token already checked.
+func checkKeyPassword(signing *signingConfig) error {
+	if signing.storeType == "pkcs11" {
+		return nil
+	}
+	args := append([]string{"-J-Duser.language=en", "-certreq", "-alias", signing.keyAlias}, signing.keytoolArgs()...)
+	passArgs, remove, err := signing.keytoolPasswordArgs(true)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	output, err := exec.Command("keytool", append(args, passArgs...)...).CombinedOutput()
+	switch {
+	case strings.Contains(string(output), "Ignoring user-specified -keypass"):
+		// keytool signs with the store password then, apksigner doesn't.
+		return fmt.Errorf("%s is a PKCS12 keystore, whose keys have the keystore password: the key password of %s must be the same", storeName(signing), signing.keyAlias)
+	case err == nil:
+		return nil
+	case strings.Contains(string(output), "Cannot recover key") || strings.Contains(string(output), "Given final block not properly padded"):
+		return fmt.Errorf("Wrong key password for %s in %s", signing.keyAlias, storeName(signing))
+	}
+	return fmt.Errorf("Failed to unlock %s in %s: %v", signing.keyAlias, storeName(signing), &cmdError{err: err, stderr: string(output)})
+}
+
+// certExpiryWarning is how long before its certificate expires a key gets a
+// warning.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// checkSigningChain checks the certificate chain of a user's key before
+// anything is decoded: the certificate has to be valid now (expired ones are
+// only a warning with -allow-expired-cert), each certificate has to be
+// signed by the next, and keys weaker than RSA-2048 get a warning. It
+// returns the key algorithm and size, e.g. "RSA 2048".
+func checkSigningChain(signing *signingConfig) (string, []string, error) {
+	cert := signing.cert
+	if cert == nil {
+		return "", []string{fmt.Sprintf("%s has no certificate for %s, it can't be checked", storeName(signing), signing.keyAlias)}, nil
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fmt.Printf("Signing certificate: %s (SHA-256 %s)\n", cert.Subject, certFingerprint(sum[:]))
+
+	var warnings []string
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return "", nil, fmt.Errorf("The certificate of %s is not valid until %s", signing.keyAlias, cert.NotBefore.Format("2006-01-02"))
+	case now.After(cert.NotAfter) && !allowExpired:
+		return "", nil, fmt.Errorf("The certificate of %s expired on %s, pass -allow-expired-cert to sign with it anyway", signing.keyAlias, cert.NotAfter.Format("2006-01-02"))
+	case now.After(cert.NotAfter):
+		warnings = append(warnings, fmt.Sprintf("the certificate of %s expired on %s, jarsigner will warn and some devices reject the APK", signing.keyAlias, cert.NotAfter.Format("2006-01-02")))
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		warnings = append(warnings, fmt.Sprintf("the certificate of %s expires in %d days, on %s", signing.keyAlias, int(cert.NotAfter.Sub(now).Hours()/24), cert.NotAfter.Format("2006-01-02")))
+	}
+
+	for i := 0; i+1 < len(signing.chain); i++ {
+		child, parent := signing.chain[i], signing.chain[i+1]
+		if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+			return "", nil, fmt.Errorf("The certificate chain of %s is broken: %s was not issued by %s", signing.keyAlias, child.Subject, parent.Subject)
+		}
+		if err := parent.CheckSignature(child.SignatureAlgorithm, child.RawTBSCertificate, child.Signature); err != nil {
+			return "", nil, fmt.Errorf("The certificate chain of %s is broken: %s is not signed by %s: %v", signing.keyAlias, child.Subject, parent.Subject, err)
+		}
+	}
+
+	key, bits := keyStrength(cert)
+	fmt.Println("Signing key:", key)
+	if (cert.PublicKeyAlgorithm == x509.RSA || cert.PublicKeyAlgorithm == x509.DSA) && bits < 2048 {
+		warnings = append(warnings, fmt.Sprintf("the %s key of %s is weaker than RSA-2048", key, signing.keyAlias))
+	}
+	return key, warnings, nil
+}
+
+// keyStrength describes the public key of a certificate and its size in bits.
+func keyStrength(cert *x509.Certificate) (string, int) {
+	bits := 0
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		bits = key.N.BitLen()
+	case *dsa.PublicKey:
+		bits = key.P.BitLen()
+	case *ecdsa.PublicKey:
+		bits = key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		bits = 256
+	}
+	return fmt.Sprintf("%s %d", cert.PublicKeyAlgorithm, bits), bits
+}
+
+// storePrompt asks for the password of the store, or the PIN of a token.
+func storePrompt(signing *signingConfig) string {
+	if signing.storeType == "pkcs11" {
+		return "Token PIN: "
+	}
+	return "Keystore password: "
+}
+
+// storeName names the store in messages.
+func storeName(signing *signingConfig) string {
+	if signing.storeType == "pkcs11" {
+		return "the token of " + signing.providerArg
+	}
+	return signing.storeFile
+}
+
+// keystoreAlias checks that alias names a private key in the store, or picks
+// the only one when alias is "".
+func keystoreAlias(signing *signingConfig, alias string) (keystoreEntry, error) {
+	name := storeName(signing)
+	entries, err := listKeystore(signing)
+	if err != nil {
+		return keystoreEntry{}, fmt.Errorf("Failed to read %s: %v", name, tokenError(err))
+	}
+
+	// Aliases are case-insensitive: keytool lists a JKS keystore's in lower
+	// case, whatever case they were created with.
+	var keys []keystoreEntry
+	var aliases []string
+	for _, e := range entries {
+		switch {
+		case strings.EqualFold(e.Alias, alias) && e.Type == "PrivateKeyEntry":
+			return e, nil
+		case strings.EqualFold(e.Alias, alias):
+			return keystoreEntry{}, fmt.Errorf("%s in %s is a %s, not a signing key", alias, name, e.Type)
+		case e.Type == "PrivateKeyEntry":
+			keys = append(keys, e)
+			aliases = append(aliases, e.Alias)
+		}
+	}
+	switch {
+	case len(keys) == 0:
+		return keystoreEntry{}, fmt.Errorf("%s holds no private keys", name)
+	case alias != "":
+		return keystoreEntry{}, fmt.Errorf("%s has no key %s, its keys are: %s", name, alias, strings.Join(aliases, ", "))
+	case len(keys) > 1:
+		return keystoreEntry{}, fmt.Errorf("%s holds several keys, pick one with -ks-alias (or keyAlias with -signing-props): %s", name, strings.Join(aliases, ", "))
+	}
+	fmt.Println("Using the only key in the keystore:", keys[0].Alias)
+	return keys[0], nil
+}
+
+// keystoreEntry is an entry of "keytool -list".
+type keystoreEntry struct {
+	Alias string
+	// Type is PrivateKeyEntry, trustedCertEntry or SecretKeyEntry.
+	Type string
+	// Cert is the first certificate of Chain.
+	Cert  *x509.Certificate
+	Chain []*x509.Certificate
+}
+
+var keystoreEntryType = regexp.MustCompile(`(?m)^Entry type: (\S+)`)
+
+// listKeystore lists a JKS or PKCS12 keystore with keytool, which detects
+// the format, or the keys of a PKCS#11 token. The certificate of each entry
+// is the first of its chain.
+func listKeystore(signing *signingConfig) ([]keystoreEntry, error) {
+	// keytool's labels are translated, make sure they're English.
+	args := append([]string{"-J-Duser.language=en", "-list", "-rfc"}, signing.keytoolArgs()...)
+	passArgs, remove, err := signing.keytoolPasswordArgs(false)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	output, err := exec.Command("keytool", append(args, passArgs...)...).CombinedOutput()
+	if err != nil {
+		return nil, &cmdError{err: err, stderr: string(output)}
+	}
+
+	var entries []keystoreEntry
+	for _, block := range strings.Split(string(output), "Alias name: ")[1:] {
+		lines := strings.SplitN(block, "\n", 2)
+		entry := keystoreEntry{Alias: strings.TrimSpace(lines[0])}
+		if m := keystoreEntryType.FindStringSubmatch(block); m != nil {
+			entry.Type = m[1]
+		}
+		for rest := []byte(block); ; {
+			var p *pem.Block
+			if p, rest = pem.Decode(rest); p == nil {
+				break
+			}
+			if p.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(p.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Alias, err)
+			}
+			entry.Chain = append(entry.Chain, cert)
+		}
+		if len(entry.Chain) > 0 {
+			entry.Cert = entry.Chain[0]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func keystoreCommand(args []string) {
+	const usage = "Usage: go run debugAPK.go keystore list {-keystore FILE | -ks-type pkcs11 -pkcs11-config FILE} [-storepass PASSWORD]"
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	flag.CommandLine.Parse(args[1:])
+	if err := loadConfig(); err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	if (keystore == "" && keystoreType == "") || flag.NArg() != 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	if len(extraKeystores) > 0 {
+		log.Fatal("keystore list lists a single -keystore")
+	}
+
+	signing, err := keystoreStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	signing.storePassword = storePassword
+	if signing.storePassword == "" {
+		if signing.storePassword, err = promptPassword(storePrompt(signing)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	entries, err := listKeystore(signing)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", storeName(signing), tokenError(err))
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s (%s)\n", e.Alias, e.Type)
+		if e.Cert == nil {
+			continue
+		}
+		fmt.Println("  Subject:  ", e.Cert.Subject)
+		sum256, sum1 := sha256.Sum256(e.Cert.Raw), sha1.Sum(e.Cert.Raw)
+		fmt.Println("  SHA-256:  ", certFingerprint(sum256[:]))
+		fmt.Println("  SHA-1:    ", certFingerprint(sum1[:]))
+		expiry := e.Cert.NotAfter.Format("2006-01-02")
+		if time.Now().After(e.Cert.NotAfter) {
+			expiry += " (EXPIRED)"
+		}
+		fmt.Println("  Expires:  ", expiry)
+	}
+	if len(entries) == 0 {
+		fmt.Println("The keystore is empty.")
+	}
+}
+
+// tokenHints explain the PKCS#11 errors of a locked, absent or misconfigured
+// token, which Java reports deep in a stack trace.
+var tokenHints = []struct{ pattern, hint string }{
+	{"CKR_PIN_INCORRECT", "the token PIN is wrong"},
+	{"CKR_PIN_LOCKED", "the token PIN is locked after too many wrong tries, unblock it with the token's PUK (on a YubiKey: ykman piv access unblock-pin)"},
+	{"CKR_PIN_EXPIRED", "the token PIN has expired, set a new one with the token's admin tool"},
+	{"CKR_TOKEN_NOT_PRESENT", "no token is plugged in, insert it and retry"},
+	{"CKR_DEVICE_REMOVED", "the token was removed, insert it and retry"},
+	{"CKR_SLOT_ID_INVALID", "the slot in the -pkcs11-config has no token, check that it's plugged in and the slot is right"},
+	{"cannot open shared object file", "the library in the -pkcs11-config can't be loaded, check its path"},
+	{"The specified module could not be found", "the library in the -pkcs11-config can't be loaded, check its path"},
+	{"PKCS11 not found", "the -pkcs11-config was not accepted by the SunPKCS11 provider, check its name and library lines"},
+}
+
+// tokenError adds a hint to an error of keytool, jarsigner or apksigner when
+// its output shows a known PKCS#11 failure.
+func tokenError(err error) error {
+	var ce *cmdError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	for _, h := range tokenHints {
+		if strings.Contains(ce.stderr, h.pattern) {
+			return fmt.Errorf("%v\nHint: %s", err, h.hint)
+		}
+	}
+	return err
+}
+
+// checkSigningCert checks that apksigner found the certificate read from
+// the store, or the token, among the signers of status. jarsigner doesn't
+// print certificate digests, so nothing is checked with it.
+func checkSigningCert(status signatureStatus, verifier string, signing *signingConfig) error {
+	if signing == nil || verifier != "apksigner" {
+		return nil
+	}
+	for _, s := range append([]*signingConfig{signing}, signing.next...) {
+		if s.cert == nil {
+			continue
+		}
+		sum := sha256.Sum256(s.cert.Raw)
+		found := false
+		for _, digest := range status.SHA256 {
+			found = found || digest == hex.EncodeToString(sum[:])
+		}
+		if !found {
+			return fmt.Errorf("%s is not signed with the certificate of %s (SHA-256 %s)", status.Path, s.keyAlias, certFingerprint(sum[:]))
+		}
+		fmt.Println("Signed with the certificate of", s.keyAlias)
+	}
+	return nil
+}
+
+// certFingerprint formats a digest the way keytool does, AB:CD:...
+func certFingerprint(digest []byte) string {
+	parts := make([]string, len(digest))
+	for i, b := range digest {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// promptPassword reads a line from the terminal with echo turned off: by
+// stty, or on Windows, which has no stty, by PowerShell. A Ctrl-C at the
+// prompt turns echo back on before exiting, instead of leaving the terminal
+// without it.
+func promptPassword(prompt string) (string, error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", fmt.Errorf("%s is needed, but stdin isn't a terminal to ask for it", strings.TrimSuffix(prompt, ": "))
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	if runtime.GOOS == "windows" {
+		if password, ok := readConsolePassword(); ok {
+			return password, nil
+		}
+		fmt.Fprint(os.Stderr, "\nWARNING: PowerShell isn't available to hide the password, it shows as it's typed\n", prompt)
+	} else {
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			restore := func() {
+				stty := exec.Command("stty", "echo")
+				stty.Stdin = os.Stdin
+				stty.Run()
+			}
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-interrupts:
+					restore()
+					fmt.Fprintln(os.Stderr)
+					os.Exit(exitFailure)
+				case <-done:
+				}
+			}()
+			defer func() {
+				signal.Stop(interrupts)
+				close(done)
+				restore()
+			}()
+		}
+	}
+	line, err := stdinReader.ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readConsolePassword reads a password from the Windows console with
+// PowerShell's Read-Host, which doesn't echo it. The password comes back on
+// PowerShell's stdout, never on a command line. ok is false when PowerShell
+// can't be run.
+func readConsolePassword() (password string, ok bool) {
+	const script = "$p = Read-Host -AsSecureString; " +
+		"[Runtime.InteropServices.Marshal]::PtrToStringBSTR([Runtime.InteropServices.Marshal]::SecureStringToBSTR($p))"
+	cmd := exec.Command("powershell", "-NoProfile", "-Command", script)
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(string(output), "\r\n"), true
+}
+
+// readProperties parses the subset of the Java .properties format used by
+// Gradle projects: key=value or key: value lines, # and ! comments, and
+// backslash escapes and line continuations.
+func readProperties(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	props := map[string]string{}
+	var logical string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		line = strings.TrimLeft(line, " \t")
+		if logical == "" && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			logical += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		logical += line
+
+		key, value := splitProperty(logical)
+		props[key] = value
+		logical = ""
+	}
+	return props, nil
+}
+
+// splitProperty splits a logical properties line at the first unescaped '='
+// or ':' and unescapes both halves.
+func splitProperty(line string) (string, string) {
+	var key, value strings.Builder
+	cur := &key
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case cur == &key && (c == '=' || c == ':'):
+			cur = &value
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(key.String()), strings.TrimSpace(value.String())
+}
+
+func generateKeyStore(signing *signingConfig, debugFlag bool) error {
+	passArgs, remove, err := signing.keytoolPasswordArgs(true)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	cmd := exec.Command("keytool", append([]string{"-genkey", "-noprompt",
+		"-alias", signing.keyAlias,
+		"-dname", "CN=Unknown, OU=Unknown, O=Unknown, L=Unknown, S=Unknown, C=Unknown",
+		"-keystore", signing.storeFile,
+		"-keyalg", "RSA",
+	}, passArgs...)...)
+	// The temporary directory is 0700 already, the keystore in it gets
+	// 0600 too.
+	if err := os.Chmod(filepath.Dir(signing.storeFile), 0700); err != nil {
+		return err
+	}
+	if err := processCMD(cmd, debugFlag); err != nil {
+		return err
+	}
+
+	return os.Chmod(signing.storeFile, 0600)
+}
+
+// signerFor picks the signing tool for an artifact type. App bundles only
+// carry a JAR (v1) signature, so they are always signed with jarsigner; APKs
+// get apksigner when it is installed, for v2/v3 signatures. It returns ""
+// when no suitable tool is installed.
+func signerFor(artifact string) string {
+	candidates := []string{"apksigner", "jarsigner"}
+	if artifact == "aab" {
+		candidates = []string{"jarsigner"}
+	}
+	for _, tool := range candidates {
+		if _, err := exec.LookPath(tool); err == nil {
+			return tool
+		}
+	}
+	return ""
+}
+
+// signArtifact signs path in place and returns the signer it used. APKs are
+// zip-aligned before apksigner runs, and after jarsigner runs since jarsigner
+// doesn't preserve alignment (a v1 signature survives re-aligning).
+func signArtifact(path, artifact string, signing *signingConfig, debugFlag bool) (string, error) {
+	signer := signerFor(artifact)
+	switch signer {
+	case "apksigner":
+		if err := rewriteZip(path, zipRewrite{}); err != nil {
+			return "", fmt.Errorf("align: %v", err)
+		}
+		args, remove, err := apksignerSignArgs(signing)
+		if err != nil {
+			return "", err
+		}
+		defer remove()
+		return signer, retryLocked(path, func() error {
+			return processCMD(exec.Command("apksigner", append(args, path)...), debugFlag)
+		})
+	case "jarsigner":
+		if len(signing.next) > 0 {
+			return "", errors.New("-next-signer needs apksigner, jarsigner signs with one key")
+		}
+		passArgs, remove, err := signing.keytoolPasswordArgs(signing.storeType != "pkcs11")
+		if err != nil {
+			return "", err
+		}
+		defer remove()
+		args := append(signing.keytoolArgs(), passArgs...)
+		err = retryLocked(path, func() error {
+			return processCMD(exec.Command("jarsigner", append(args, path, signing.keyAlias)...), debugFlag)
+		})
+		if err != nil {
+			return "", err
+		}
+		if artifact == "apk" {
+			if err := rewriteZip(path, zipRewrite{}); err != nil {
+				return "", fmt.Errorf("align: %v", err)
+			}
+		}
+		return signer, nil
+	}
+	return "", fmt.Errorf("no signer for %s files is installed", artifact)
+}
+
+// apksignerSignArgs are the apksigner sign options for signing and its next
+// signers, reading each signer's passwords from passwordFiles of its own.
+// remove deletes the files once apksigner is done.
+func apksignerSignArgs(signing *signingConfig) (args []string, remove func(), err error) {
+	signers := append([]*signingConfig{signing}, signing.next...)
+	var passwords []string
+	for _, s := range signers {
+		passwords = append(passwords, s.storePassword, s.keyPassword)
+	}
+	paths, remove, err := passwordFiles(passwords...)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = []string{"sign"}
+	for i, s := range signers {
+		if i > 0 {
+			args = append(args, "--next-signer")
+		}
+		args = append(args, s.apksignerArgs()...)
+		args = append(args, "--ks-pass", "file:"+paths[2*i], "--ks-key-alias", s.keyAlias, "--key-pass", "file:"+paths[2*i+1])
+	}
+	if len(signing.next) > 0 {
+		// Without a lineage, v3 signs with a single key, and v4 needs v3
+		// or v2 from a single signer as well.
+		args = append(args, "--v3-signing-enabled", "false", "--v4-signing-enabled", "false")
+	}
+	return args, remove, nil
+}
+
+// verifierFor picks the tool that checks the signature of an artifact, as
+// chosen with -verify-with. It's independent of the tool that signed, but
+// apksigner can't verify app bundles.
+func verifierFor(artifact string) (string, error) {
+	switch verifyWith {
+	case "auto":
+		if _, err := exec.LookPath("apksigner"); err == nil && artifact == "apk" {
+			return "apksigner", nil
+		}
+		return "jarsigner", nil
+	case "apksigner", "jarsigner":
+		if verifyWith == "apksigner" && artifact == "aab" {
+			return "", &exitError{exitUsage, errors.New("apksigner can't verify app bundles, use -verify-with jarsigner")}
+		}
+		if _, err := exec.LookPath(verifyWith); err != nil {
+			return "", &exitError{exitMissingTool, fmt.Errorf("-verify-with %s: %s is not installed", verifyWith, verifyWith)}
+		}
+		return verifyWith, nil
+	}
+	return "", &exitError{exitUsage, fmt.Errorf("Invalid -verify-with %q, expected apksigner, jarsigner or auto", verifyWith)}
+}
+
+// signatureStatus is an artifact as verify reports it: its signature and,
+// for APKs, its alignment. Schemes are the verified signature schemes,
+// e.g. v1 and v2. AlignCheck is how the alignment was checked, with
+// zipalign or, when it's not installed, by reading the entry offsets.
+type signatureStatus struct {
+	Path       string   `json:"path"`
+	Signed     bool     `json:"signed"`
+	Schemes    []string `json:"schemes"`
+	Verifier   string   `json:"verifier,omitempty"`
+	Signer     string   `json:"signer,omitempty"` // certificate DN, apksigner only
+	SHA256     []string `json:"sha256,omitempty"` // of each signer's certificate
+	Error      string   `json:"error,omitempty"`
+	Aligned    bool     `json:"aligned"`
+	AlignCheck string   `json:"alignCheck,omitempty"`
+	Misaligned []string `json:"misaligned,omitempty"`
+	Failure    string   `json:"failure,omitempty"` // the category of the failure, see verifyFailures
+}
+
+var (
+	verifiedSchemePattern = regexp.MustCompile(`(?m)^Verified using (v[\d.]+) scheme.*: true\s*$`)
+	signerDNPattern       = regexp.MustCompile(`(?m)^Signer #1 certificate DN: (.*?)\s*$`)
+	signerDigestPattern   = regexp.MustCompile(`(?m)^Signer #\d+ certificate SHA-256 digest: ([0-9a-f]+)`)
+	zipalignBadPattern    = regexp.MustCompile(`(?m)^\s*\d+ (.+?) \(BAD - \d+\)\s*$`)
+)
+
+// checkArtifact checks that path is a zip of the artifact type, then its
+// signature with verifier and, for an APK, its alignment. The error is the
+// first problem found; status.Failure is its category from verifyFailures.
+func checkArtifact(path, verifier, artifact string) (signatureStatus, error) {
+	if err := checkArchive(path, artifact); err != nil {
+		status := signatureStatus{Path: path, Schemes: []string{}, Verifier: verifier, Error: err.Error(), Failure: "input"}
+		return status, err
+	}
+	status := signatureOf(path, verifier)
+	if artifact == "apk" {
+		alignmentOf(&status)
+	} else {
+		status.Aligned = true
+	}
+	problem := status.problem()
+	switch {
+	case problem == "":
+		return status, nil
+	case !status.Signed:
+		status.Failure = "signature"
+	default:
+		status.Failure = "alignment"
+	}
+	return status, errors.New(problem)
+}
+
+// checkArchive checks that path is a zip file and, for an APK, that it has
+// a manifest.
+func checkArchive(path, artifact string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if artifact != "apk" {
+		return nil
+	}
+	for _, f := range r.File {
+		if f.Name == "AndroidManifest.xml" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no AndroidManifest.xml, it's not an APK", path)
+}
+
+// signatureOf checks the signature of apk with verifier. It doesn't check
+// the alignment, see alignmentOf.
+func signatureOf(apk, verifier string) signatureStatus {
+	status := signatureStatus{Path: apk, Schemes: []string{}, Verifier: verifier}
+	if verifier == "apksigner" {
+		output, err := exec.Command("apksigner", "verify", "-v", "--print-certs", apk).CombinedOutput()
+		if err != nil {
+			status.Error = lastLine(string(output))
+			return status
+		}
+		parseApksignerVerify(string(output), &status)
+	} else {
+		output, err := exec.Command("jarsigner", "-verify", apk).CombinedOutput()
+		if err != nil || !strings.Contains(string(output), "jar verified.") {
+			status.Error = lastLine(string(output))
+			return status
+		}
+		status.Schemes = append(status.Schemes, "v1")
+	}
+	status.Signed = len(status.Schemes) > 0
+	return status
+}
+
+// parseApksignerVerify reads the schemes and the signers from the output of
+// apksigner verify -v --print-certs.
+func parseApksignerVerify(output string, status *signatureStatus) {
+	for _, m := range verifiedSchemePattern.FindAllStringSubmatch(output, -1) {
+		status.Schemes = append(status.Schemes, m[1])
+	}
+	if m := signerDNPattern.FindStringSubmatch(output); m != nil {
+		status.Signer = m[1]
+	}
+	for _, m := range signerDigestPattern.FindAllStringSubmatch(output, -1) {
+		status.SHA256 = append(status.SHA256, m[1])
+	}
+}
+
+// alignmentOf checks that apk is zip-aligned, with zipalign -c -p 4 if it's
+// installed. Otherwise the entries are checked like zipalign -p would:
+// stored entries on 4 bytes, stored native libraries on 4 KiB.
+func alignmentOf(status *signatureStatus) {
+	if _, err := exec.LookPath("zipalign"); err == nil {
+		status.AlignCheck = "zipalign -c -p 4"
+		output, err := exec.Command("zipalign", "-c", "-v", "-p", "4", status.Path).CombinedOutput()
+		status.Misaligned = parseZipalignCheck(string(output))
+		status.Aligned = err == nil && len(status.Misaligned) == 0
+		if err != nil && len(status.Misaligned) == 0 && status.Error == "" {
+			status.Error = "zipalign: " + lastLine(string(output))
+		}
+		return
+	}
+
+	status.AlignCheck = "built-in, zipalign is not installed"
+	r, err := zip.OpenReader(status.Path)
+	if err != nil {
+		if status.Error == "" {
+			status.Error = err.Error()
+		}
+		return
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Method != zip.Store || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		align := int64(4)
+		if strings.HasSuffix(f.Name, ".so") {
+			align = 4096
+		}
+		if offset, err := f.DataOffset(); err != nil || offset%align != 0 {
+			status.Misaligned = append(status.Misaligned, f.Name)
+		}
+	}
+	status.Aligned = len(status.Misaligned) == 0
+}
+
+// parseZipalignCheck returns the entries zipalign -c -v reports as BAD,
+// a line per entry like "  1234 classes.dex (BAD - 2)".
+func parseZipalignCheck(output string) []string {
+	var bad []string
+	for _, m := range zipalignBadPattern.FindAllStringSubmatch(output, -1) {
+		bad = append(bad, m[1])
+	}
+	return bad
+}
+
+// problem is why the artifact doesn't verify, or "" if it does.
+func (s signatureStatus) problem() string {
+	switch {
+	case s.Error != "":
+		return s.Error
+	case s.Verifier != "" && !s.Signed:
+		return s.Path + " is not signed"
+	case len(s.Misaligned) > 0:
+		return fmt.Sprintf("%s is not zip-aligned: %d misaligned entries, starting with %s", s.Path, len(s.Misaligned), s.Misaligned[0])
+	case !s.Aligned:
+		return s.Path + " is not zip-aligned"
+	}
+	return ""
+}
+
+// print prints the status as a block, the human output of verify.
+func (s signatureStatus) print() {
+	fmt.Println(s.Path)
+	switch {
+	case s.AlignCheck == "":
+	case s.Aligned:
+		fmt.Printf("  Aligned:    yes (%s)\n", s.AlignCheck)
+	case len(s.Misaligned) > 0:
+		fmt.Printf("  Aligned:    NO, %d misaligned entries (%s): %s\n", len(s.Misaligned), s.AlignCheck, strings.Join(s.Misaligned, ", "))
+	default:
+		fmt.Printf("  Aligned:    unknown (%s)\n", s.AlignCheck)
+	}
+	switch {
+	case s.Verifier == "":
+		fmt.Println("  Signatures: none, unsigned by request (-no-sign)")
+	case s.Signed:
+		fmt.Printf("  Signatures: %s (verified with %s)\n", strings.Join(s.Schemes, ", "), s.Verifier)
+	default:
+		fmt.Printf("  Signatures: NONE (verified with %s)\n", s.Verifier)
+	}
+	if s.Signer != "" {
+		fmt.Println("  Signer:    ", s.Signer)
+	}
+	for i, digest := range s.SHA256 {
+		raw, _ := hex.DecodeString(digest)
+		if len(s.SHA256) == 1 {
+			fmt.Println("  SHA-256:   ", certFingerprint(raw))
+		} else {
+			fmt.Printf("  SHA-256 #%d: %s\n", i+1, certFingerprint(raw))
+		}
+	}
+	if s.Error != "" {
+		fmt.Println("  Error:     ", s.Error)
+	}
+}
+
+// verifyOptions are the options of the verify command.
+type verifyOptions struct {
+	recursive, asJSON, summary, verbose bool
+	excludes                            stringList
+}
+
+// flags is the flag set of verify, which sets o and -verify-with.
+func (o *verifyOptions) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.BoolVar(&o.recursive, "recursive", false, "Check every .apk in the given directories and below")
+	flags.BoolVar(&o.asJSON, "json", false, "Print the results as a JSON array")
+	flags.BoolVar(&o.summary, "summary", false, "With -json, print an object of the results and of the failed APKs by category instead")
+	flags.Var(&o.excludes, "exclude", "With -recursive, skip paths matching this .gitignore-style pattern (repeatable)")
+	flags.BoolVar(&o.verbose, "v", false, "Print the ignore rules in effect for each directory")
+	flags.StringVar(&verifyWith, "verify-with", "auto", "Verify with apksigner, jarsigner or auto")
+	return flags
+}
+
+func verifyCommand(args []string) {
+	var o verifyOptions
+	flags := o.flags()
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: go run debugAPK.go verify [-recursive [-exclude PATTERN]... [-v]] [-json [-summary]] [-verify-with TOOL] <APK_OR_DIR>...")
+		os.Exit(1)
+	}
+	verifier, err := verifierFor("apk")
+	if err != nil {
+		exitWith(exitCodeOf(err), err)
+	}
+
+	var apks []string
+	for _, path := range flags.Args() {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !info.IsDir() {
+			apks = append(apks, path)
+			continue
+		}
+		if !o.recursive {
+			log.Fatalf("%s is a directory, pass -recursive to check the APKs in it", path)
+		}
+		rules, err := ignoreRules(path, o.excludes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if o.verbose {
+			fmt.Fprintf(os.Stderr, "Ignore rules for %s:\n", path)
+			for _, r := range rules {
+				fmt.Fprintf(os.Stderr, "  %-30s (%s)\n", r.pattern, r.source)
+			}
+		}
+		root := path
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if rel, _ := filepath.Rel(root, path); rel != "." && isIgnored(rules, filepath.ToSlash(rel), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".apk") {
+				apks = append(apks, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	results := []signatureStatus{}
+	failures := map[string][]string{}
+	failed := 0
+	for _, apk := range apks {
+		status, err := checkArtifact(apk, verifier, "apk")
+		if err != nil {
+			failed++
+			failures[status.Failure] = append(failures[status.Failure], apk)
+		}
+		results = append(results, status)
+	}
+
+	if o.asJSON {
+		var v interface{} = results
+		if o.summary {
+			v = verifySummary{Checked: len(results), Passed: len(results) - failed, Verifier: verifier, APKs: results, Failures: failures}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for _, r := range results {
+			r.print()
+			fmt.Println()
+		}
+		fmt.Printf("%d of %d APKs signed and aligned (checked with %s)\n", len(results)-failed, len(results), verifier)
+		if failed > 0 {
+			fmt.Println("Failures by category:")
+			for _, f := range verifyFailures {
+				if n := len(failures[f.Name]); n > 0 {
+					fmt.Printf("  %-10s %5d  %s\n", f.Name, n, f.Meaning)
+				}
+			}
+		}
+	}
+	os.Exit(verifyExitCode(failures))
+}
+
+// verifyFailures are the categories of the APKs verify fails, in the order
+// they're checked, with the exit code a build failing the same way exits
+// with.
+var verifyFailures = []exitStatus{
+	{exitInput, "input", "not an APK: missing, unreadable, not a zip file or without a manifest"},
+	{exitVerify, "signature", "unsigned, or the signature doesn't verify"},
+	{exitVerify, "alignment", "signed, but not zip-aligned"},
+}
+
+// verifyExitCode is the exit code of verify: that of the first category of
+// verifyFailures with failed APKs, exitOK when there are none.
+func verifyExitCode(failures map[string][]string) int {
+	for _, f := range verifyFailures {
+		if len(failures[f.Name]) > 0 {
+			return f.Code
+		}
+	}
+	return exitOK
+}
+
+// verifySummary is the output of verify -json -summary. Failures lists the
+// failed APKs by category.
+type verifySummary struct {
+	Checked  int                 `json:"checked"`
+	Passed   int                 `json:"passed"`
+	Verifier string              `json:"verifier"`
+	APKs     []signatureStatus   `json:"apks"`
+	Failures map[string][]string `json:"failures"`
+}
+
+// ignoreFile is the file of a directory that verify -recursive reads
+// exclusions from, in .gitignore syntax.
+const ignoreFile = ".rsiwignore"
+
+// ignoreRule is a pattern of a .rsiwignore line or an -exclude.
+type ignoreRule struct {
+	pattern string
+	source  string // -exclude, or the .rsiwignore it comes from
+	negate  bool   // a !pattern, taking the path back in
+	dirOnly bool   // a pattern/, matching directories only
+	re      *regexp.Regexp
+}
+
+// ignoreRules returns the rules of the .rsiwignore of root, if it has one,
+// followed by the -exclude patterns. As in .gitignore, the last rule that
+// matches a path decides, so an -exclude wins over the file. An invalid
+// pattern is skipped with a warning.
+func ignoreRules(root string, excludes []string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	add := func(line, source, where string) {
+		r, ok, err := parseIgnoreRule(line, source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s: skipping the invalid pattern %q: %v\n", where, line, err)
+		} else if ok {
+			rules = append(rules, r)
+		}
+	}
+	path := filepath.Join(root, ignoreFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		for i, line := range strings.Split(string(data), "\n") {
+			add(line, path, fmt.Sprintf("%s:%d", path, i+1))
+		}
+	}
+	for _, pattern := range excludes {
+		add(pattern, "-exclude", "-exclude")
+	}
+	return rules, nil
+}
+
+// parseIgnoreRule parses a line of .gitignore syntax; ok is false for
+// blank lines and comments. A pattern with a slash other than a trailing
+// one is relative to the root, one without matches at any depth.
+func parseIgnoreRule(line, source string) (r ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+	r.pattern, r.source = line, source
+	switch {
+	case strings.HasPrefix(line, "!"):
+		r.negate, line = true, line[1:]
+	case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly, line = true, strings.TrimSuffix(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var re strings.Builder
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(line[i:], ']'); end > 1 {
+				class := line[i+1 : i+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				re.WriteString("[" + class + "]")
+				i += end
+			} else {
+				re.WriteString(`\[`)
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			// A byte at a time, the bytes of a UTF-8 character included.
+			re.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	if r.re, err = regexp.Compile("^" + re.String() + "$"); err != nil {
+		return r, false, err
+	}
+	return r, true, nil
+}
+
+// isIgnored reports whether the rules exclude rel, a slash-separated path
+// relative to the root.
+func isIgnored(rules []ignoreRule, rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeProjectName reduces name to characters that are safe in a directory
+// name on every platform. It returns "" when nothing usable is left.
+func sanitizeProjectName(name string) string {
+	name = unsafeNameChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return name
+}
+
+// moveDir moves src to dst, copying when they are on different filesystems
+// (the temp dir is often a tmpfs).
+func moveDir(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyDir(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// keepTree makes dst the decoded tree src, by -keep-mode: move renames it
+// (see moveDir), copy copies it, and link hard-links its files when dst is
+// on the same filesystem, copying them otherwise. Hard links share their
+// content, so the files edited in place afterwards, see copiedFiles, are
+// always copied: editing one tree can't change the other.
+func keepTree(src, dst, mode string) error {
+	var err error
+	switch mode {
+	case "copy":
+		err = copyDir(src, dst)
+	case "link":
+		err = linkDir(src, dst)
+	default:
+		return moveDir(src, dst)
+	}
+	if err != nil {
+		os.RemoveAll(dst)
+	}
+	return err
+}
+
+// copiedFiles are the files of a decoded tree that -keep-mode link copies,
+// since they're the ones patched and edited in place.
+var copiedFiles = map[string]bool{"AndroidManifest.xml": true, "apktool.yml": true}
+
+// linkFile is os.Link, replaced in tests.
+var linkFile = os.Link
+
+// linkDir recreates src as dst, hard-linking its files but copiedFiles, or
+// copying those it can't link, as across filesystems.
+func linkDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if !copiedFiles[filepath.ToSlash(rel)] && linkFile(path, target) == nil {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+const backupTimeFormat = "20060102-150405"
+
+var backupPattern = regexp.MustCompile(`\.bak-\d{8}-\d{6}$`)
+
+// backupOutput is -backup-original: it backs up path, when it exists, before
+// it gets overwritten and records the copy in result. Running out of disk
+// space only skips the backup.
+func backupOutput(path string, result *report) error {
+	if !backupOriginal || !fileExists(path) {
+		return nil
+	}
+
+	backup, err := backupFile(path)
+	if errors.Is(err, syscall.ENOSPC) {
+		warning := fmt.Sprintf("not enough disk space to back up %s, overwriting it anyway", path)
+		fmt.Println("WARNING:", warning)
+		result.Warnings = append(result.Warnings, warning)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to back up %s: %v", path, err)
+	}
+	fmt.Println("Backed up", path, "to", backup)
+	result.Backups = append(result.Backups, backup)
+	return nil
+}
+
+// backupFile copies path to <path>.bak-<timestamp> and checks that the copy
+// has the same SHA-256.
+func backupFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	backup := path + ".bak-" + time.Now().Format(backupTimeFormat)
+	if err := copyFile(path, backup, info.Mode().Perm()); err != nil {
+		os.Remove(backup)
+		return "", err
+	}
+
+	want, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	got, err := fileSHA256(backup)
+	if err != nil {
+		return "", err
+	}
+	if got != want {
+		os.Remove(backup)
+		return "", fmt.Errorf("%s doesn't match the original", backup)
+	}
+	return backup, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compressionLevels maps -compression modes to flate levels. zip.Store is
+// represented by flate.NoCompression.
+var compressionLevels = map[string]int{
+	"store": flate.NoCompression,
+	"fast":  flate.BestSpeed,
+	"best":  flate.BestCompression,
+}
+
+// zipRewrite describes how rewriteZip transforms the entries of an archive.
+type zipRewrite struct {
+	// compression is the -compression mode deflated entries are
+	// re-compressed with, "store" stores every entry, and "" copies the
+	// compressed data unchanged. Entries that are already stored always
+	// stay stored, since Android may need to mmap them.
+	compression string
+	// skip drops the entries it returns true for.
+	skip func(name string) bool
+	// bundle disables alignment and the APK stored-entry rules, which
+	// don't apply to app bundles.
+	bundle bool
+	// order lists entry names to write first, in that order. The other
+	// entries follow in the order they already had.
+	order []string
+	// replace returns new content for an entry, which gets deflated, or
+	// nil to copy it as it is.
+	replace func(f *zip.File) ([]byte, error)
+}
+
+// zipEntryNames lists the entries of an archive in central directory order.
+func zipEntryNames(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make([]string, len(r.File))
+	for i, f := range r.File {
+		names[i] = f.Name
+	}
+	return names, nil
+}
+
+// alwaysStored reports whether an entry must be stored uncompressed no
+// matter which compression was requested: resources.arsc has to be for
+// targetSdk 30+, and native libraries have to be for extractNativeLibs=false.
+func alwaysStored(name string) bool {
+	return name == "resources.arsc" || (strings.HasPrefix(name, "lib/") && strings.HasSuffix(name, ".so"))
+}
+
+// rewriteZip re-writes the archive at path according to rw. Entries keep
+// their central directory order unless rw.order says otherwise. Stored
+// entries are aligned like zipalign -p does: 4 KiB for native libraries and
+// 4 bytes for everything else.
+func rewriteZip(path string, rw zipRewrite) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	cw := &countingWriter{w: tmp}
+	w := zip.NewWriter(cw)
+
+	files := r.File
+	if rw.order != nil {
+		rank := make(map[string]int, len(rw.order))
+		for i, name := range rw.order {
+			rank[name] = i
+		}
+		at := func(f *zip.File) int {
+			if i, ok := rank[f.Name]; ok {
+				return i
+			}
+			return len(rw.order)
+		}
+		files = append([]*zip.File(nil), r.File...)
+		sort.SliceStable(files, func(i, j int) bool { return at(files[i]) < at(files[j]) })
+	}
+
+	for _, f := range files {
+		if rw.skip != nil && rw.skip(f.Name) {
+			continue
+		}
+		if rw.replace != nil {
+			data, err := rw.replace(f)
+			if err == nil && data != nil {
+				err = writeZipEntry(w, f, data)
+			}
+			if err != nil {
+				tmp.Close()
+				return fmt.Errorf("%s: %v", f.Name, err)
+			}
+			if data != nil {
+				continue
+			}
+		}
+		if err := copyZipEntry(w, cw, f, rw); err != nil {
+			tmp.Close()
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	r.Close()
+	return retryLocked(path, func() error { return os.Rename(tmp.Name(), path) })
+}
+
+// Windows error codes of a file another process has open.
+const (
+	errorAccessDenied     = syscall.Errno(5)
+	errorSharingViolation = syscall.Errno(32)
+	errorLockViolation    = syscall.Errno(33)
+)
+
+// retryLocked runs op, which writes path, again when it fails because
+// another process has path open. On Windows, antivirus software opens every
+// file that is written to scan it, so renaming over a freshly written APK or
+// signing it can fail for a moment with "Access is denied" or a sharing
+// violation. Other errors, and any error on other systems, are returned
+// right away.
+func retryLocked(path string, op func() error) error {
+	delay := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == lockedAttempts || !fileLocked(err) {
+			return err
+		}
+		// On stderr: it's noise in the output, which may be -json.
+		fmt.Fprintf(os.Stderr, "%s is locked by another process (an antivirus scan?), retrying in %s\n", filepath.Base(path), delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// lockedAttempts makes retryLocked give up after waiting about 4s.
+const lockedAttempts = 5
+
+// fileLocked tells access errors of a locked file, from Go or in the output
+// of a Java tool, from other failures.
+func fileLocked(err error) bool {
+	if runtime.GOOS != "windows" {
+		return false
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno == errorAccessDenied || errno == errorSharingViolation || errno == errorLockViolation
+	}
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		return strings.Contains(ce.stderr, "being used by another process") ||
+			strings.Contains(ce.stderr, "java.nio.file.AccessDeniedException") ||
+			strings.Contains(ce.stderr, "(Access is denied)")
+	}
+	return false
+}
+
+// writeZipEntry writes data, deflated, as the content of f.
+func writeZipEntry(w *zip.Writer, f *zip.File, data []byte) error {
+	fh := f.FileHeader
+	fh.Extra = stripAlignmentExtra(fh.Extra)
+	fh.Modified = time.Time{}
+	fh.Method = zip.Deflate
+	out, err := w.CreateHeader(&fh)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func copyZipEntry(w *zip.Writer, cw *countingWriter, f *zip.File, rw zipRewrite) error {
+	fh := f.FileHeader
+	fh.Extra = stripAlignmentExtra(fh.Extra)
+	fh.Flags &^= 0x8 // sizes are known up front, no data descriptor
+	// A non-zero Modified makes the writer append an extended timestamp
+	// field, which would throw off the alignment computed below. The DOS
+	// date and time fields are kept.
+	fh.Modified = time.Time{}
+
+	level, recompressing := compressionLevels[rw.compression]
+	method := f.Method
+	if rw.compression == "store" || (!rw.bundle && alwaysStored(f.Name)) {
+		method = zip.Store
+	}
+
+	var data io.Reader
+	if method == f.Method && (method == zip.Store || !recompressing) {
+		raw, err := f.OpenRaw()
+		if err != nil {
+			return err
+		}
+		data = raw
+	} else {
+		compressed, err := recompress(f, method, level)
+		if err != nil {
+			return err
+		}
+		fh.Method = method
+		fh.CompressedSize64 = uint64(len(compressed))
+		data = bytes.NewReader(compressed)
+	}
+
+	if method == zip.Store && !rw.bundle && !strings.HasSuffix(f.Name, "/") {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		align := int64(4)
+		if strings.HasSuffix(f.Name, ".so") {
+			align = 4096
+		}
+		fh.Extra = append(fh.Extra, alignmentExtra(cw.n, &fh, align)...)
+	}
+
+	out, err := w.CreateRaw(&fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, data)
+	return err
+}
+
+// recompress returns the entry's content encoded with method, deflating at
+// level. The CRC and uncompressed size don't change.
+func recompress(f *zip.File, method uint16, level int) ([]byte, error) {
+	in, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var buf bytes.Buffer
+	if method == zip.Store {
+		_, err = io.Copy(&buf, in)
+		return buf.Bytes(), err
+	}
+
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(fw, in); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// alignmentExtra returns the zipalign-style (0xd935) extra field that pads
+// the entry's data to a multiple of align when its local header starts at
+// offset.
+func alignmentExtra(offset int64, fh *zip.FileHeader, align int64) []byte {
+	const fieldHeader = 6 // ID, size, alignment
+	dataStart := offset + 30 + int64(len(fh.Name)) + int64(len(fh.Extra)) + fieldHeader
+	pad := (align - dataStart%align) % align
+
+	extra := make([]byte, fieldHeader+pad)
+	binary.LittleEndian.PutUint16(extra[0:], 0xd935)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(2+pad))
+	binary.LittleEndian.PutUint16(extra[4:], uint16(align))
+	return extra
+}
+
+// stripAlignmentExtra drops the alignment padding left by zipalign or a
+// previous rewrite, keeping every other extra field.
+func stripAlignmentExtra(extra []byte) []byte {
+	var kept []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if id != 0xd935 {
+			kept = append(kept, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return kept
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// packerMarkers maps files shipped by common Android packers (protectors that
+// encrypt the real DEX and load it at runtime) to the packer's name.
+var packerMarkers = map[string]string{
+	"libjiagu.so":         "360 Jiagu",
+	"libjiagu_x86.so":     "360 Jiagu",
+	"libjiagu_a64.so":     "360 Jiagu",
+	"libprotectClass.so":  "360 Jiagu",
+	"libsecexe.so":        "Bangcle",
+	"libsecmain.so":       "Bangcle",
+	"secData0.jar":        "Bangcle",
+	"libDexHelper.so":     "SecNeo",
+	"libDexHelper-x86.so": "SecNeo",
+	"libexec.so":          "Ijiami",
+	"libexecmain.so":      "Ijiami",
+	"ijiami.dat":          "Ijiami",
+	"libshella.so":        "Tencent Legu",
+	"libshellx.so":        "Tencent Legu",
+	"libtup.so":           "Tencent Legu",
+	"libbaiduprotect.so":  "Baidu",
+	"libmobisec.so":       "Alibaba",
+	"libnqshield.so":      "NQ Shield",
+	"libAPKProtect.so":    "APKProtect",
+	"libapssec.so":        "Ali Security",
+	"libdexprotector.so":  "DexProtector",
+}
+
+// packedDexLimit is the classes.dex size below which a packer marker is
+// taken to mean the DEX is only a loader stub.
+const packedDexLimit = 128 << 10
+
+// detectPacker returns the name of the packer apk appears to be protected
+// with, or "" when it doesn't look packed: that takes a tiny classes.dex
+// and a known packer file under lib/ or assets/.
+func detectPacker(apk string) (string, error) {
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	var packer string
+	tinyDex := false
+	for _, f := range r.File {
+		if f.Name == "classes.dex" {
+			tinyDex = f.UncompressedSize64 < packedDexLimit
+		}
+		if !strings.HasPrefix(f.Name, "lib/") && !strings.HasPrefix(f.Name, "assets/") {
+			continue
+		}
+		if name, ok := packerMarkers[path.Base(f.Name)]; ok {
+			packer = name
+		}
+	}
+	if !tinyDex {
+		return "", nil
+	}
+	return packer, nil
+}
+
+func manifestPackage(manifestPath string) (string, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	m := regexp.MustCompile(`<manifest\b[^>]*\bpackage="([^"]+)"`).FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("no package attribute in %s", manifestPath)
+	}
+	return string(m[1]), nil
+}
+
+// installResult is the device's verdict on an "adb install" attempt.
+type installResult struct {
+	Success bool
+	Code    string // e.g. INSTALL_FAILED_VERIFICATION_FAILURE
+	Message string
+}
+
+// parseInstallOutput extracts the accept/reject reason from "adb install" output.
+// Failures look like "Failure [INSTALL_FAILED_X: details]", optionally prefixed
+// with "adb: failed to install app.apk: " on newer adb releases.
+func parseInstallOutput(output string) installResult {
+	var last string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		last = line
+		if line == "Success" {
+			return installResult{Success: true}
+		}
+		if i := strings.Index(line, "Failure ["); i >= 0 {
+			reason := strings.TrimSuffix(line[i+len("Failure ["):], "]")
+			if strings.TrimSpace(reason) == "" {
+				return installResult{Code: "UNKNOWN", Message: line}
+			}
+			if j := strings.Index(reason, ":"); j >= 0 {
+				return installResult{Code: reason[:j], Message: strings.TrimSpace(reason[j+1:])}
+			}
+			return installResult{Code: reason}
+		}
+	}
+	return installResult{Code: "UNKNOWN", Message: last}
+}
+
+var installHints = map[string]string{
+	"INSTALL_FAILED_VERIFICATION_FAILURE":  "disable adb install verification: adb shell settings put global verifier_verify_adb_installs 0 && adb shell settings put global package_verifier_enable 0",
+	"INSTALL_FAILED_UPDATE_INCOMPATIBLE":   "an installed copy is signed with a different key, uninstall it first",
+	"INSTALL_PARSE_FAILED_NO_CERTIFICATES": "the device rejected the signature, targetSdk 30+ requires an APK Signature Scheme v2 signature",
+	"INSTALL_FAILED_TEST_ONLY":             "the app is marked testOnly, install it with adb install -t",
+	"INSTALL_FAILED_NO_MATCHING_ABIS":      "the APK has no native libraries for the device's ABI",
+	"INSTALL_FAILED_OLDER_SDK":             "the device is older than the app's minSdkVersion",
+}
+
+// adbTransientErrors are adb failures caused by the device briefly dropping
+// off USB, still booting, or the adb server restarting. They're retried.
+var adbTransientErrors = regexp.MustCompile(`(?m)device offline|device (?:'[^']*' )?not found|no devices/emulators found|device still (?:authorizing|connecting)|protocol fault|: closed$|connection reset|cannot connect to daemon|Can't find service: package`)
+
+// adbPermanentErrors are failures that retrying can't fix.
+var adbPermanentErrors = []string{
+	"INSTALL_FAILED_",
+	"INSTALL_PARSE_FAILED_",
+	"unauthorized",
+}
+
+const adbAttempts = 4
+
+// adbRetryable reports whether a failed adb command with this output is
+// worth running again.
+func adbRetryable(output string) bool {
+	for _, s := range adbPermanentErrors {
+		if strings.Contains(output, s) {
+			return false
+		}
+	}
+	return adbTransientErrors.MatchString(output)
+}
+
+// shellQuote quotes s for the device's shell: adb shell joins its arguments
+// with spaces, so a file name with spaces or quotes has to be quoted.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hostQuote quotes s for the shell of this machine: sh, or cmd on Windows.
+func hostQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return cmdQuote(s)
+	}
+	return shellQuote(s)
+}
+
+var plainHostArg = regexp.MustCompile(`^[A-Za-z0-9_./:@+=,-]+$`)
+
+// hostArg is s as an argument of a command line printed for the user to
+// run: as is when no shell would change it, hostQuote'd otherwise. Windows
+// paths keep their backslashes unquoted.
+func hostArg(s string) string {
+	plain := s
+	if runtime.GOOS == "windows" {
+		plain = strings.ReplaceAll(s, "\\", "/")
+	}
+	if plainHostArg.MatchString(plain) {
+		return s
+	}
+	return hostQuote(s)
+}
+
+// cmdQuote quotes s for cmd, as an argument of a program: in double quotes,
+// with the backslashes before a quote doubled. When s has a quote, % or !,
+// which cmd acts on even in quotes, all of cmd's special characters are
+// escaped with ^, the quotes included, so that none of it is left to cmd.
+func cmdQuote(s string) string {
+	var q strings.Builder
+	q.WriteByte('"')
+	slashes := 0
+	for _, c := range s {
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			q.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		q.WriteRune(c)
+	}
+	q.WriteString(strings.Repeat(`\`, slashes))
+	q.WriteByte('"')
+	if !strings.ContainsAny(s, `"%!`) {
+		return q.String()
+	}
+
+	var escaped strings.Builder
+	for _, c := range q.String() {
+		if strings.ContainsRune(`^"%!&|<>()`, c) {
+			escaped.WriteByte('^')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// adb runs an adb command against serial (any device when empty), retrying
+// with backoff while it fails with a transient error.
+func adb(serial string, args ...string) ([]byte, error) {
+	command := args[0]
+	if serial != "" {
+		args = append([]string{"-s", serial}, args...)
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		output, err := exec.Command("adb", args...).CombinedOutput()
+		if err == nil || attempt == adbAttempts || !adbRetryable(string(output)) {
+			return output, err
+		}
+		if verbose {
+			fmt.Printf("adb %s: %s, retrying in %s (attempt %d/%d)\n", command, lastLine(string(output)), delay, attempt+1, adbAttempts)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// deviceABI returns the ABI whose native libraries from apk the device will
+// load: the first one it supports that the APK has. It's "" when the APK
+// has no native libraries, and an error when none of them suit the device.
+func deviceABI(serial, apk string) (string, error) {
+	names, err := zipEntryNames(apk)
+	if err != nil {
+		return "", err
+	}
+	var apkABIs []string
+	has := map[string]bool{}
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) == 3 && parts[0] == "lib" && strings.HasSuffix(parts[2], ".so") && !has[parts[1]] {
+			has[parts[1]] = true
+			apkABIs = append(apkABIs, parts[1])
+		}
+	}
+	if len(apkABIs) == 0 {
+		return "", nil
+	}
+
+	output, err := adb(serial, "shell", "getprop", "ro.product.cpu.abilist")
+	if err != nil {
+		return "", fmt.Errorf("reading its ABIs: %v", err)
+	}
+	abilist := strings.TrimSpace(string(output))
+	if abilist == "" {
+		// Before Android 5.0 there's only the primary ABI.
+		if output, err = adb(serial, "shell", "getprop", "ro.product.cpu.abi"); err != nil {
+			return "", fmt.Errorf("reading its ABIs: %v", err)
+		}
+		abilist = strings.TrimSpace(string(output))
+	}
+	for _, abi := range strings.Split(abilist, ",") {
+		if has[abi] {
+			return abi, nil
+		}
+	}
+	return "", fmt.Errorf("the device supports %s but the APK only has native libraries for %s", strings.ReplaceAll(abilist, ",", ", "), strings.Join(apkABIs, ", "))
+}
+
+// deviceStates returns the state adb reports for each device, e.g.
+// "device", "offline" or "unauthorized".
+func deviceStates() (map[string]string, error) {
+	output, err := adb("", "devices")
+	if err != nil {
+		return nil, fmt.Errorf("adb devices: %s", lastLine(string(output)))
+	}
+
+	states := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			states[fields[0]] = fields[1]
+		}
+	}
+	return states, nil
+}
+
+func connectedDevices() ([]string, error) {
+	states, err := deviceStates()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for serial, state := range states {
+		if state == "device" {
+			devices = append(devices, serial)
+		}
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// waitForDevice waits until serial (or any device) is online, giving up at
+// deadline. When no device showed up in time it returns the reason.
+func waitForDevice(serial string, deadline time.Time) (reason string, err error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	args := []string{"wait-for-device"}
+	if serial != "" {
+		args = append([]string{"-s", serial}, args...)
+	}
+	output, err := exec.CommandContext(ctx, "adb", args...).CombinedOutput()
+	switch {
+	case ctx.Err() != nil:
+		// Don't make people wait for a device that needs their attention.
+		states, err := deviceStates()
+		if err != nil {
+			return "", err
+		}
+		for s, state := range states {
+			if state == "unauthorized" && (serial == "" || s == serial) {
+				return fmt.Sprintf("device %s is unauthorized, accept the USB debugging prompt on it", s), nil
+			}
+		}
+		return fmt.Sprintf("no device came online within %ds", deviceTimeout), nil
+	case err != nil && strings.Contains(string(output), "more than one"):
+		// Several devices are online, selectDevice asks for ANDROID_SERIAL.
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("adb wait-for-device: %s", lastLine(string(output)))
+	}
+	return "", nil
+}
+
+// waitForBoot waits until the device reports sys.boot_completed, since the
+// package manager isn't usable before then.
+func waitForBoot(serial string, deadline time.Time) (reason string) {
+	for {
+		output, err := adb(serial, "shell", "getprop", "sys.boot_completed")
+		if err == nil && strings.TrimSpace(string(output)) == "1" {
+			return ""
+		}
+		if time.Now().After(deadline) {
+			return fmt.Sprintf("device %s didn't finish booting within %ds", serial, deviceTimeout)
+		}
+		fmt.Printf("Waiting for device %s to finish booting...\n", serial)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// selectDevice picks the adb device to use: $ANDROID_SERIAL, or the only
+// connected one. When there's nothing to pick it returns the reason instead.
+func selectDevice() (serial, reason string, err error) {
+	if _, err := exec.LookPath("adb"); err != nil {
+		return "", "adb is not installed", nil
+	}
+
+	deadline := time.Now().Add(time.Duration(deviceTimeout) * time.Second)
+	serial = os.Getenv("ANDROID_SERIAL")
+	if reason, err := waitForDevice(serial, deadline); reason != "" || err != nil {
+		return "", reason, err
+	}
+
+	devices, err := connectedDevices()
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case len(devices) == 0:
+		return "", "no device connected", nil
+	case serial == "" && len(devices) > 1:
+		return "", "multiple devices connected, set ANDROID_SERIAL to pick one", nil
+	case serial == "":
+		serial = devices[0]
+	}
+
+	if reason := waitForBoot(serial, deadline); reason != "" {
+		return "", reason, nil
+	}
+	return serial, "", nil
+}
+
+func installOnDevice(serial, apk string) error {
+	args, err := installArgs(apk)
+	if err != nil {
+		return err
+	}
+	output, _ := adb(serial, append(append([]string{"install", "--no-streaming"}, args...), apk)...)
+	result := parseInstallOutput(string(output))
+	if !result.Success {
+		fmt.Printf("Device %s rejected the APK: %s %s\n", serial, result.Code, result.Message)
+		if hint, ok := installHints[result.Code]; ok {
+			fmt.Println("Hint:", hint)
+		}
+		return fmt.Errorf("%s", result.Code)
+	}
+	fmt.Printf("Device %s accepted the APK.\n", serial)
+	return nil
+}
+
+// installMultipleOnDevice installs a base APK and its splits in one session,
+// so that either all of them or none go in. adb install-multiple does that;
+// when it fails without the device giving a reason, as some adb and device
+// combinations do, the session is run with pm by hand.
+func installMultipleOnDevice(serial string, apks []string) error {
+	args, err := installArgs(apks[0])
+	if err != nil {
+		return err
+	}
+	output, _ := adb(serial, append(append([]string{"install-multiple", "--no-streaming"}, args...), apks...)...)
+	result := parseInstallOutput(string(output))
+	if result.Code == "UNKNOWN" {
+		fmt.Printf("adb install-multiple failed (%s), installing through a pm session instead\n", result.Message)
+		result = pmInstallSession(serial, apks, args)
+	}
+	if !result.Success {
+		fmt.Printf("Device %s rejected the APKs: %s %s\n", serial, result.Code, result.Message)
+		if hint, ok := installHints[result.Code]; ok {
+			fmt.Println("Hint:", hint)
+		}
+		return fmt.Errorf("%s", result.Code)
+	}
+	fmt.Printf("Device %s accepted the %d APKs.\n", serial, len(apks))
+	return nil
+}
+
+var pmSessionPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+// pmInstallSession installs apks with pm install-create, given the
+// installArgs, install-write and install-commit, from copies in
+// /data/local/tmp. A session that fails before its commit is abandoned,
+// which leaves the device as it was.
+func pmInstallSession(serial string, apks, args []string) installResult {
+	fail := func(step string, output []byte) installResult {
+		if result := parseInstallOutput(string(output)); result.Code != "UNKNOWN" {
+			return result
+		}
+		return installResult{Code: "SESSION_FAILED", Message: step + ": " + lastLine(string(output))}
+	}
+
+	output, err := adb(serial, append([]string{"shell", "pm", "install-create"}, args...)...)
+	m := pmSessionPattern.FindSubmatch(output)
+	if err != nil || m == nil {
+		return fail("pm install-create", output)
+	}
+	session := string(m[1])
+
+	var pushed []string
+	defer func() {
+		if len(pushed) > 0 {
+			adb(serial, append([]string{"shell", "rm", "-f"}, pushed...)...)
+		}
+	}()
+	for i, apk := range apks {
+		info, err := os.Stat(apk)
+		if err != nil {
+			adb(serial, "shell", "pm", "install-abandon", session)
+			return installResult{Code: "SESSION_FAILED", Message: err.Error()}
+		}
+		remote := fmt.Sprintf("/data/local/tmp/rsiw-%s-%d.apk", session, i)
+		if output, err := adb(serial, "push", apk, remote); err != nil {
+			adb(serial, "shell", "pm", "install-abandon", session)
+			return fail("push "+filepath.Base(apk), output)
+		}
+		pushed = append(pushed, remote)
+		output, err := adb(serial, "shell", "pm", "install-write", "-S", strconv.FormatInt(info.Size(), 10), session, shellQuote(fmt.Sprintf("%d_%s", i, filepath.Base(apk))), remote)
+		if err != nil || !bytes.Contains(output, []byte("Success")) {
+			adb(serial, "shell", "pm", "install-abandon", session)
+			return fail("pm install-write "+filepath.Base(apk), output)
+		}
+	}
+
+	output, _ = adb(serial, "shell", "pm", "install-commit", session)
+	if result := parseInstallOutput(string(output)); result.Success || result.Code != "UNKNOWN" {
+		return result
+	}
+	return fail("pm install-commit", output)
+}
+
+func uninstallFromDevice(serial, pkg string) error {
+	output, err := adb(serial, "uninstall", pkg)
+	if err != nil {
+		return fmt.Errorf("uninstall %s: %s", pkg, strings.TrimSpace(string(output)))
+	}
+	fmt.Println("Uninstalled", pkg)
+	return nil
+}
+
+// debuggableCheck is the outcome of the -verify-install probes.
+type debuggableCheck struct {
+	Debuggable bool         `json:"debuggable"`
+	Probes     []debugProbe `json:"probes"`
+}
+
+type debugProbe struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checkDebuggable asks the device whether pkg is debuggable, three ways:
+// run-as only works for debuggable apps, dumpsys shows the DEBUGGABLE
+// package flag, and a debuggable process shows up in "adb jdwp". run-as also
+// fails for unrelated reasons (e.g. storage still locked after a reboot), so
+// only its "not debuggable" answer counts against the verdict.
+func checkDebuggable(serial, pkg string) *debuggableCheck {
+	check := &debuggableCheck{Debuggable: true}
+	probe := func(name string, passed bool, detail string, counts bool) {
+		check.Probes = append(check.Probes, debugProbe{Name: name, Passed: passed, Detail: detail})
+		if !passed && counts {
+			check.Debuggable = false
+		}
+	}
+
+	output, err := adb(serial, "shell", "run-as", pkg, "id")
+	switch out := strings.TrimSpace(string(output)); {
+	case err == nil && strings.Contains(out, "uid="):
+		probe("run-as", true, out, true)
+	case strings.Contains(out, "not debuggable"):
+		probe("run-as", false, lastLine(out), true)
+	default:
+		probe("run-as", false, lastLine(out)+" (not counted, run-as can fail for other reasons)", false)
+	}
+
+	output, err = adb(serial, "shell", "dumpsys", "package", pkg)
+	switch flags := pkgFlagsPattern.FindString(string(output)); {
+	case err != nil || flags == "":
+		probe("pkgFlags", false, "no pkgFlags in dumpsys package "+pkg, true)
+	default:
+		probe("pkgFlags", strings.Contains(flags, " DEBUGGABLE "), flags, true)
+	}
+
+	pid, err := launchForJDWP(serial, pkg)
+	switch {
+	case err != nil:
+		probe("jdwp", false, err.Error(), true)
+	case jdwpHasPid(serial, pid):
+		probe("jdwp", true, "pid "+pid, true)
+	default:
+		probe("jdwp", false, "pid "+pid+" is not listed by adb jdwp", true)
+	}
+	adb(serial, "shell", "am", "force-stop", pkg)
+	return check
+}
+
+var pkgFlagsPattern = regexp.MustCompile(`pkgFlags=\[[^\]]*\]`)
+
+// launchForJDWP starts the app and returns the pid of its process once it
+// shows up.
+func launchForJDWP(serial, pkg string) (string, error) {
+	if output, err := adb(serial, "shell", "monkey", "-p", pkg, "-c", "android.intent.category.LAUNCHER", "1"); err != nil || bytes.Contains(output, []byte("No activities found")) {
+		return "", fmt.Errorf("launch %s: %s", pkg, lastLine(string(output)))
+	}
+	for i := 0; i < 10; i++ {
+		if output, err := adb(serial, "shell", "pidof", pkg); err == nil {
+			if fields := strings.Fields(string(output)); len(fields) > 0 {
+				return fields[0], nil
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return "", fmt.Errorf("%s has no process after the launch", pkg)
+}
+
+// jdwpHasPid reports whether pid is among the debuggable processes of the
+// device. "adb jdwp" keeps tracking them until killed, so it only gets a few
+// seconds to print the list.
+func jdwpHasPid(serial, pid string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	output, _ := exec.CommandContext(ctx, "adb", "-s", serial, "jdwp").Output()
+	for _, line := range strings.Fields(string(output)) {
+		if line == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// smokeResult is the outcome of -smoke-test.
+type smokeResult struct {
+	Passed      bool   `json:"passed"`
+	Alive       bool   `json:"alive"`
+	TopActivity string `json:"topActivity,omitempty"`
+	Crash       string `json:"crash,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// runSmokeTest launches the app, waits, and checks that its process is still
+// alive, that it owns the top activity, and that logcat has no fatal
+// exception from it.
+func runSmokeTest(serial, pkg string, wait time.Duration) (*smokeResult, error) {
+	if output, err := adb(serial, "logcat", "-c"); err != nil {
+		return nil, fmt.Errorf("clear logcat: %s", strings.TrimSpace(string(output)))
+	}
+	if output, err := adb(serial, "shell", "monkey", "-p", pkg, "-c", "android.intent.category.LAUNCHER", "1"); err != nil || bytes.Contains(output, []byte("No activities found")) {
+		return nil, fmt.Errorf("launch %s: %s", pkg, strings.TrimSpace(string(output)))
+	}
+	time.Sleep(wait)
+
+	result := &smokeResult{}
+	if output, err := adb(serial, "shell", "pidof", pkg); err == nil && len(bytes.TrimSpace(output)) > 0 {
+		result.Alive = true
+	}
+	if output, err := adb(serial, "shell", "dumpsys", "activity", "activities"); err == nil {
+		result.TopActivity = resumedActivity(string(output))
+	}
+	if output, err := adb(serial, "logcat", "-d", "-v", "threadtime", "AndroidRuntime:E", "*:S"); err == nil {
+		result.Crash = fatalException(string(output), pkg)
+	}
+
+	switch {
+	case result.Crash != "":
+		result.Reason = "the app crashed"
+	case !result.Alive:
+		result.Reason = "the app's process is not running"
+	case !strings.HasPrefix(result.TopActivity, pkg+"/"):
+		result.Reason = "the top activity doesn't belong to " + pkg
+	default:
+		result.Passed = true
+	}
+	return result, nil
+}
+
+var resumedActivityPattern = regexp.MustCompile(`(?:mResumedActivity|topResumedActivity|ResumedActivity)[:=].*?\s([\w.]+/[\w.$]+)`)
+
+// resumedActivity extracts the component of the resumed activity from
+// "dumpsys activity activities" output.
+func resumedActivity(dumpsys string) string {
+	if m := resumedActivityPattern.FindStringSubmatch(dumpsys); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// fatalException returns the AndroidRuntime "FATAL EXCEPTION" block logged
+// for pkg, or "" when the app didn't crash.
+func fatalException(logcat, pkg string) string {
+	var block []string
+	var found string
+	flush := func() {
+		for _, line := range block {
+			if strings.Contains(line, "Process: "+pkg+",") {
+				found = strings.Join(block, "\n")
+			}
+		}
+		block = nil
+	}
+
+	for _, line := range strings.Split(logcat, "\n") {
+		i := strings.Index(line, "AndroidRuntime: ")
+		if i < 0 {
+			continue
+		}
+		msg := strings.TrimRight(line[i+len("AndroidRuntime: "):], "\r")
+		if strings.HasPrefix(msg, "FATAL EXCEPTION") {
+			flush()
+		}
+		if block != nil || strings.HasPrefix(msg, "FATAL EXCEPTION") {
+			block = append(block, msg)
+		}
+	}
+	flush()
+	return found
 }
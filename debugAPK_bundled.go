@@ -0,0 +1,51 @@
+//go:build bundled
+
+package main
+
+/*
+
+Embeds a known-good apktool jar so debugAPK only needs a JRE. The jar isn't
+checked in; fetch it, and record its version and checksum, before building:
+
+	curl -Lo apktool_bundled.jar https://github.com/iBotPeaches/Apktool/releases/download/v2.9.3/apktool_2.9.3.jar
+	echo 2.9.3 > apktool_bundled.version
+	sha256sum apktool_bundled.jar | cut -d' ' -f1 > apktool_bundled.sha256
+
+Then build or run it together with debugAPK.go, with the bundled tag:
+
+	go run -tags bundled debugAPK.go debugAPK_bundled.go [OPTIONS] <APK_FILE>
+	go build -tags bundled -o debugAPK debugAPK.go debugAPK_bundled.go
+
+The tag keeps this file, and the jar it needs, out of any build that doesn't
+ask for it. The slim build names debugAPK.go alone:
+
+	go run debugAPK.go [OPTIONS] <APK_FILE>
+	go build -o debugAPK debugAPK.go
+
+The directory isn't a buildable package (subzero.go has a main of its own),
+so "go build ." doesn't work either way.
+
+*/
+
+import (
+	_ "embed"
+	"strings"
+)
+
+//go:embed apktool_bundled.jar
+var bundledJarData []byte
+
+//go:embed apktool_bundled.version
+var bundledJarVersion string
+
+//go:embed apktool_bundled.sha256
+var bundledJarSHA256 string
+
+func init() {
+	bundledApktool = &bundledJar{
+		version: strings.TrimSpace(bundledJarVersion),
+		sha256:  strings.TrimSpace(bundledJarSHA256),
+		data:    bundledJarData,
+	}
+	apktoolChecksums[bundledApktool.version] = bundledApktool.sha256
+}
@@ -0,0 +1,75 @@
+//go:build windows
+
+package main
+
+// Tests of the parts of debugAPK.go that only Windows has. Run them with the
+// file they test and the other tests:
+//
+//	go test debugAPK.go debugAPK_test.go debugAPK_windows_test.go
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFileLockedErrors(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&os.LinkError{Op: "rename", Err: errorAccessDenied}, true},
+		{&os.PathError{Op: "open", Err: errorSharingViolation}, true},
+		{&os.PathError{Op: "open", Err: errorLockViolation}, true},
+		{&cmdError{err: os.ErrInvalid, stderr: "The process cannot access the file because it is being used by another process"}, true},
+		{&os.PathError{Op: "open", Err: syscall.ERROR_FILE_NOT_FOUND}, false},
+		{&cmdError{err: os.ErrInvalid, stderr: "ERROR: invalid APK"}, false},
+	} {
+		if got := fileLocked(c.err); got != c.want {
+			t.Errorf("fileLocked(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryLockedRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.apk")
+	tmp := filepath.Join(dir, "app.apk.tmp")
+	for _, file := range []string{path, tmp} {
+		if err := os.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Like a virus scanner, hold the APK open for a moment: Go opens files
+	// without FILE_SHARE_DELETE, so renaming over it is denied meanwhile.
+	scanner, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); !fileLocked(err) {
+		scanner.Close()
+		t.Fatalf("renaming over an open file: %v, want a locked file error", err)
+	}
+	go func() {
+		time.Sleep(400 * time.Millisecond)
+		scanner.Close()
+	}()
+
+	attempts := 0
+	err = retryLocked(path, func() error {
+		attempts++
+		return os.Rename(tmp, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts < 2 {
+		t.Errorf("%d attempts, want a retry", attempts)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != tmp {
+		t.Errorf("%s has %q, %v after the rename", path, data, err)
+	}
+}